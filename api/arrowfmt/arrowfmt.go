@@ -0,0 +1,144 @@
+// Package arrowfmt writes query results as Apache Arrow IPC streams. Importing
+// it makes api.QueryResult.Write support api.FormatArrow, without the
+// dependency on Arrow for the users of the other formats.
+package arrowfmt
+
+import (
+	"io"
+	"sort"
+
+	"github.com/apache/arrow/go/v10/arrow"
+	"github.com/apache/arrow/go/v10/arrow/array"
+	"github.com/apache/arrow/go/v10/arrow/ipc"
+	"github.com/apache/arrow/go/v10/arrow/memory"
+
+	"github.com/lwangrabbit/prom-query/api"
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+func init() {
+	api.RegisterFormat(api.FormatArrow, WriteMatrix)
+}
+
+// batchSize is the number of rows of the record batches.
+const batchSize = 64 * 1024
+
+// WriteMatrix writes mat as the Arrow IPC stream of api.FormatArrow: a
+// nullable string column per label name, followed by the timestamp and value
+// columns.
+func WriteMatrix(w io.Writer, mat value.Matrix) error {
+	names := labelNames(mat)
+	fields := make([]arrow.Field, 0, len(names)+2)
+	for _, name := range labelColumns(names) {
+		fields = append(fields, arrow.Field{Name: name, Type: arrow.BinaryTypes.String, Nullable: true})
+	}
+	fields = append(fields,
+		arrow.Field{Name: "timestamp", Type: &arrow.TimestampType{Unit: arrow.Second}},
+		arrow.Field{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+	)
+	schema := arrow.NewSchema(fields, nil)
+
+	mem := memory.NewGoAllocator()
+	b := array.NewRecordBuilder(mem, schema)
+	defer b.Release()
+	iw := ipc.NewWriter(w, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+
+	var (
+		vals       = make([]string, len(names))
+		present    = make([]bool, len(names))
+		timestamps = b.Field(len(names)).(*array.TimestampBuilder)
+		values     = b.Field(len(names) + 1).(*array.Float64Builder)
+		rows       int
+	)
+	flush := func() error {
+		rec := b.NewRecord()
+		defer rec.Release()
+		rows = 0
+		return iw.Write(rec)
+	}
+	for _, s := range mat {
+		labelValues(vals, present, names, s.Metric)
+		for _, p := range s.Points {
+			for i, v := range vals {
+				col := b.Field(i).(*array.StringBuilder)
+				if present[i] {
+					col.Append(v)
+				} else {
+					col.AppendNull()
+				}
+			}
+			timestamps.Append(arrow.Timestamp(p.T))
+			values.Append(p.V)
+			if rows++; rows == batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if rows > 0 || len(mat) == 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return iw.Close()
+}
+
+// labelColumns returns the names of the columns of the given label names,
+// which precede the timestamp and value columns. Labels named after those are
+// prefixed with "exported_", as Prometheus does with conflicting target
+// labels, as many times as needed for the names to be unique.
+func labelColumns(names []string) []string {
+	taken := map[string]struct{}{"timestamp": {}, "value": {}}
+	for _, name := range names {
+		taken[name] = struct{}{}
+	}
+	cols := make([]string, len(names))
+	for i, name := range names {
+		if name == "timestamp" || name == "value" {
+			for {
+				name = "exported_" + name
+				if _, ok := taken[name]; !ok {
+					break
+				}
+			}
+			taken[name] = struct{}{}
+		}
+		cols[i] = name
+	}
+	return cols
+}
+
+// labelNames returns the sorted label names of the series of mat.
+func labelNames(mat value.Matrix) []string {
+	seen := map[string]struct{}{}
+	var names []string
+	for _, s := range mat {
+		for _, l := range s.Metric {
+			if _, ok := seen[l.Name]; !ok {
+				seen[l.Name] = struct{}{}
+				names = append(names, l.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelValues sets the values of the given label names in ls into vals, and
+// whether ls has them into present. Both names and ls are sorted.
+func labelValues(vals []string, present []bool, names []string, ls labels.Labels) {
+	j := 0
+	for i, name := range names {
+		for j < len(ls) && ls[j].Name < name {
+			j++
+		}
+		present[i] = j < len(ls) && ls[j].Name == name
+		if present[i] {
+			vals[i] = ls[j].Value
+		} else {
+			vals[i] = ""
+		}
+	}
+}
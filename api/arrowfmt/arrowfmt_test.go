@@ -0,0 +1,76 @@
+package arrowfmt_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow/go/v10/arrow/array"
+	"github.com/apache/arrow/go/v10/arrow/ipc"
+
+	"github.com/lwangrabbit/prom-query/api"
+	_ "github.com/lwangrabbit/prom-query/api/arrowfmt"
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+func TestWriteArrow(t *testing.T) {
+	res := &api.QueryResult{Data: &api.QueryData{Result: value.Matrix{
+		{Metric: labels.FromStrings("__name__", "up", "job", "node"), Points: []value.Point{{T: 10, V: 1}, {T: 20, V: 2}}},
+		{Metric: labels.FromStrings("__name__", "up"), Points: []value.Point{{T: 10, V: 3}}},
+	}}}
+	var buf bytes.Buffer
+	if err := res.Write(&buf, api.FormatArrow); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	var names []string
+	for _, f := range r.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	if expected := []string{"__name__", "job", "timestamp", "value"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the columns %v, got %v", expected, names)
+	}
+	if !r.Next() {
+		t.Fatal("expected a record")
+	}
+	rec := r.Record()
+	if rec.NumRows() != 3 {
+		t.Fatalf("expected 3 rows, got %d", rec.NumRows())
+	}
+	jobs := rec.Column(1).(*array.String)
+	if jobs.Value(0) != "node" || !jobs.IsNull(2) {
+		t.Errorf("expected the job of the first series and null for the second one, got %v", jobs)
+	}
+	if values := rec.Column(3).(*array.Float64); values.Value(2) != 3 {
+		t.Errorf("expected 3 as last value, got %v", values)
+	}
+}
+
+func TestWriteArrowConflictingLabels(t *testing.T) {
+	res := &api.QueryResult{Data: &api.QueryData{Result: value.Matrix{
+		{Metric: labels.FromStrings("timestamp", "a", "value", "b"), Points: []value.Point{{T: 10, V: 1}}},
+	}}}
+	var buf bytes.Buffer
+	if err := res.Write(&buf, api.FormatArrow); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	var names []string
+	for _, f := range r.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	if expected := []string{"exported_timestamp", "exported_value", "timestamp", "value"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the columns %v, got %v", expected, names)
+	}
+}
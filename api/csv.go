@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// writeCSV writes mat in the long layout of FormatCSV.
+func writeCSV(w io.Writer, mat value.Matrix) error {
+	cw := csv.NewWriter(w)
+	names := labelNames(mat)
+	record := append(labelColumns(names), "timestamp", "value")
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+	for _, s := range mat {
+		labelValues(record, names, s.Metric)
+		for _, p := range s.Points {
+			record[len(names)] = strconv.FormatInt(p.T, 10)
+			record[len(names)+1] = strconv.FormatFloat(p.V, 'f', -1, 64)
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeWideCSV writes mat in the wide layout of FormatWideCSV. The value
+// columns are named after the labels of their series.
+func writeWideCSV(w io.Writer, mat value.Matrix) error {
+	cw := csv.NewWriter(w)
+	record := make([]string, len(mat)+1)
+	record[0] = "timestamp"
+	for i, s := range mat {
+		record[i+1] = s.Metric.String()
+	}
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+
+	var timestamps []int64
+	seen := map[int64]struct{}{}
+	for _, s := range mat {
+		for _, p := range s.Points {
+			if _, ok := seen[p.T]; !ok {
+				seen[p.T] = struct{}{}
+				timestamps = append(timestamps, p.T)
+			}
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	// The points of each series are ordered by time, so one cursor per
+	// series walks them along the timestamps.
+	cursors := make([]int, len(mat))
+	for _, t := range timestamps {
+		record[0] = strconv.FormatInt(t, 10)
+		for i, s := range mat {
+			record[i+1] = ""
+			if c := cursors[i]; c < len(s.Points) && s.Points[c].T == t {
+				record[i+1] = strconv.FormatFloat(s.Points[c].V, 'f', -1, 64)
+				cursors[i]++
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
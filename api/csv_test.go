@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+func TestWriteCSV(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mat      value.Matrix
+		expected string
+	}{
+		{
+			name: "missing labels",
+			mat: value.Matrix{
+				{Metric: labels.FromStrings("__name__", "up", "job", "node"), Points: []value.Point{{T: 10, V: 1}, {T: 20, V: 0.5}}},
+				{Metric: labels.FromStrings("__name__", "up", "instance", "a:9100"), Points: []value.Point{{T: 10, V: math.NaN()}}},
+				{Metric: labels.FromStrings("job", `say "hi", bye`), Points: []value.Point{{T: 10, V: math.Inf(-1)}}},
+				{Metric: labels.FromStrings("job", "empty"), Points: nil},
+			},
+			expected: "__name__,instance,job,timestamp,value\n" +
+				"up,,node,10,1\n" +
+				"up,,node,20,0.5\n" +
+				"up,a:9100,,10,NaN\n" +
+				",,\"say \"\"hi\"\", bye\",10,-Inf\n",
+		},
+		{
+			name: "conflicting labels",
+			mat: value.Matrix{
+				{Metric: labels.FromStrings("exported_value", "a", "timestamp", "b", "value", "c"), Points: []value.Point{{T: 10, V: 1}}},
+			},
+			expected: "exported_value,exported_timestamp,exported_exported_value,timestamp,value\n" +
+				"a,b,c,10,1\n",
+		},
+		{
+			name:     "no series",
+			mat:      nil,
+			expected: "timestamp,value\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeCSV(&buf, tc.mat); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteWideCSV(t *testing.T) {
+	// The series have points at timestamps the others lack.
+	mat := value.Matrix{
+		{Metric: labels.FromStrings("__name__", "up", "job", "a"), Points: []value.Point{{T: 10, V: 1}, {T: 30, V: 3}}},
+		{Metric: labels.FromStrings("__name__", "up", "job", "b"), Points: []value.Point{{T: 20, V: 2}, {T: 30, V: 4}, {T: 40, V: 5}}},
+		{Metric: labels.FromStrings("__name__", "up", "job", "c"), Points: []value.Point{{T: 5, V: 0}}},
+		{Metric: labels.FromStrings("__name__", "up", "job", "d"), Points: nil},
+	}
+	expected := `timestamp,"{__name__=""up"", job=""a""}","{__name__=""up"", job=""b""}",` +
+		`"{__name__=""up"", job=""c""}","{__name__=""up"", job=""d""}"` + "\n" +
+		"5,,,0,\n" +
+		"10,1,,,\n" +
+		"20,,2,,\n" +
+		"30,3,4,,\n" +
+		"40,,5,,\n"
+	var buf bytes.Buffer
+	if err := writeWideCSV(&buf, mat); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
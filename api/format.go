@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// Format is an output format of query results.
+type Format int
+
+// The output formats.
+const (
+	// FormatJSON is the JSON format of the Prometheus HTTP API.
+	FormatJSON Format = iota
+	// FormatCSV has one row per sample, with a column per label name
+	// followed by the timestamp and value columns. The columns of labels
+	// named timestamp or value are prefixed with "exported_".
+	FormatCSV
+	// FormatWideCSV has one row per timestamp, with the timestamp column
+	// followed by a value column per series.
+	FormatWideCSV
+	// FormatProtobuf is a stream of prompb.TimeSeries messages, each
+	// preceded by its varint encoded size.
+	FormatProtobuf
+	// FormatArrow is an Apache Arrow IPC stream with the columns of
+	// FormatCSV. It requires importing api/arrowfmt.
+	FormatArrow
+)
+
+// formatWriters write the formats registered by other packages.
+var formatWriters = map[Format]func(io.Writer, value.Matrix) error{}
+
+// RegisterFormat makes Write write the results in format f with write. It is
+// called by the packages implementing the formats with dependencies of their
+// own, such as api/arrowfmt, when imported.
+func RegisterFormat(f Format, write func(io.Writer, value.Matrix) error) {
+	formatWriters[f] = write
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatCSV:
+		return "csv"
+	case FormatWideCSV:
+		return "wide csv"
+	case FormatProtobuf:
+		return "protobuf"
+	case FormatArrow:
+		return "arrow"
+	default:
+		return fmt.Sprintf("format(%d)", int(f))
+	}
+}
+
+// ContentType returns the media type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV, FormatWideCSV:
+		return "text/csv; charset=utf-8"
+	case FormatProtobuf:
+		return "application/x-protobuf; proto=prometheus.TimeSeries; encoding=delimited"
+	case FormatArrow:
+		return "application/vnd.apache.arrow.stream"
+	default:
+		return "application/json"
+	}
+}
+
+// Write writes the result to w in the given format. Formats other than JSON
+// only support vector and matrix results of float samples, and timestamps
+// in seconds, except for protobuf which has them in milliseconds.
+func (r *QueryResult) Write(w io.Writer, f Format) error {
+	if f == FormatJSON {
+		return r.WriteJSON(w)
+	}
+	if r.Data == nil {
+		return fmt.Errorf("no result to write as %s", f)
+	}
+	mat, err := resultMatrix(r.Data.Result, f)
+	if err != nil {
+		return err
+	}
+	switch f {
+	case FormatCSV:
+		return writeCSV(w, mat)
+	case FormatWideCSV:
+		return writeWideCSV(w, mat)
+	case FormatProtobuf:
+		return writeProtobuf(w, mat)
+	}
+	if write, ok := formatWriters[f]; ok {
+		return write(w, mat)
+	}
+	if f == FormatArrow {
+		return fmt.Errorf("format %s requires importing github.com/lwangrabbit/prom-query/api/arrowfmt", f)
+	}
+	return fmt.Errorf("unknown format %s", f)
+}
+
+// resultMatrix returns the series of a vector or matrix result, as a matrix.
+func resultMatrix(v value.Value, f Format) (value.Matrix, error) {
+	var mat value.Matrix
+	switch v := v.(type) {
+	case value.Matrix:
+		mat = v
+	case value.Vector:
+		mat = make(value.Matrix, 0, len(v))
+		for _, s := range v {
+			mat = append(mat, value.Series{Metric: s.Metric, Points: []value.Point{s.Point}})
+		}
+	default:
+		return nil, fmt.Errorf("%s results can't be written as %s", v.Type(), f)
+	}
+	for _, s := range mat {
+		for _, p := range s.Points {
+			if p.H != nil {
+				return nil, fmt.Errorf("native histograms can't be written as %s", f)
+			}
+		}
+	}
+	return mat, nil
+}
+
+// labelNames returns the sorted label names of the series of mat.
+func labelNames(mat value.Matrix) []string {
+	seen := map[string]struct{}{}
+	var names []string
+	for _, s := range mat {
+		for _, l := range s.Metric {
+			if _, ok := seen[l.Name]; !ok {
+				seen[l.Name] = struct{}{}
+				names = append(names, l.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelColumns returns the names of the columns of the given label names,
+// which precede the timestamp and value columns. Labels named after those are
+// prefixed with "exported_", as Prometheus does with conflicting target
+// labels, as many times as needed for the names to be unique.
+func labelColumns(names []string) []string {
+	taken := map[string]struct{}{"timestamp": {}, "value": {}}
+	for _, name := range names {
+		taken[name] = struct{}{}
+	}
+	cols := make([]string, len(names))
+	for i, name := range names {
+		if name == "timestamp" || name == "value" {
+			for {
+				name = "exported_" + name
+				if _, ok := taken[name]; !ok {
+					break
+				}
+			}
+			taken[name] = struct{}{}
+		}
+		cols[i] = name
+	}
+	return cols
+}
+
+// labelValues sets the values of the given label names in ls into vals,
+// empty for missing labels. Both names and ls are sorted.
+func labelValues(vals []string, names []string, ls labels.Labels) {
+	j := 0
+	for i, name := range names {
+		for j < len(ls) && ls[j].Name < name {
+			j++
+		}
+		if j < len(ls) && ls[j].Name == name {
+			vals[i] = ls[j].Value
+		} else {
+			vals[i] = ""
+		}
+	}
+}
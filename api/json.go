@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// WriteJSON writes the result to w in the JSON format of the Prometheus HTTP
+// API, the same as json.Marshal. Vectors and matrices are written as they are
+// encoded rather than buffered, without allocating per sample.
+func (r *QueryResult) WriteJSON(w io.Writer) error {
+	jw := &jsonWriter{w: bufio.NewWriterSize(w, 64<<10)}
+	jw.writeString(`{"data":`)
+	if r.Data == nil {
+		jw.writeString("null")
+	} else {
+		jw.writeString(`{"resultType":`)
+		jw.writeQuoted(string(r.Data.ResultType))
+		jw.writeString(`,"result":`)
+		jw.writeValue(r.Data.Result)
+		jw.writeString("}")
+	}
+	jw.writeString(`,"status":`)
+	jw.writeQuoted(r.Status)
+	if len(r.Warnings) > 0 {
+		jw.writeString(`,"warnings":[`)
+		for i, w := range r.Warnings {
+			if i > 0 {
+				jw.writeString(",")
+			}
+			jw.writeQuoted(w)
+		}
+		jw.writeString("]")
+	}
+	jw.writeString("}")
+	if jw.err != nil {
+		return jw.err
+	}
+	return jw.w.Flush()
+}
+
+// jsonWriter writes JSON into a buffered writer, encoding the numbers and
+// strings into a reused scratch buffer. Its first error is kept in err, and
+// later writes are noops.
+type jsonWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+func (jw *jsonWriter) writeString(s string) {
+	if jw.err == nil {
+		_, jw.err = jw.w.WriteString(s)
+	}
+}
+
+func (jw *jsonWriter) flushBuf() {
+	if jw.err == nil {
+		_, jw.err = jw.w.Write(jw.buf)
+	}
+	jw.buf = jw.buf[:0]
+}
+
+func (jw *jsonWriter) writeQuoted(s string) {
+	jw.buf = appendJSONString(jw.buf[:0], s)
+	jw.flushBuf()
+}
+
+func (jw *jsonWriter) writeValue(v value.Value) {
+	switch v := v.(type) {
+	case value.Matrix:
+		if v == nil {
+			jw.writeString("null")
+			return
+		}
+		jw.writeString("[")
+		for i, s := range v {
+			if i > 0 {
+				jw.writeString(",")
+			}
+			jw.writeSeries(s)
+		}
+		jw.writeString("]")
+	case value.Vector:
+		if v == nil {
+			jw.writeString("null")
+			return
+		}
+		jw.writeString("[")
+		for i, s := range v {
+			if i > 0 {
+				jw.writeString(",")
+			}
+			jw.writeString(`{"metric":`)
+			jw.writeLabels(s.Metric)
+			if s.H != nil {
+				jw.writeString(`,"histogram":`)
+			} else {
+				jw.writeString(`,"value":`)
+			}
+			jw.writePoint(s.Point)
+			jw.writeString("}")
+		}
+		jw.writeString("]")
+	default:
+		// Scalars and strings are small.
+		b, err := json.Marshal(v)
+		if err != nil {
+			if jw.err == nil {
+				jw.err = err
+			}
+			return
+		}
+		jw.buf = append(jw.buf[:0], b...)
+		jw.flushBuf()
+	}
+}
+
+func (jw *jsonWriter) writeSeries(s value.Series) {
+	jw.writeString(`{"metric":`)
+	jw.writeLabels(s.Metric)
+	// As in value.Series.MarshalJSON, float and histogram points are listed
+	// separately, each left out if empty.
+	jw.writePoints(s.Points, `,"values":[`, false)
+	jw.writePoints(s.Points, `,"histograms":[`, true)
+	jw.writeString("}")
+}
+
+// writePoints writes the histogram points, or the float points, as the field
+// opened by prefix, unless there are none.
+func (jw *jsonWriter) writePoints(points []value.Point, prefix string, histograms bool) {
+	n := 0
+	for _, p := range points {
+		if (p.H != nil) != histograms {
+			continue
+		}
+		if n == 0 {
+			jw.writeString(prefix)
+		} else {
+			jw.writeString(",")
+		}
+		jw.writePoint(p)
+		n++
+	}
+	if n > 0 {
+		jw.writeString("]")
+	}
+}
+
+// writeLabels writes ls as an object, {} if nil as by labels.Labels.MarshalJSON.
+func (jw *jsonWriter) writeLabels(ls labels.Labels) {
+	b := append(jw.buf[:0], '{')
+	for i, l := range ls {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, l.Name)
+		b = append(b, ':')
+		b = appendJSONString(b, l.Value)
+	}
+	jw.buf = append(b, '}')
+	jw.flushBuf()
+}
+
+func (jw *jsonWriter) writePoint(p value.Point) {
+	b := append(jw.buf[:0], '[')
+	b = appendJSONFloat(b, float64(p.T))
+	b = append(b, ',')
+	if p.H == nil {
+		b = append(b, '"')
+		b = strconv.AppendFloat(b, p.V, 'f', -1, 64)
+		b = append(b, '"')
+	} else {
+		b = appendHistogram(b, p.H)
+	}
+	jw.buf = append(b, ']')
+	jw.flushBuf()
+}
+
+func appendHistogram(b []byte, h *value.Histogram) []byte {
+	b = append(b, `{"count":"`...)
+	b = strconv.AppendFloat(b, h.Count, 'f', -1, 64)
+	b = append(b, `","sum":"`...)
+	b = strconv.AppendFloat(b, h.Sum, 'f', -1, 64)
+	b = append(b, '"')
+	if len(h.Buckets) > 0 {
+		b = append(b, `,"buckets":[`...)
+		for i, bucket := range h.Buckets {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, '[')
+			b = strconv.AppendInt(b, int64(bucket.Boundaries), 10)
+			for _, f := range [...]float64{bucket.Lower, bucket.Upper, bucket.Count} {
+				b = append(b, `,"`...)
+				b = strconv.AppendFloat(b, f, 'f', -1, 64)
+				b = append(b, '"')
+			}
+			b = append(b, ']')
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// appendJSONFloat appends f as encoding/json formats float64 values.
+func appendJSONFloat(b []byte, f float64) []byte {
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9.
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+const hex = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string, escaped as by
+// encoding/json.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hex[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+func TestWriteJSON(t *testing.T) {
+	h := &value.Histogram{
+		Count: 10,
+		Sum:   3.5e-7,
+		Buckets: []value.HistogramBucket{
+			{Boundaries: 0, Lower: -1e22, Upper: 0.25, Count: 4},
+			{Boundaries: 3, Lower: 0.25, Upper: math.Inf(1), Count: 6},
+		},
+	}
+	metric := labels.FromStrings("__name__", "up", "job", `<a&b> "q" \ `+"\n\t\x01 \xff")
+	floats := []value.Point{
+		{T: -60, V: 0}, {T: 0, V: 1.5}, {T: 60, V: math.NaN()}, {T: 120, V: math.Inf(1)},
+		{T: 180, V: math.Inf(-1)}, {T: 240, V: 1e-9}, {T: 300, V: 1e22}, {T: 1e12, V: -3},
+	}
+
+	for _, tc := range []struct {
+		name string
+		res  *QueryResult
+	}{
+		{"matrix", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeMatrix, Result: value.Matrix{
+			{Metric: metric, Points: floats},
+			{Metric: labels.FromStrings("a", "b"), Points: []value.Point{{T: 0, V: 1}, {T: 60, H: h}, {T: 120, V: 2}}},
+			{Metric: labels.FromStrings("a", "c"), Points: []value.Point{{T: 60, H: h}}},
+			{Metric: labels.Labels{}, Points: nil},
+			{Metric: nil, Points: []value.Point{{T: 0, V: 1}}},
+		}}}},
+		{"empty matrix", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeMatrix, Result: value.Matrix{}}}},
+		{"nil matrix", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeMatrix, Result: value.Matrix(nil)}}},
+		{"vector", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeVector, Result: value.Vector{
+			{Metric: metric, Point: value.Point{T: 60, V: 1.5}},
+			{Metric: labels.FromStrings("a", "nan"), Point: value.Point{T: 60, V: math.NaN()}},
+			{Metric: labels.FromStrings("a", "inf"), Point: value.Point{T: 60, V: math.Inf(1)}},
+			{Metric: labels.FromStrings("a", "-inf"), Point: value.Point{T: 60, V: math.Inf(-1)}},
+			{Metric: labels.FromStrings("a", "histogram"), Point: value.Point{T: 60, H: h}},
+			{Metric: labels.FromStrings("a", "empty histogram"), Point: value.Point{T: 60, H: &value.Histogram{}}},
+			{Metric: nil, Point: value.Point{T: 60, V: 1}},
+		}}}},
+		{"empty vector", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeVector, Result: value.Vector{}}}},
+		{"nil vector", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeVector, Result: value.Vector(nil)}}},
+		{"scalar", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeScalar, Result: value.Scalar{T: 60, V: 1.5}}}},
+		{"NaN scalar", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeScalar, Result: value.Scalar{T: 60, V: math.NaN()}}}},
+		{"-Inf scalar", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeScalar, Result: value.Scalar{T: 60, V: math.Inf(-1)}}}},
+		{"string", &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeString, Result: value.String{T: 60, V: `<"a">` + "\n"}}}},
+		{"no data", &QueryResult{Status: "error"}},
+		{"warnings", &QueryResult{Status: "success", Warnings: []string{"a & b", " "}, Data: &QueryData{ResultType: value.ValueTypeVector, Result: value.Vector{}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := json.Marshal(tc.res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := tc.res.WriteJSON(&got); err != nil {
+				t.Fatal(err)
+			}
+			if i := firstDiff(got.Bytes(), want); i >= 0 {
+				t.Fatalf("expected the output of json.Marshal, differing at byte %d:\n%s\ngot:\n%s", i, want[i:], got.Bytes()[i:])
+			}
+		})
+	}
+}
+
+// firstDiff returns the offset of the first byte differing in a and b, or
+// -1 if they are equal.
+func firstDiff(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return len(a)
+		}
+		return len(b)
+	}
+	return -1
+}
+
+func testMatrix(series, points int) value.Matrix {
+	mat := make(value.Matrix, series)
+	for i := range mat {
+		mat[i].Metric = labels.FromStrings("__name__", "up", "instance", fmt.Sprintf("host-%d:9100", i))
+		mat[i].Points = make([]value.Point, points)
+		for j := range mat[i].Points {
+			mat[i].Points[j] = value.Point{T: int64(j) * 15, V: float64(j) / 3}
+		}
+	}
+	return mat
+}
+
+func TestWriteJSONAllocs(t *testing.T) {
+	allocs := func(points int) float64 {
+		res := &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeMatrix, Result: testMatrix(10, points)}}
+		return testing.AllocsPerRun(10, func() {
+			if err := res.WriteJSON(ioutil.Discard); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// The allocations don't depend on the number of points.
+	if few, many := allocs(10), allocs(10000); many > few {
+		t.Fatalf("expected as many allocations for 10000 points as for 10, got %v and %v", many, few)
+	}
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	res := &QueryResult{Status: "success", Data: &QueryData{ResultType: value.ValueTypeMatrix, Result: testMatrix(100, 1000)}}
+	for _, bc := range []struct {
+		name  string
+		write func() error
+	}{
+		{"WriteJSON", func() error { return res.WriteJSON(ioutil.Discard) }},
+		{"Marshal", func() error { _, err := json.Marshal(res); return err }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bc.write(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
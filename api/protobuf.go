@@ -0,0 +1,46 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/prompb"
+)
+
+// writeProtobuf writes mat as the size delimited prompb.TimeSeries messages
+// of FormatProtobuf. Timestamps are in milliseconds, as in remote read.
+func writeProtobuf(w io.Writer, mat value.Matrix) error {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	var (
+		buf  []byte
+		size [binary.MaxVarintLen64]byte
+		ts   prompb.TimeSeries
+	)
+	for _, s := range mat {
+		ts.Labels = ts.Labels[:0]
+		for _, l := range s.Metric {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		ts.Samples = ts.Samples[:0]
+		for _, p := range s.Points {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: p.V, Timestamp: p.T * 1000})
+		}
+
+		n := ts.Size()
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		if _, err := ts.MarshalTo(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(size[:binary.PutUvarint(size[:], uint64(n))]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/prompb"
+)
+
+func TestWriteProtobuf(t *testing.T) {
+	mat := value.Matrix{
+		{Metric: labels.FromStrings("__name__", "up", "job", "node"), Points: []value.Point{{T: 10, V: 1}, {T: 20, V: math.Inf(1)}}},
+		{Metric: labels.FromStrings("__name__", "up"), Points: []value.Point{{T: -10, V: -0.5}}},
+		{Metric: labels.FromStrings("job", "empty"), Points: nil},
+	}
+	res := &QueryResult{Data: &QueryData{Result: mat}}
+	var buf bytes.Buffer
+	if err := res.Write(&buf, FormatProtobuf); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&buf)
+	var got value.Matrix
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		var ts prompb.TimeSeries
+		if err := ts.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		s := value.Series{Metric: labels.Labels{}}
+		for _, l := range ts.Labels {
+			s.Metric = append(s.Metric, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, sample := range ts.Samples {
+			if sample.Timestamp%1000 != 0 {
+				t.Fatalf("expected timestamps in whole seconds, got %d ms", sample.Timestamp)
+			}
+			s.Points = append(s.Points, value.Point{T: sample.Timestamp / 1000, V: sample.Value})
+		}
+		got = append(got, s)
+	}
+	if !reflect.DeepEqual(got, mat) {
+		t.Fatalf("expected %v, got %v", mat, got)
+	}
+}
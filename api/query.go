@@ -6,82 +6,520 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/go-kit/log"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/lwangrabbit/prom-query/promql"
 
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 
+	"github.com/lwangrabbit/prom-query/pkg/gate"
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
 	"github.com/lwangrabbit/prom-query/pkg/value"
 	"github.com/lwangrabbit/prom-query/remote"
 )
 
 var (
-	queryEngine  *promql.Engine
-	remoteReader *remote.Reader
+	queryEngine        *promql.Engine
+	remoteReader       *remote.Reader
+	activeQueryTracker *promql.ActiveQueryTracker // Nil without active query log.
 )
 
 const (
 	DefaultQueryMaxConcurrency = 20
 	DefaultQueryMaxSamples     = 50000000
 	DefaultQueryTimeout        = 2 * time.Minute
+	DefaultQuerySplitInterval  = 24 * time.Hour
 )
 
 type ReadConfig struct {
 	URL     string
 	Timeout time.Duration
+	// ExternalLabels are added to the series of the backend which don't have
+	// them already, e.g. to tell apart the series of backends which don't set
+	// external_labels.
+	ExternalLabels map[string]string
+}
+
+// GroupConfig configures a group of replicas holding the same data, such as
+// a Prometheus HA pair of one shard.
+type GroupConfig struct {
+	Name string
+	// ExternalLabels identify the data held by the group. Queries pinning one
+	// of them to another value, e.g. cluster="eu1", are not sent to the group.
+	// They are the default external labels of the replicas.
+	ExternalLabels map[string]string
+	Replicas       []*ReadConfig
+	// DNSDiscovery and FileDiscovery discover further replicas at runtime.
+	DNSDiscovery  []*DNSDiscoveryConfig
+	FileDiscovery []*FileDiscoveryConfig
+}
+
+// DNSDiscoveryConfig discovers replicas from DNS SRV or A records.
+type DNSDiscoveryConfig struct {
+	Names []string
+	// Type is "SRV" (default) or "A".
+	Type string
+	// Port is the port of the replicas of A records.
+	Port int
+	// Scheme defaults to "http".
+	Scheme          string
+	RefreshInterval time.Duration
+	// Timeout is the request timeout of the replicas, DefaultQueryTimeout if
+	// 0.
+	Timeout time.Duration
 }
 
-func Init(configs []*ReadConfig) error {
-	engineOpts := promql.EngineOpts{
-		MaxConcurrent: DefaultQueryMaxConcurrency,
-		MaxSamples:    DefaultQueryMaxSamples,
-		Timeout:       DefaultQueryTimeout,
+// FileDiscoveryConfig discovers replicas from JSON or YAML files in the
+// file_sd format of Prometheus. The labels of the targets are their external
+// labels.
+type FileDiscoveryConfig struct {
+	// Files are the file paths, which may contain glob patterns.
+	Files []string
+	// Scheme is the scheme of targets which aren't URLs, "http" by default.
+	Scheme string
+	// RefreshInterval is how often the files are checked for changes.
+	RefreshInterval time.Duration
+	// Timeout is the request timeout of the replicas, DefaultQueryTimeout if
+	// 0.
+	Timeout time.Duration
+}
+
+// Option configures the query engine set up by Init.
+type Option func(*options)
+
+type options struct {
+	engineOpts     promql.EngineOpts
+	tenantLabels   remote.TenantLabels
+	activeQueryDir string
+	transport      remote.TransportConfig
+	hedge          *remote.HedgeConfig
+	dedup          remote.DedupMode
+	counters       remote.CounterMode
+	conflicts      *remote.ConflictConfig
+	local          []remote.Queryable
+	firstTargets   time.Duration
+}
+
+// WithLogger sets the logger of the query engine and backend clients.
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		o.engineOpts.Logger = logger
 	}
-	queryEngine = promql.NewEngine(engineOpts)
+}
 
-	var err error
-	var rConfs = make([]*remote.ReadConfig, 0, len(configs))
-	for _, conf := range configs {
-		u, err := url.Parse(conf.URL)
+// WithTracerProvider traces the queries, their queue wait and backend
+// requests with the given provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.engineOpts.TracerProvider = tp
+	}
+}
+
+// WithDefaultLookbackDelta sets the lookback delta of queries without one of
+// their own, see WithLookbackDelta. It defaults to promql.DefaultLookbackDelta,
+// which isn't sent to the backends.
+func WithDefaultLookbackDelta(d time.Duration) Option {
+	return func(o *options) {
+		o.engineOpts.LookbackDelta = d
+	}
+}
+
+// WithSlowQueryThreshold logs the queries taking longer than d at warn level.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(o *options) {
+		o.engineOpts.SlowQueryThreshold = d
+	}
+}
+
+// WithActiveQueryLog records the queries in flight in a file of the given
+// directory, and logs the queries which didn't finish in the previous run.
+func WithActiveQueryLog(dir string) Option {
+	return func(o *options) {
+		o.activeQueryDir = dir
+	}
+}
+
+// WithMaxQueuedQueries limits the number of queries waiting for execution,
+// further queries fail immediately.
+func WithMaxQueuedQueries(n int) Option {
+	return func(o *options) {
+		o.engineOpts.MaxQueued = n
+	}
+}
+
+// WithReservedConcurrency reserves n of the concurrently executing queries
+// to queries of priority p. Init fails if the reserved queries leave none to
+// all priorities.
+func WithReservedConcurrency(p gate.Priority, n int) Option {
+	return func(o *options) {
+		if o.engineOpts.ReservedConcurrent == nil {
+			o.engineOpts.ReservedConcurrent = map[gate.Priority]int{}
+		}
+		o.engineOpts.ReservedConcurrent[p] = n
+	}
+}
+
+// WithTenantLimits sets the limits applied to the queries of the given tenant.
+func WithTenantLimits(id string, limits promql.TenantLimits) Option {
+	return func(o *options) {
+		if o.engineOpts.TenantLimits == nil {
+			o.engineOpts.TenantLimits = map[string]promql.TenantLimits{}
+		}
+		o.engineOpts.TenantLimits[id] = limits
+	}
+}
+
+// WithDefaultTenantLimits sets the limits applied to the queries of tenants
+// without limits of their own.
+func WithDefaultTenantLimits(limits promql.TenantLimits) Option {
+	return func(o *options) {
+		o.engineOpts.DefaultTenantLimits = &limits
+	}
+}
+
+// WithEnforcedLabels restricts the queries of the given tenant to the series
+// having the given labels. Once enforced labels are set, the queries of the
+// tenants without an entry of their own fail with remote.ErrUnknownTenant. A
+// tenant given no labels is not restricted, the empty tenant being the
+// queries issued without WithTenant.
+func WithEnforcedLabels(id string, ls labels.Labels) Option {
+	return func(o *options) {
+		if o.tenantLabels == nil {
+			o.tenantLabels = remote.TenantLabels{}
+		}
+		o.tenantLabels[id] = ls
+	}
+}
+
+// WithBackendTransport tunes the connections to the backends and the
+// compression of their responses, e.g. to accept zstd and gzip compressed
+// responses.
+func WithBackendTransport(tc remote.TransportConfig) Option {
+	return func(o *options) {
+		o.transport = tc
+	}
+}
+
+// WithHedgedReads queries one replica of each group first, and the others
+// only if it fails or is slow to answer, see remote.HedgeConfig.
+func WithHedgedReads(hc remote.HedgeConfig) Option {
+	return func(o *options) {
+		o.hedge = &hc
+	}
+}
+
+// WithDedupMode sets how the series of the replicas of each group are
+// deduplicated, remote.DedupMerge by default.
+func WithDedupMode(m remote.DedupMode) Option {
+	return func(o *options) {
+		o.dedup = m
+	}
+}
+
+// WithDefaultCounterMode sets which series are merged as counters across
+// replicas, for the queries without a mode of their own, see WithCounterMode.
+// It defaults to remote.CountersNone.
+func WithDefaultCounterMode(m remote.CounterMode) Option {
+	return func(o *options) {
+		o.counters = m
+	}
+}
+
+// WithConflictDetection detects the series whose values diverge between the
+// replicas of a group, or which some replicas miss. They are returned as
+// warnings of the queries, and counted, see ReplicaConflicts. With
+// WithHedging, it requires FillGaps.
+func WithConflictDetection(cc remote.ConflictConfig) Option {
+	return func(o *options) {
+		o.conflicts = &cc
+	}
+}
+
+// WithFirstTargetsTimeout sets how long InitGroups waits for the first
+// replicas of the discovery, remote.DefaultFirstTargetsTimeout by default.
+// Zero doesn't wait.
+func WithFirstTargetsTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.firstTargets = d
+	}
+}
+
+// WithQueryable queries q in addition to the backends, e.g. a
+// remote.MemoryStorage of synthetic or locally computed series.
+func WithQueryable(q remote.Queryable) Option {
+	return func(o *options) {
+		o.local = append(o.local, q)
+	}
+}
+
+// Init sets up queries against replicas of the same data.
+func Init(configs []*ReadConfig, opts ...Option) error {
+	return InitGroups([]*GroupConfig{{Replicas: configs}}, opts...)
+}
+
+// InitGroups sets up queries against groups of replicas. The series of the
+// replicas of a group are deduplicated, and the series of groups are unioned.
+// The resources of a previous setup are released, see Close.
+func InitGroups(groups []*GroupConfig, opts ...Option) (err error) {
+	o := &options{
+		engineOpts: promql.EngineOpts{
+			MaxConcurrent: DefaultQueryMaxConcurrency,
+			MaxSamples:    DefaultQueryMaxSamples,
+			Timeout:       DefaultQueryTimeout,
+			SplitInterval: DefaultQuerySplitInterval,
+		},
+		firstTargets: remote.DefaultFirstTargetsTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	gateOpts := gate.Opts{
+		MaxConcurrent: o.engineOpts.MaxConcurrent,
+		MaxQueued:     o.engineOpts.MaxQueued,
+		Reserved:      o.engineOpts.ReservedConcurrent,
+	}
+	if err := gateOpts.Validate(); err != nil {
+		return err
+	}
+	var tracker *promql.ActiveQueryTracker
+	if o.activeQueryDir != "" {
+		// The queries are tracked while they hold a spot in the gate.
+		tracker, err = promql.NewActiveQueryTracker(o.activeQueryDir, o.engineOpts.MaxConcurrent, o.engineOpts.Logger)
 		if err != nil {
 			return err
 		}
-		rconf := &remote.ReadConfig{
-			URL:     &config_util.URL{URL: u},
-			Timeout: model.Duration(conf.Timeout),
-			Name:    fmt.Sprintf("promql-read-%v", conf.URL),
+		defer func() {
+			if err != nil {
+				tracker.Close()
+			}
+		}()
+		o.engineOpts.ActiveQueryTracker = tracker
+	}
+	engine := promql.NewEngine(o.engineOpts)
+
+	var gConfs = make([]*remote.GroupConfig, 0, len(groups))
+	for _, group := range groups {
+		gconf := &remote.GroupConfig{
+			Name:           group.Name,
+			ExternalLabels: labels.FromMap(group.ExternalLabels),
+		}
+		for _, conf := range group.Replicas {
+			u, err := url.Parse(conf.URL)
+			if err != nil {
+				return err
+			}
+			rconf := &remote.ReadConfig{
+				URL:            &config_util.URL{URL: u},
+				Timeout:        model.Duration(conf.Timeout),
+				Name:           fmt.Sprintf("promql-read-%v", conf.URL),
+				ExternalLabels: labels.FromMap(conf.ExternalLabels),
+			}
+			gconf.Replicas = append(gconf.Replicas, rconf)
+		}
+		for _, conf := range group.DNSDiscovery {
+			p, err := remote.NewDNSProvider(&remote.DNSConfig{
+				Names:           conf.Names,
+				Type:            conf.Type,
+				Port:            conf.Port,
+				Scheme:          conf.Scheme,
+				RefreshInterval: conf.RefreshInterval,
+				Timeout:         model.Duration(discoveryTimeout(conf.Timeout)),
+			}, o.engineOpts.Logger)
+			if err != nil {
+				return err
+			}
+			gconf.Providers = append(gconf.Providers, p)
 		}
-		rConfs = append(rConfs, rconf)
+		for _, conf := range group.FileDiscovery {
+			p, err := remote.NewFileProvider(&remote.FileConfig{
+				Files:           conf.Files,
+				Scheme:          conf.Scheme,
+				RefreshInterval: conf.RefreshInterval,
+				Timeout:         model.Duration(discoveryTimeout(conf.Timeout)),
+			}, o.engineOpts.Logger)
+			if err != nil {
+				return err
+			}
+			gconf.Providers = append(gconf.Providers, p)
+		}
+		gConfs = append(gConfs, gconf)
+	}
+	readerOpts := []remote.ReaderOption{
+		remote.WithLogger(o.engineOpts.Logger),
+		remote.WithTracerProvider(o.engineOpts.TracerProvider),
+		remote.WithTransportConfig(o.transport),
+		remote.WithDedupMode(o.dedup),
+		remote.WithDefaultCounterMode(o.counters),
+		remote.WithFirstTargetsTimeout(o.firstTargets),
 	}
-	remoteReader, err = remote.NewReader(rConfs)
+	if o.conflicts != nil {
+		readerOpts = append(readerOpts, remote.WithConflictDetection(*o.conflicts))
+	}
+	for _, q := range o.local {
+		readerOpts = append(readerOpts, remote.WithQueryable(q))
+	}
+	if o.hedge != nil {
+		readerOpts = append(readerOpts, remote.WithHedging(*o.hedge))
+	}
+	if len(o.tenantLabels) > 0 {
+		readerOpts = append(readerOpts, remote.WithQueryRewriter(o.tenantLabels))
+	}
+	reader, err := remote.NewGroupedReader(gConfs, readerOpts...)
 	if err != nil {
 		return err
 	}
+	Close()
+	queryEngine, remoteReader, activeQueryTracker = engine, reader, tracker
 	return nil
 }
 
-func Query(query string) (*QueryResult, error) {
+// discoveryTimeout returns the request timeout of discovered replicas.
+func discoveryTimeout(d time.Duration) time.Duration {
+	if d <= 0 {
+		return DefaultQueryTimeout
+	}
+	return d
+}
+
+// Close stops the discovery of replicas and closes the active query log.
+func Close() error {
+	var err error
+	if remoteReader != nil {
+		err = remoteReader.Close()
+		remoteReader = nil
+	}
+	if activeQueryTracker != nil {
+		if cerr := activeQueryTracker.Close(); err == nil {
+			err = cerr
+		}
+		activeQueryTracker = nil
+	}
+	return err
+}
+
+// BackendResponseBytes returns the total size of the responses of each
+// backend, as received and once decompressed.
+func BackendResponseBytes() []remote.BackendBytes {
+	if remoteReader == nil {
+		return nil
+	}
+	return remoteReader.ResponseBytes()
+}
+
+// ReplicaConflicts returns the number of conflicts detected between the
+// replicas of each group, if enabled by WithConflictDetection.
+func ReplicaConflicts() []remote.GroupConflicts {
+	if remoteReader == nil {
+		return nil
+	}
+	return remoteReader.Conflicts()
+}
+
+// ConsistencyReport compares the series selected by the given selector on the
+// replicas of each group over the given range. Values differing by more than
+// the given relative tolerance at equal timestamps conflict.
+func ConsistencyReport(selector string, startTs, endTs int64, step int, tolerance float64, opts ...QueryOption) (*remote.ConsistencyReport, error) {
+	ctx, cancal := queryContext(opts, DefaultQueryTimeout)
+	defer cancal()
+	return remoteReader.ConsistencyReport(ctx, &remote.SelectParams{
+		Query: selector,
+		Start: startTs,
+		End:   endTs,
+		Step:  int64(step),
+	}, tolerance)
+}
+
+// QueryOption configures a single query.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	priority      gate.Priority
+	caller        string
+	tenant        string
+	lookbackDelta time.Duration
+	stats         *remote.Stats
+	counters      *remote.CounterMode
+}
+
+// WithPriority sets the priority class the query is queued under.
+func WithPriority(p gate.Priority) QueryOption {
+	return func(o *queryOptions) {
+		o.priority = p
+	}
+}
+
+// WithCaller identifies the caller of the query, waiting queries of the same
+// priority are executed in turn across callers.
+func WithCaller(caller string) QueryOption {
+	return func(o *queryOptions) {
+		o.caller = caller
+	}
+}
+
+// WithTenant sets the tenant issuing the query, whose limits the query is
+// subject to. Unless set by WithCaller, the tenant is also the caller.
+func WithTenant(id string) QueryOption {
+	return func(o *queryOptions) {
+		o.tenant = id
+	}
+}
+
+// WithLookbackDelta sets the time since the last sample after which a series
+// is considered stale in the query, by the engine and the backends.
+func WithLookbackDelta(d time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.lookbackDelta = d
+	}
+}
+
+// WithStats records what happened on the backends while executing the query
+// into s, such as the outcome of the requests and the replicas the series
+// were taken from.
+func WithStats(s *remote.Stats) QueryOption {
+	return func(o *queryOptions) {
+		o.stats = s
+	}
+}
+
+// WithCounterMode sets which series are merged as counters across replicas
+// in the query, so that switching replicas doesn't make counters decrease.
+func WithCounterMode(m remote.CounterMode) QueryOption {
+	return func(o *queryOptions) {
+		o.counters = &m
+	}
+}
+
+func Query(query string, opts ...QueryOption) (*QueryResult, error) {
 	ts := time.Now().Unix()
 	qry := queryEngine.NewQuery(remoteReader, query, ts, ts, 0)
-	ctx, cancal := context.WithTimeout(context.Background(), DefaultQueryTimeout)
+	return exec(qry, opts)
+}
+
+func QueryRange(query string, startTs, endTs int64, step int, opts ...QueryOption) (*QueryResult, error) {
+	qry := queryEngine.NewQuery(remoteReader, query, startTs, endTs, step)
+	return exec(qry, opts)
+}
+
+// LabelValues returns the values of the label with the given name.
+func LabelValues(name string, opts ...QueryOption) ([]string, error) {
+	ctx, cancal := queryContext(opts, DefaultQueryTimeout)
 	defer cancal()
-	res := qry.Exec(ctx)
-	if res.Err != nil {
-		return nil, res.Err
+	q, err := remoteReader.Querier(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return &QueryResult{
-		Data: &QueryData{
-			ResultType: res.Value.Type(),
-			Result:     res.Value,
-		},
-		Status: "success",
-	}, nil
+	defer q.Close()
+	return q.LabelValues(name)
 }
 
-func QueryRange(query string, startTs, endTs int64, step int) (*QueryResult, error) {
-	qry := queryEngine.NewQuery(remoteReader, query, startTs, endTs, step)
-	ctx, cancal := context.WithTimeout(context.Background(), DefaultQueryTimeout)
+func exec(qry promql.Query, opts []QueryOption) (*QueryResult, error) {
+	// The engine times out the queries.
+	ctx, cancal := queryContext(opts, 0)
 	defer cancal()
+
 	res := qry.Exec(ctx)
 	if res.Err != nil {
 		return nil, res.Err
@@ -91,13 +529,49 @@ func QueryRange(query string, startTs, endTs int64, step int) (*QueryResult, err
 			ResultType: res.Value.Type(),
 			Result:     res.Value,
 		},
-		Status: "success",
+		Status:   "success",
+		Warnings: res.Warnings,
 	}, nil
 }
 
+// queryContext returns the context to execute a query with the given options,
+// timing out after timeout unless 0.
+func queryContext(opts []QueryOption, timeout time.Duration) (context.Context, context.CancelFunc) {
+	o := &queryOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.caller == "" {
+		o.caller = o.tenant
+	}
+	var (
+		ctx    context.Context
+		cancal context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancal = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancal = context.WithCancel(context.Background())
+	}
+	ctx = gate.WithPriority(ctx, o.priority)
+	ctx = gate.WithCaller(ctx, o.caller)
+	ctx = tenant.WithID(ctx, o.tenant)
+	if o.lookbackDelta > 0 {
+		ctx = promql.WithLookbackDelta(ctx, o.lookbackDelta)
+	}
+	if o.stats != nil {
+		ctx = remote.NewContextWithStats(ctx, o.stats)
+	}
+	if o.counters != nil {
+		ctx = remote.WithCounterMode(ctx, *o.counters)
+	}
+	return ctx, cancal
+}
+
 type QueryResult struct {
-	Data   *QueryData `json:"data"`
-	Status string     `json:"status"`
+	Data     *QueryData `json:"data"`
+	Status   string     `json:"status"`
+	Warnings []string   `json:"warnings,omitempty"`
 }
 type QueryData struct {
 	ResultType value.ValueType `json:"resultType"`
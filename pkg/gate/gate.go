@@ -13,36 +13,322 @@
 
 package gate
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/lwangrabbit/prom-query/pkg/gate"
+
+// Priority is the class a query is admitted under. Lower values are admitted first.
+type Priority int
+
+// The priority classes.
+const (
+	PriorityInteractive Priority = iota
+	PriorityBatch
+
+	numPriorities = int(PriorityBatch) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBatch:
+		return "batch"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// ErrTooManyQueued is returned by Start if the maximum number of waiting
+// queries was reached. It holds the queue limit.
+type ErrTooManyQueued int
+
+func (e ErrTooManyQueued) Error() string {
+	return fmt.Sprintf("too many queued queries (limit %d)", int(e))
+}
+
+type contextKey int
+
+const (
+	priorityKey contextKey = iota
+	callerKey
+)
+
+// WithPriority returns a context which makes the gate admit the query under
+// the given priority. Queries without a priority are interactive.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey, p)
+}
+
+// PriorityFromContext returns the priority of the query in ctx.
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey).(Priority)
+	if p < 0 || int(p) >= numPriorities {
+		return PriorityBatch
+	}
+	return p
+}
+
+// WithCaller returns a context which identifies the caller of the query.
+// Waiting queries of the same priority are admitted round-robin by caller.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey, caller)
+}
+
+// CallerFromContext returns the caller of the query in ctx.
+func CallerFromContext(ctx context.Context) string {
+	c, _ := ctx.Value(callerKey).(string)
+	return c
+}
+
+// Opts configures a Gate.
+type Opts struct {
+	// MaxConcurrent is the maximum number of concurrently running queries.
+	MaxConcurrent int
+	// MaxQueued is the maximum number of queries waiting for a spot. Queries
+	// beyond it are rejected with ErrTooManyQueued. Zero means unlimited.
+	MaxQueued int
+	// Reserved holds the number of spots out of MaxConcurrent which only
+	// queries of the given priority may use. At least one spot must be left
+	// to all priorities. The queries must be released with DoneWithPriority
+	// for the reservations to hold.
+	Reserved map[Priority]int
+}
+
+// Validate returns an error if the options are invalid.
+func (o Opts) Validate() error {
+	reserved := 0
+	for p, n := range o.Reserved {
+		if p < 0 || int(p) >= numPriorities {
+			return fmt.Errorf("unknown priority %d", int(p))
+		}
+		if n < 0 {
+			return fmt.Errorf("negative number of spots reserved to %s queries", p)
+		}
+		reserved += n
+	}
+	if reserved > 0 && reserved >= o.MaxConcurrent {
+		return fmt.Errorf("%d reserved spots leave none of the %d concurrent spots to all priorities", reserved, o.MaxConcurrent)
+	}
+	return nil
+}
 
 // A Gate controls the maximum number of concurrently running and waiting queries.
 type Gate struct {
-	ch chan struct{}
+	mtx sync.Mutex
+
+	maxQueued int
+	shared    int
+	reserved  [numPriorities]int
+
+	running    [numPriorities]int
+	sharedUsed int
+	queued     int
+	queues     [numPriorities]callerQueue
 }
 
 // NewGate returns a query gate that limits the number of queries
 // being concurrently executed.
 func New(length int) *Gate {
-	return &Gate{
-		ch: make(chan struct{}, length),
+	return &Gate{shared: length}
+}
+
+// NewWithOpts returns a query gate configured with the given options, or an
+// error if they are invalid.
+func NewWithOpts(opts Opts) (*Gate, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Gate{
+		maxQueued: opts.MaxQueued,
+		shared:    opts.MaxConcurrent,
+	}
+	for p, n := range opts.Reserved {
+		g.reserved[p] = n
+		g.shared -= n
 	}
+	return g, nil
 }
 
 // Start blocks until the gate has a free spot or the context is done.
+// The wait is traced with the tracer provider of the span in ctx.
 func (g *Gate) Start(ctx context.Context) error {
+	p := PriorityFromContext(ctx)
+	_, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, "gate.Start",
+		trace.WithAttributes(attribute.String("priority", p.String())))
+	defer span.End()
+
+	g.mtx.Lock()
+	if g.queues[p].len() == 0 && g.admissible(p) {
+		g.admit(p)
+		g.mtx.Unlock()
+		return nil
+	}
+	if g.maxQueued > 0 && g.queued >= g.maxQueued {
+		g.mtx.Unlock()
+		span.RecordError(ErrTooManyQueued(g.maxQueued))
+		return ErrTooManyQueued(g.maxQueued)
+	}
+	span.AddEvent("queued")
+	w := &waiter{ch: make(chan struct{}), caller: CallerFromContext(ctx)}
+	g.queues[p].push(w)
+	g.queued++
+	g.mtx.Unlock()
+
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case g.ch <- struct{}{}:
+	case <-w.ch:
 		return nil
+	case <-ctx.Done():
 	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if w.admitted {
+		// The spot was handed over concurrently with the cancellation.
+		g.release(p)
+		g.dispatch()
+	} else {
+		g.queues[p].remove(w)
+		g.queued--
+	}
+	return ctx.Err()
 }
 
 // Done releases a single spot in the gate.
+//
+// The gate doesn't know which query is done, so it releases a spot of the
+// highest priority running, which breaks the reservations of gates with
+// reserved spots. Their queries must be released with DoneWithPriority.
 func (g *Gate) Done() {
-	select {
-	case <-g.ch:
-	default:
-		panic("gate.Done: more operations done than started")
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for p := Priority(0); int(p) < numPriorities; p++ {
+		if g.running[p] > 0 {
+			g.release(p)
+			g.dispatch()
+			return
+		}
+	}
+	panic("gate.Done: more operations done than started")
+}
+
+// DoneWithPriority releases the spot of a query started with the priority p,
+// see PriorityFromContext.
+func (g *Gate) DoneWithPriority(p Priority) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if int(p) >= numPriorities || p < 0 || g.running[p] == 0 {
+		panic(fmt.Sprintf("gate.DoneWithPriority: more %s operations done than started", p))
+	}
+	g.release(p)
+	g.dispatch()
+}
+
+// admissible returns whether a query of priority p can run now.
+func (g *Gate) admissible(p Priority) bool {
+	return g.running[p] < g.reserved[p] || g.sharedUsed < g.shared
+}
+
+func (g *Gate) admit(p Priority) {
+	if g.running[p] >= g.reserved[p] {
+		g.sharedUsed++
+	}
+	g.running[p]++
+}
+
+func (g *Gate) release(p Priority) {
+	g.running[p]--
+	if g.running[p] >= g.reserved[p] {
+		g.sharedUsed--
+	}
+}
+
+// dispatch admits waiting queries, highest priority first, as long as there
+// are free spots for them.
+func (g *Gate) dispatch() {
+	for p := Priority(0); int(p) < numPriorities; p++ {
+		for g.queues[p].len() > 0 && g.admissible(p) {
+			w := g.queues[p].pop()
+			g.queued--
+			g.admit(p)
+			w.admitted = true
+			close(w.ch)
+		}
+	}
+}
+
+type waiter struct {
+	ch       chan struct{}
+	caller   string
+	admitted bool
+}
+
+// callerQueue holds the waiters of one priority in a FIFO queue per caller,
+// and hands them out round-robin across callers.
+type callerQueue struct {
+	callers []string
+	waiters map[string][]*waiter
+	n       int
+}
+
+func (q *callerQueue) len() int {
+	return q.n
+}
+
+func (q *callerQueue) push(w *waiter) {
+	if q.waiters == nil {
+		q.waiters = map[string][]*waiter{}
+	}
+	if len(q.waiters[w.caller]) == 0 {
+		q.callers = append(q.callers, w.caller)
+	}
+	q.waiters[w.caller] = append(q.waiters[w.caller], w)
+	q.n++
+}
+
+// pop returns the oldest waiter of the next caller in turn.
+func (q *callerQueue) pop() *waiter {
+	caller := q.callers[0]
+	q.callers = q.callers[1:]
+
+	ws := q.waiters[caller]
+	w := ws[0]
+	if len(ws) > 1 {
+		q.waiters[caller] = ws[1:]
+		q.callers = append(q.callers, caller)
+	} else {
+		delete(q.waiters, caller)
+	}
+	q.n--
+	return w
+}
+
+func (q *callerQueue) remove(w *waiter) {
+	ws := q.waiters[w.caller]
+	for i, o := range ws {
+		if o != w {
+			continue
+		}
+		ws = append(ws[:i], ws[i+1:]...)
+		q.n--
+		break
+	}
+	if len(ws) > 0 {
+		q.waiters[w.caller] = ws
+		return
+	}
+	delete(q.waiters, w.caller)
+	for i, c := range q.callers {
+		if c == w.caller {
+			q.callers = append(q.callers[:i], q.callers[i+1:]...)
+			break
+		}
 	}
 }
@@ -0,0 +1,136 @@
+package gate
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidateReserved(t *testing.T) {
+	for _, tc := range []struct {
+		opts  Opts
+		valid bool
+	}{
+		{opts: Opts{MaxConcurrent: 2}, valid: true},
+		{opts: Opts{MaxConcurrent: 2, Reserved: map[Priority]int{PriorityInteractive: 1}}, valid: true},
+		{opts: Opts{MaxConcurrent: 2, Reserved: map[Priority]int{PriorityInteractive: 2}}},
+		{opts: Opts{MaxConcurrent: 3, Reserved: map[Priority]int{PriorityInteractive: 2, PriorityBatch: 1}}},
+		{opts: Opts{MaxConcurrent: 2, Reserved: map[Priority]int{PriorityBatch: -1}}},
+	} {
+		if _, err := NewWithOpts(tc.opts); (err == nil) != tc.valid {
+			t.Fatalf("%+v: expected valid %v, got error %v", tc.opts, tc.valid, err)
+		}
+	}
+}
+
+func TestReservedSpots(t *testing.T) {
+	g, err := NewWithOpts(Opts{MaxConcurrent: 2, Reserved: map[Priority]int{PriorityInteractive: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := WithPriority(context.Background(), PriorityBatch)
+	if err := g.Start(batch); err != nil {
+		t.Fatal(err)
+	}
+	// The second spot is reserved to interactive queries.
+	ctx, cancel := context.WithTimeout(batch, 10*time.Millisecond)
+	defer cancel()
+	if err := g.Start(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the batch query to wait, got %v", err)
+	}
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the queries are done, a waiting batch query takes a spot.
+	admitted := make(chan error)
+	go func() { admitted <- g.Start(batch) }()
+	g.Done()
+	g.Done()
+	if err := <-admitted; err != nil {
+		t.Fatal(err)
+	}
+	g.Done()
+}
+
+func TestMaxQueued(t *testing.T) {
+	g, err := NewWithOpts(Opts{MaxConcurrent: 1, MaxQueued: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() { queued <- g.Start(context.Background()) }()
+	for {
+		g.mtx.Lock()
+		n := g.queued
+		g.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := g.Start(context.Background()); err != ErrTooManyQueued(1) {
+		t.Fatalf("expected ErrTooManyQueued, got %v", err)
+	}
+	g.Done()
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+	g.Done()
+}
+
+func TestReservedSpotsDoneWithPriority(t *testing.T) {
+	g, err := NewWithOpts(Opts{MaxConcurrent: 3, Reserved: map[Priority]int{PriorityBatch: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := WithPriority(context.Background(), PriorityBatch)
+	interactive := WithPriority(context.Background(), PriorityInteractive)
+	wait := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		return g.Start(ctx)
+	}
+
+	for _, ctx := range []context.Context{batch, interactive, interactive} {
+		if err := g.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wait(interactive); err != context.DeadlineExceeded {
+		t.Fatalf("expected the interactive query to wait, got %v", err)
+	}
+
+	// The spot of the batch query done is still reserved to batch queries.
+	g.DoneWithPriority(PriorityBatch)
+	if err := wait(interactive); err != context.DeadlineExceeded {
+		t.Fatalf("expected the interactive query to wait for a shared spot, got %v", err)
+	}
+	if err := wait(batch); err != nil {
+		t.Fatalf("expected the batch query to take its reserved spot, got %v", err)
+	}
+
+	// The spot of an interactive query done is shared, and taken by the
+	// waiting interactive query.
+	admitted := make(chan error)
+	go func() { admitted <- g.Start(interactive) }()
+	g.DoneWithPriority(PriorityInteractive)
+	if err := <-admitted; err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(batch); err != context.DeadlineExceeded {
+		t.Fatalf("expected the batch query to wait, got %v", err)
+	}
+
+	g.DoneWithPriority(PriorityBatch)
+	g.DoneWithPriority(PriorityInteractive)
+	g.DoneWithPriority(PriorityInteractive)
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.sharedUsed != 0 || g.running != [numPriorities]int{} {
+		t.Fatalf("expected all the spots to be free, got %d shared spots used and %v running", g.sharedUsed, g.running)
+	}
+}
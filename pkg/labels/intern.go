@@ -0,0 +1,86 @@
+package labels
+
+import "sync"
+
+// DefaultInternerSize is the default number of strings an Interner holds.
+const DefaultInternerSize = 1 << 20
+
+// Interner deduplicates the strings of label sets, so that the labels of the
+// series of many responses share their memory, and compare equal by pointer
+// before their bytes are compared. It is safe for concurrent use.
+//
+// The Interner forgets its strings once it holds more than its size, the
+// strings already interned staying valid.
+type Interner struct {
+	size int
+
+	mtx     sync.RWMutex
+	strings map[string]string
+}
+
+// NewInterner returns an Interner holding up to size strings,
+// DefaultInternerSize if 0.
+func NewInterner(size int) *Interner {
+	if size <= 0 {
+		size = DefaultInternerSize
+	}
+	return &Interner{size: size, strings: map[string]string{}}
+}
+
+// Intern returns the string equal to s held by the Interner, adding s if it
+// holds none.
+func (in *Interner) Intern(s string) string {
+	in.mtx.RLock()
+	interned, ok := in.strings[s]
+	in.mtx.RUnlock()
+	if ok {
+		return interned
+	}
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	return in.addLocked(s)
+}
+
+// InternLabels replaces the names and values of ls by the strings held by the
+// Interner and returns ls. The labels are modified in place rather than
+// copied, so ls must not be read concurrently, and the callers sharing its
+// backing array see the interned strings, which are equal to theirs.
+func (in *Interner) InternLabels(ls Labels) Labels {
+	missing := false
+	in.mtx.RLock()
+	for i, l := range ls {
+		name, okName := in.strings[l.Name]
+		value, okValue := in.strings[l.Value]
+		if okName {
+			ls[i].Name = name
+		}
+		if okValue {
+			ls[i].Value = value
+		}
+		missing = missing || !okName || !okValue
+	}
+	in.mtx.RUnlock()
+	if !missing {
+		return ls
+	}
+
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	for i, l := range ls {
+		ls[i] = Label{Name: in.addLocked(l.Name), Value: in.addLocked(l.Value)}
+	}
+	return ls
+}
+
+// addLocked returns the string equal to s held by the Interner, adding s if
+// it holds none. The caller must hold the write lock.
+func (in *Interner) addLocked(s string) string {
+	if interned, ok := in.strings[s]; ok {
+		return interned
+	}
+	if len(in.strings) >= in.size {
+		in.strings = make(map[string]string, len(in.strings))
+	}
+	in.strings[s] = s
+	return s
+}
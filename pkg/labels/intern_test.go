@@ -0,0 +1,93 @@
+package labels
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+// sameString returns whether a and b share their bytes.
+func sameString(a, b string) bool {
+	return a == b && (*reflect.StringHeader)(unsafe.Pointer(&a)).Data == (*reflect.StringHeader)(unsafe.Pointer(&b)).Data
+}
+
+// newString returns a copy of s not sharing its bytes.
+func newString(s string) string {
+	return string([]byte(s))
+}
+
+func TestInternLabels(t *testing.T) {
+	in := NewInterner(0)
+	first := FromStrings("__name__", newString("up"), "job", newString("node"))
+	if got := in.InternLabels(first); &got[0] != &first[0] {
+		t.Fatal("expected the labels to be interned in place")
+	}
+
+	// The labels are modified in place, and share the strings of the first.
+	ls := FromStrings("__name__", newString("up"), "job", newString("node"))
+	shared := ls[:1]
+	got := in.InternLabels(ls)
+	if &got[0] != &ls[0] || !Equal(got, first) {
+		t.Fatalf("expected %s in place, got %s", first, got)
+	}
+	for i := range ls {
+		if !sameString(ls[i].Name, first[i].Name) || !sameString(ls[i].Value, first[i].Value) {
+			t.Errorf("expected %s to share the strings of the first labels", ls[i])
+		}
+	}
+	if !sameString(shared[0].Value, first[0].Value) {
+		t.Error("expected the labels sharing the backing array to see the interned strings")
+	}
+
+	// Labels with a new string intern all of their strings.
+	ls = FromStrings("__name__", newString("up"), "job", newString("api"))
+	in.InternLabels(ls)
+	if !sameString(ls[0].Value, first[0].Value) || ls[1].Value != "api" {
+		t.Errorf("unexpected interned labels %s", ls)
+	}
+	if s := in.Intern(newString("api")); !sameString(s, ls[1].Value) {
+		t.Error("expected the new string to be interned")
+	}
+}
+
+func TestInternerSize(t *testing.T) {
+	in := NewInterner(2)
+	a, b := in.Intern(newString("node")), in.Intern(newString("api"))
+	if s := in.Intern(newString("node")); !sameString(s, a) {
+		t.Error("expected node to be interned")
+	}
+	// The Interner forgets its strings once full, the interned ones staying
+	// valid.
+	c := in.Intern(newString("db"))
+	if a != "node" || b != "api" || c != "db" {
+		t.Fatalf("unexpected interned strings %q, %q and %q", a, b, c)
+	}
+	if s := in.Intern(newString("node")); sameString(s, a) {
+		t.Error("expected node to be forgotten")
+	}
+	if s := in.Intern(newString("db")); !sameString(s, c) {
+		t.Error("expected db to be interned")
+	}
+}
+
+func TestInternerConcurrent(t *testing.T) {
+	in := NewInterner(16)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ls := FromStrings("job", fmt.Sprint(j%10), "instance", fmt.Sprint((i+j)%20))
+				expected := ls.String()
+				if got := in.InternLabels(ls).String(); got != expected {
+					t.Errorf("expected %s, got %s", expected, got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
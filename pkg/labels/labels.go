@@ -127,6 +127,10 @@ func Equal(ls, o Labels) bool {
 	if len(ls) != len(o) {
 		return false
 	}
+	if len(ls) == 0 || &ls[0] == &o[0] {
+		// The same label set.
+		return true
+	}
 	for i, l := range ls {
 		if l.Name != o[i].Name || l.Value != o[i].Value {
 			return false
@@ -158,11 +162,12 @@ func New(ls ...Label) Labels {
 
 // FromMap returns new sorted Labels from the given map.
 func FromMap(m map[string]string) Labels {
-	l := make([]Label, 0, len(m))
+	l := make(Labels, 0, len(m))
 	for k, v := range m {
 		l = append(l, Label{Name: k, Value: v})
 	}
-	return New(l...)
+	sort.Sort(l)
+	return l
 }
 
 // FromStrings creates new labels from pairs of strings.
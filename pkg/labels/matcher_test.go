@@ -0,0 +1,67 @@
+package labels
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		matcher *Matcher
+		value   string
+		match   bool
+	}{
+		{MustNewMatcher(MatchEqual, "job", "node"), "node", true},
+		{MustNewMatcher(MatchEqual, "job", "node"), "nodes", false},
+		{MustNewMatcher(MatchEqual, "job", ""), "", true},
+		{MustNewMatcher(MatchNotEqual, "job", "node"), "node", false},
+		{MustNewMatcher(MatchNotEqual, "job", "node"), "", true},
+		{MustNewMatcher(MatchRegexp, "job", "no.*"), "node", true},
+		{MustNewMatcher(MatchRegexp, "job", "no"), "node", false},
+		{MustNewMatcher(MatchRegexp, "job", "od"), "node", false},
+		{MustNewMatcher(MatchRegexp, "job", "node|api"), "api", true},
+		{MustNewMatcher(MatchRegexp, "job", ".*"), "", true},
+		{MustNewMatcher(MatchRegexp, "job", ".+"), "", false},
+		{MustNewMatcher(MatchRegexp, "job", "(?i)NODE"), "node", true},
+		{MustNewMatcher(MatchNotRegexp, "job", "no.*"), "node", false},
+		{MustNewMatcher(MatchNotRegexp, "job", "no"), "node", true},
+		{MustNewMatcher(MatchNotRegexp, "job", ""), "", false},
+	} {
+		if got := tc.matcher.Matches(tc.value); got != tc.match {
+			t.Errorf("%s matching %q: expected %t, got %t", tc.matcher, tc.value, tc.match, got)
+		}
+		inverse, err := tc.matcher.Inverse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := inverse.Matches(tc.value); got == tc.match {
+			t.Errorf("%s matching %q: expected %t, got %t", inverse, tc.value, !tc.match, got)
+		}
+	}
+}
+
+func TestMatcherInvalidRegexp(t *testing.T) {
+	if _, err := NewMatcher(MatchRegexp, "job", "("); err == nil {
+		t.Error("expected an error for an invalid regexp")
+	}
+	if _, err := NewMatcher(MatchEqual, "job", "("); err != nil {
+		t.Errorf("expected no error for an equality matcher, got %s", err)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	ls := FromStrings("__name__", "up", "job", "node")
+	for _, tc := range []struct {
+		matchers []*Matcher
+		match    bool
+	}{
+		{nil, true},
+		{[]*Matcher{MustNewMatcher(MatchEqual, "job", "node"), MustNewMatcher(MatchEqual, "__name__", "up")}, true},
+		{[]*Matcher{MustNewMatcher(MatchEqual, "job", "node"), MustNewMatcher(MatchEqual, "__name__", "down")}, false},
+		// Missing labels have the empty value.
+		{[]*Matcher{MustNewMatcher(MatchEqual, "env", "")}, true},
+		{[]*Matcher{MustNewMatcher(MatchNotEqual, "env", "")}, false},
+		{[]*Matcher{MustNewMatcher(MatchRegexp, "env", "prod|")}, true},
+	} {
+		if got := MatchLabels(ls, tc.matchers...); got != tc.match {
+			t.Errorf("%v matching %s: expected %t, got %t", tc.matchers, ls, tc.match, got)
+		}
+	}
+}
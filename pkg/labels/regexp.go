@@ -0,0 +1,135 @@
+package labels
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+// FastRegexMatcher matches strings against a regular expression anchored at
+// both ends. The expressions which are literals, alternations of literals or
+// literal prefixes followed by .* are matched without the regexp engine.
+type FastRegexMatcher struct {
+	re *regexp.Regexp
+
+	// set holds the literals of an alternation of literals, or the literal
+	// the expression is.
+	set map[string]struct{}
+	// prefix is a literal prefix the strings must have, and suffix which
+	// suffixes match once they do, if known without the regexp engine.
+	prefix string
+	suffix suffixKind
+}
+
+type suffixKind int
+
+const (
+	suffixUnknown suffixKind = iota
+	// suffixAny is any suffix, as for "foo.*" with the s flag.
+	suffixAny
+	// suffixNotNL is any suffix without newline, as for "foo.*".
+	suffixNotNL
+)
+
+// NewFastRegexMatcher compiles the given regular expression, anchored.
+func NewFastRegexMatcher(v string) (*FastRegexMatcher, error) {
+	re, err := regexp.Compile("^(?:" + v + ")$")
+	if err != nil {
+		return nil, err
+	}
+	m := &FastRegexMatcher{re: re}
+
+	if alts, ok := literalAlternation(v); ok {
+		m.set = make(map[string]struct{}, len(alts))
+		for _, a := range alts {
+			m.set[a] = struct{}{}
+		}
+		return m, nil
+	}
+	parsed, err := syntax.Parse(v, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	m.prefix, m.suffix = literalPrefix(parsed.Simplify())
+	return m, nil
+}
+
+// MatchString returns whether the regular expression matches s entirely.
+func (m *FastRegexMatcher) MatchString(s string) bool {
+	if m.set != nil {
+		_, ok := m.set[s]
+		return ok
+	}
+	if !strings.HasPrefix(s, m.prefix) {
+		return false
+	}
+	switch m.suffix {
+	case suffixAny:
+		return true
+	case suffixNotNL:
+		return !strings.Contains(s[len(m.prefix):], "\n")
+	}
+	return m.re.MatchString(s)
+}
+
+// GetRegexString returns the regular expression, anchored.
+func (m *FastRegexMatcher) GetRegexString() string {
+	return m.re.String()
+}
+
+// literalAlternation returns the literals of v if it is an alternation of
+// literals, such as "foo|bar", or a single literal.
+func literalAlternation(v string) ([]string, bool) {
+	alts := strings.Split(v, "|")
+	for _, a := range alts {
+		if regexp.QuoteMeta(a) != a || !literalBytes(a) {
+			return nil, false
+		}
+	}
+	return alts, true
+}
+
+// literalPrefix returns the literal prefix of the strings matching re, and
+// which suffixes match it after the prefix, as for "foo.*".
+func literalPrefix(re *syntax.Regexp) (string, suffixKind) {
+	if re.Flags&syntax.FoldCase != 0 {
+		return "", suffixUnknown
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		if prefix := string(re.Rune); literalBytes(prefix) {
+			return prefix, suffixUnknown
+		}
+	case syntax.OpStar:
+		return "", anyString(re)
+	case syntax.OpConcat:
+		if len(re.Sub) != 2 || re.Sub[0].Op != syntax.OpLiteral || re.Sub[0].Flags&syntax.FoldCase != 0 {
+			return "", suffixUnknown
+		}
+		if prefix := string(re.Sub[0].Rune); literalBytes(prefix) {
+			return prefix, anyString(re.Sub[1])
+		}
+	}
+	return "", suffixUnknown
+}
+
+// literalBytes returns whether the literal s matches the same bytes with the
+// regexp engine, which also matches utf8.RuneError to invalid UTF-8.
+func literalBytes(s string) bool {
+	return !strings.ContainsRune(s, utf8.RuneError)
+}
+
+// anyString returns the suffixes re matches if it is .*.
+func anyString(re *syntax.Regexp) suffixKind {
+	if re.Op != syntax.OpStar {
+		return suffixUnknown
+	}
+	switch re.Sub[0].Op {
+	case syntax.OpAnyChar:
+		return suffixAny
+	case syntax.OpAnyCharNotNL:
+		return suffixNotNL
+	}
+	return suffixUnknown
+}
@@ -0,0 +1,82 @@
+package labels
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFastRegexMatcher(t *testing.T) {
+	inputs := []string{
+		"", "foo", "FOO", "Foo", "foobar", "foo\nbar", "barfoo", "bar", "baz", "foo|bar",
+		"\n", "foo\n", ".", "a.b", "axb", "\xff", "foo\xff", "�", "ß", "SS", "ſ",
+	}
+	for _, tc := range []struct {
+		pattern string
+		fast    bool // Whether the pattern is matched without the regexp engine.
+	}{
+		{"", true},
+		{"foo", true},
+		{"foo|bar", true},
+		{"foo|", true},
+		{"|foo", true},
+		{"|", true},
+		{"foo||bar", true},
+		{".*", true},
+		{"(?s).*", true},
+		{"foo.*", true},
+		{"foo.*?", true},
+		{"(?s)foo.*", true},
+		{"(?:foo).*", true},
+		{`foo\n.*`, true},
+		{"�", false},
+		{"foo�.*", false},
+		{"foo|�", false},
+		{".+", false},
+		{"foo.+", false},
+		{".*foo", false},
+		{".*foo.*", false},
+		{"^foo", false},
+		{"foo$", false},
+		{"^foo$", false},
+		{"^.*$", false},
+		{"(?i)foo", false},
+		{"(?i)foo.*", false},
+		{"(?i)ss", false},
+		{"(?i)foo|bar", false},
+		{"(?i:f)oo.*", false},
+		{"fo(?i:o).*", false},
+		{"a.b", false},
+		{`a\.b`, false},
+		{"foo|bar.*", false},
+		{"(foo|bar)", false},
+		{"(foo)|(bar)", false},
+		{"(|foo)", false},
+		{"foo?", false},
+		{`\n`, false},
+		{"[^a]*", false},
+		{`\Qa.b\E`, false},
+		{"(?m)^foo$", false},
+	} {
+		m, err := NewFastRegexMatcher(tc.pattern)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.pattern, err)
+		}
+		if fast := m.set != nil || m.suffix != suffixUnknown; fast != tc.fast {
+			t.Errorf("%q: expected fast path %t, got %t", tc.pattern, tc.fast, fast)
+		}
+		re := regexp.MustCompile("^(?:" + tc.pattern + ")$")
+		for _, s := range inputs {
+			if got, expected := m.MatchString(s), re.MatchString(s); got != expected {
+				t.Errorf("%q matching %q: expected %t, got %t", tc.pattern, s, expected, got)
+			}
+		}
+	}
+}
+
+func TestFastRegexMatcherInvalid(t *testing.T) {
+	for _, pattern := range []string{"(", "foo)", "[a", "*", "a**", `\`, "(?P<>a)"} {
+		if _, err := NewFastRegexMatcher(pattern); err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package labels
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSelector parses a series selector, such as `up{job=~"node.*"}` or
+// `{job="node",env!="dev"}`, into its matchers. The metric name preceding the
+// braces is matched by an equality matcher on MetricName, which comes first.
+// As in PromQL, a selector must have a matcher which doesn't match the empty
+// value.
+func ParseSelector(input string) ([]*Matcher, error) {
+	p := &selectorParser{input: input}
+	ms, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("parse error in selector %q at position %d: %w", input, p.pos, err)
+	}
+	for _, m := range ms {
+		if !m.Matches("") {
+			return ms, nil
+		}
+	}
+	return nil, fmt.Errorf("selector %q must contain at least one non-empty matcher", input)
+}
+
+// FormatSelector returns the selector of the given matchers, with a metric
+// name preceding the braces if the first matcher is an equality matcher on
+// MetricName.
+func FormatSelector(ms []*Matcher) string {
+	var b strings.Builder
+	if len(ms) > 0 && ms[0].Name == MetricName && ms[0].Type == MatchEqual && isMetricName(ms[0].Value) {
+		b.WriteString(ms[0].Value)
+		ms = ms[1:]
+		if len(ms) == 0 {
+			return b.String()
+		}
+	}
+	b.WriteByte('{')
+	for i, m := range ms {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(m.String())
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() ([]*Matcher, error) {
+	var ms []*Matcher
+	p.skipSpaces()
+	if name := p.identifier(true); name != "" {
+		m, err := NewMatcher(MatchEqual, MetricName, name)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		p.skipSpaces()
+	}
+	if p.pos < len(p.input) && p.input[p.pos] == '{' {
+		p.pos++
+		for {
+			p.skipSpaces()
+			if p.consume("}") {
+				break
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+			p.skipSpaces()
+			if p.consume("}") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, fmt.Errorf("expected comma or closing brace")
+			}
+		}
+		p.skipSpaces()
+	}
+	switch {
+	case p.pos < len(p.input):
+		return nil, fmt.Errorf("unexpected character %q", p.input[p.pos])
+	case ms == nil:
+		return nil, fmt.Errorf("empty selector")
+	}
+	return ms, nil
+}
+
+func (p *selectorParser) matcher() (*Matcher, error) {
+	name := p.identifier(false)
+	if name == "" {
+		return nil, fmt.Errorf("expected label name")
+	}
+	p.skipSpaces()
+	var t MatchType
+	switch {
+	case p.consume("=~"):
+		t = MatchRegexp
+	case p.consume("!~"):
+		t = MatchNotRegexp
+	case p.consume("!="):
+		t = MatchNotEqual
+	case p.consume("="):
+		t = MatchEqual
+	default:
+		return nil, fmt.Errorf("expected label matching operator after %q", name)
+	}
+	p.skipSpaces()
+	v, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+	return NewMatcher(t, name, v)
+}
+
+// identifier consumes a label name, or a metric name which may contain
+// colons, and returns it, or the empty string if there is none.
+func (p *selectorParser) identifier(metric bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(p.pos > start && c >= '0' && c <= '9') || (metric && c == ':') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+// str consumes a quoted string and returns its value.
+func (p *selectorParser) str() (string, error) {
+	if p.pos == len(p.input) {
+		return "", fmt.Errorf("expected quoted string")
+	}
+	quote := p.input[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", fmt.Errorf("expected quoted string")
+	}
+	start := p.pos
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		switch c := p.input[p.pos]; {
+		case c == '\\' && quote != '`':
+			p.pos++
+		case c == quote:
+			p.pos++
+			return unquote(p.input[start:p.pos])
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string")
+}
+
+func (p *selectorParser) consume(s string) bool {
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\n\r", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// unquote returns the value of a quoted PromQL string.
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		// Go only allows single characters in single quotes.
+		s = `"` + strings.Replace(strings.Replace(s[1:len(s)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// isMetricName returns whether s is a valid metric name.
+func isMetricName(s string) bool {
+	p := &selectorParser{input: s}
+	return s != "" && p.identifier(true) == s
+}
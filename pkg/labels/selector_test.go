@@ -0,0 +1,91 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []*Matcher
+		format   string // The formatted selector, the input if empty.
+	}{
+		{
+			input:    "up",
+			expected: []*Matcher{MustNewMatcher(MatchEqual, MetricName, "up")},
+		},
+		{
+			input:    "node:cpu:rate5m",
+			expected: []*Matcher{MustNewMatcher(MatchEqual, MetricName, "node:cpu:rate5m")},
+		},
+		{
+			input: `up{job=~"node.*",env!="dev"}`,
+			expected: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricName, "up"),
+				MustNewMatcher(MatchRegexp, "job", "node.*"),
+				MustNewMatcher(MatchNotEqual, "env", "dev"),
+			},
+		},
+		{
+			input: ` up { job = 'it\'s' , path !~ ` + "`a\\.b`" + ` , } `,
+			expected: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricName, "up"),
+				MustNewMatcher(MatchEqual, "job", "it's"),
+				MustNewMatcher(MatchNotRegexp, "path", `a\.b`),
+			},
+			format: `up{job="it's",path!~"a\\.b"}`,
+		},
+		{
+			input:    `{__name__="up"}`,
+			expected: []*Matcher{MustNewMatcher(MatchEqual, MetricName, "up")},
+			format:   "up",
+		},
+		{
+			input:    `{__name__="1up",job="a\n\"b\""}`,
+			expected: []*Matcher{MustNewMatcher(MatchEqual, MetricName, "1up"), MustNewMatcher(MatchEqual, "job", "a\n\"b\"")},
+		},
+		{
+			input:    `{job="node",__name__="up"}`,
+			expected: []*Matcher{MustNewMatcher(MatchEqual, "job", "node"), MustNewMatcher(MatchEqual, MetricName, "up")},
+		},
+	} {
+		ms, err := ParseSelector(tc.input)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.input, err)
+		}
+		if !reflect.DeepEqual(ms, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.input, tc.expected, ms)
+		}
+		format := tc.format
+		if format == "" {
+			format = tc.input
+		}
+		if got := FormatSelector(ms); got != format {
+			t.Errorf("%s: expected to be formatted as %s, got %s", tc.input, format, got)
+		}
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"{}",
+		`{job=""}`,
+		`{job=~".*"}`,
+		`up{job="node"`,
+		`up{job="node" env="dev"}`,
+		`up{job}`,
+		`up{job=node}`,
+		`up{job=~"("}`,
+		`up{1job="node"}`,
+		`up{job="node}`,
+		`up{job="node"} foo`,
+		`up[5m]`,
+		"1up",
+	} {
+		if ms, err := ParseSelector(input); err == nil {
+			t.Errorf("%s: expected an error, got %v", input, ms)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+// Package promtest provides a fake Prometheus backend for tests. It serves the
+// query, labels and series endpoints of the Prometheus HTTP API over
+// in-memory series, and can inject latency, errors, missing series and skew
+// between replicas.
+//
+// Queries are limited to single vector selectors, such as
+// `up{job="node"}`, which are evaluated as Prometheus does: the value of a
+// series at a time is its latest sample within the lookback delta, which the
+// lookback_delta parameter overrides.
+//
+// Scripts test the query engine against the data of fake replicas, see
+// Script.
+package promtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+// DefaultLookbackDelta is the default time since the last sample after which
+// a series is stale in the queries.
+const DefaultLookbackDelta = 5 * time.Minute
+
+// Series is a series of the backend.
+type Series struct {
+	Labels labels.Labels
+	// Points are sorted by time, in seconds.
+	Points []value.Point
+}
+
+// Option configures a Server.
+type Option func(*config)
+
+type config struct {
+	lookback  time.Duration
+	latency   time.Duration
+	status    int
+	failEvery int
+	keep      func(labels.Labels) bool
+	timeSkew  int64
+	valueSkew float64
+}
+
+// WithLookbackDelta sets the time since the last sample after which a series
+// is stale in the queries, DefaultLookbackDelta if 0.
+func WithLookbackDelta(d time.Duration) Option {
+	return func(c *config) {
+		c.lookback = d
+	}
+}
+
+// WithLatency delays the responses by d, or until the request is canceled.
+func WithLatency(d time.Duration) Option {
+	return func(c *config) {
+		c.latency = d
+	}
+}
+
+// WithError makes the requests fail with the given HTTP status, or succeed
+// again if it is 0.
+func WithError(status int) Option {
+	return func(c *config) {
+		c.status = status
+	}
+}
+
+// WithFailEvery makes every n-th request fail with the status 503, or none
+// if n is 0.
+func WithFailEvery(n int) Option {
+	return func(c *config) {
+		c.failEvery = n
+	}
+}
+
+// WithPartialSeries serves only the series for which keep returns true, as a
+// replica missing some series, or all of them if keep is nil.
+func WithPartialSeries(keep func(labels.Labels) bool) Option {
+	return func(c *config) {
+		c.keep = keep
+	}
+}
+
+// WithSkew shifts the timestamps of the samples by d and adds delta to their
+// values, as a replica scraping its targets at other times.
+func WithSkew(d time.Duration, delta float64) Option {
+	return func(c *config) {
+		c.timeSkew = int64(d / time.Second)
+		c.valueSkew = delta
+	}
+}
+
+// Server is a fake Prometheus backend.
+type Server struct {
+	*httptest.Server
+
+	mtx      sync.Mutex
+	series   []Series
+	conf     config
+	requests int
+}
+
+// NewServer starts a Server over the given series. It is stopped by Close.
+func NewServer(series []Series, opts ...Option) *Server {
+	s := &Server{series: series}
+	s.Configure(opts...)
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Configure applies the given options to the server, on top of the previous
+// ones.
+func (s *Server) Configure(opts ...Option) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, opt := range opts {
+		opt(&s.conf)
+	}
+}
+
+// SetSeries replaces the series of the server.
+func (s *Server) SetSeries(series []Series) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.series = series
+}
+
+// Requests returns the number of requests received.
+func (s *Server) Requests() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+// ReadConfig returns the config of a remote.Reader backend reading from the
+// server with the given timeout.
+func (s *Server) ReadConfig(timeout time.Duration) *remote.ReadConfig {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		panic(err)
+	}
+	return &remote.ReadConfig{
+		URL:     &config_util.URL{URL: u},
+		Timeout: model.Duration(timeout),
+		Name:    s.URL,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	s.requests++
+	n, conf, series := s.requests, s.conf, s.series
+	s.mtx.Unlock()
+
+	if conf.latency > 0 {
+		select {
+		case <-time.After(conf.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	switch {
+	case conf.status != 0:
+		writeError(w, conf.status, "internal", "injected error")
+		return
+	case conf.failEvery > 0 && n%conf.failEvery == 0:
+		writeError(w, http.StatusServiceUnavailable, "unavailable", "injected failure")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	series = conf.apply(series)
+
+	var (
+		data interface{}
+		err  error
+	)
+	// Queries may override the lookback delta of the server, as with
+	// Prometheus.
+	lookback := conf.lookbackDelta()
+	if s := r.Form.Get("lookback_delta"); s != "" {
+		d, err := parseSeconds(s)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid lookback delta %q", s))
+			return
+		}
+		if d > 0 {
+			lookback = int64(d)
+		}
+	}
+	switch path := r.URL.Path; {
+	case path == "/api/v1/query":
+		data, err = instantQuery(series, r.Form, lookback)
+	case path == "/api/v1/query_range":
+		data, err = rangeQuery(series, r.Form, lookback)
+	case path == "/api/v1/labels":
+		data, err = labelNames(series, r.Form["match[]"])
+	case strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/api/v1/label/"), "/values")
+		data, err = labelValues(series, name, r.Form["match[]"])
+	case path == "/api/v1/series":
+		data, err = seriesLabels(series, r.Form["match[]"])
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "unknown endpoint "+path)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+}
+
+func writeError(w http.ResponseWriter, status int, typ, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": "error", "errorType": typ, "error": msg})
+}
+
+// lookbackDelta returns the lookback delta of the queries, in seconds.
+func (c config) lookbackDelta() int64 {
+	if c.lookback == 0 {
+		return int64(DefaultLookbackDelta / time.Second)
+	}
+	return int64(c.lookback / time.Second)
+}
+
+// apply returns the series served with the config.
+func (c config) apply(series []Series) []Series {
+	if c.keep == nil && c.timeSkew == 0 && c.valueSkew == 0 {
+		return series
+	}
+	res := make([]Series, 0, len(series))
+	for _, s := range series {
+		if c.keep != nil && !c.keep(s.Labels) {
+			continue
+		}
+		points := make([]value.Point, len(s.Points))
+		for i, p := range s.Points {
+			p.T += c.timeSkew
+			if p.H == nil && !value.IsStaleNaN(p.V) {
+				p.V += c.valueSkew
+			}
+			points[i] = p
+		}
+		res = append(res, Series{Labels: s.Labels, Points: points})
+	}
+	return res
+}
+
+func instantQuery(series []Series, form url.Values, lookback int64) (interface{}, error) {
+	matches, err := selectorMatcher(form.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	if form.Get("time") != "" {
+		if ts, err = parseTime(form.Get("time")); err != nil {
+			return nil, err
+		}
+	}
+	vec := value.Vector{}
+	for _, s := range series {
+		if !matches(s.Labels) {
+			continue
+		}
+		if p, ok := pointAt(s.Points, ts, lookback); ok {
+			p.T = ts
+			vec = append(vec, value.Sample{Metric: s.Labels, Point: p})
+		}
+	}
+	return map[string]interface{}{"resultType": value.ValueTypeVector, "result": vec}, nil
+}
+
+func rangeQuery(series []Series, form url.Values, lookback int64) (interface{}, error) {
+	matches, err := selectorMatcher(form.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTime(form.Get("start"))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTime(form.Get("end"))
+	if err != nil {
+		return nil, err
+	}
+	step, err := parseStep(form.Get("step"))
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf("end timestamp must not be before start time")
+	}
+
+	mat := value.Matrix{}
+	for _, s := range series {
+		if !matches(s.Labels) {
+			continue
+		}
+		var points []value.Point
+		for ts := start; ts <= end; ts += step {
+			if p, ok := pointAt(s.Points, ts, lookback); ok {
+				p.T = ts
+				points = append(points, p)
+			}
+		}
+		if len(points) > 0 {
+			mat = append(mat, value.Series{Metric: s.Labels, Points: points})
+		}
+	}
+	sort.Sort(mat)
+	return map[string]interface{}{"resultType": value.ValueTypeMatrix, "result": mat}, nil
+}
+
+// pointAt returns the latest point of points within the lookback delta
+// before ts, in seconds, unless it is a stale marker.
+func pointAt(points []value.Point, ts, lookback int64) (value.Point, bool) {
+	i := sort.Search(len(points), func(i int) bool { return points[i].T > ts })
+	if i == 0 {
+		return value.Point{}, false
+	}
+	p := points[i-1]
+	if p.T <= ts-lookback || (p.H == nil && value.IsStaleNaN(p.V)) {
+		return value.Point{}, false
+	}
+	return p, true
+}
+
+func labelNames(series []Series, selectors []string) (interface{}, error) {
+	matching, err := matchingSeries(series, selectors)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range matching {
+		for _, l := range s.Labels {
+			names = append(names, l.Name)
+		}
+	}
+	return uniqueSorted(names), nil
+}
+
+func labelValues(series []Series, name string, selectors []string) (interface{}, error) {
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return nil, err
+	}
+	matching, err := matchingSeries(series, selectors)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, s := range matching {
+		if v := s.Labels.Get(name); v != "" {
+			values = append(values, v)
+		}
+	}
+	return uniqueSorted(values), nil
+}
+
+func seriesLabels(series []Series, selectors []string) (interface{}, error) {
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("no match[] parameter provided")
+	}
+	matching, err := matchingSeries(series, selectors)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]labels.Labels, 0, len(matching))
+	for _, s := range matching {
+		res = append(res, s.Labels)
+	}
+	return res, nil
+}
+
+// matchingSeries returns the series matching any of the given selectors, or
+// all of them without selectors.
+func matchingSeries(series []Series, selectors []string) ([]Series, error) {
+	if len(selectors) == 0 {
+		return series, nil
+	}
+	matchers := make([]func(labels.Labels) bool, 0, len(selectors))
+	for _, sel := range selectors {
+		m, err := selectorMatcher(sel)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	var res []Series
+	for _, s := range series {
+		for _, m := range matchers {
+			if m(s.Labels) {
+				res = append(res, s)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// selectorMatcher returns a function telling whether labels match the given
+// vector selector, or an error if the input isn't a single vector selector.
+func selectorMatcher(input string) (func(labels.Labels) bool, error) {
+	matchers, err := labels.ParseSelector(input)
+	if err != nil {
+		return nil, fmt.Errorf("only vector selectors are supported: %w", err)
+	}
+	return func(ls labels.Labels) bool {
+		return labels.MatchLabels(ls, matchers...)
+	}, nil
+}
+
+// parseTime parses a timestamp in seconds or in RFC 3339 format.
+func parseTime(s string) (int64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Floor(f)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+	}
+	return t.Unix(), nil
+}
+
+// parseStep parses a positive step in seconds or as a duration.
+func parseStep(s string) (int64, error) {
+	step, err := parseSeconds(s)
+	if err != nil {
+		return 0, err
+	}
+	if step < 1 {
+		return 0, fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	return int64(step), nil
+}
+
+// parseSeconds parses a duration in seconds or in the Prometheus format.
+func parseSeconds(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+	}
+	return time.Duration(d).Seconds(), nil
+}
+
+func uniqueSorted(ss []string) []string {
+	sort.Strings(ss)
+	res := []string{}
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
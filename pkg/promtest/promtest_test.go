@@ -0,0 +1,155 @@
+package promtest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+func TestScripts(t *testing.T) {
+	RunScripts(t, "testdata/*.test")
+}
+
+var testSeries = []Series{
+	{
+		Labels: labels.FromStrings("__name__", "up", "job", "node"),
+		Points: []value.Point{{T: 0, V: 1}, {T: 60, V: 2}, {T: 120, V: math.Float64frombits(value.StaleNaN)}, {T: 300, V: 5}},
+	},
+	{
+		Labels: labels.FromStrings("__name__", "up", "job", "api"),
+		Points: []value.Point{{T: 0, V: 10}},
+	},
+}
+
+// queryRange returns the points of the series of the range query to s by
+// the value of their job label.
+func queryRange(t *testing.T, s *Server, query string, start, end, step int64) map[string][]value.Point {
+	t.Helper()
+	v := url.Values{}
+	v.Set("query", query)
+	v.Set("start", time.Unix(start, 0).UTC().Format(time.RFC3339))
+	v.Set("end", time.Unix(end, 0).UTC().Format(time.RFC3339))
+	v.Set("step", (time.Duration(step) * time.Second).String())
+	rsp, err := http.Get(s.URL + "/api/v1/query_range?" + v.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", rsp.StatusCode)
+	}
+	var res remote.RangeQueryResult
+	if err := json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	points := map[string][]value.Point{}
+	for _, s := range *res.Data.Result {
+		points[s.Metric.Get("job")] = s.Points
+	}
+	return points
+}
+
+func TestServerQueryRange(t *testing.T) {
+	s := NewServer(testSeries, WithLookbackDelta(3*time.Minute))
+	defer s.Close()
+
+	got := queryRange(t, s, `up{job="node"}`, 0, 420, 60)
+	// The stale marker at 120 ends the series until the sample at 300,
+	// which is selected within the lookback delta until 480 excluded.
+	expected := []value.Point{{T: 0, V: 1}, {T: 60, V: 2}, {T: 300, V: 5}, {T: 360, V: 5}, {T: 420, V: 5}}
+	if len(got) != 1 || !equalPoints(got["node"], expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	got = queryRange(t, s, `up`, 0, 240, 60)
+	expected = []value.Point{{T: 0, V: 10}, {T: 60, V: 10}, {T: 120, V: 10}}
+	if len(got) != 2 || !equalPoints(got["api"], expected) {
+		t.Fatalf("expected %v for job api, got %v", expected, got)
+	}
+}
+
+func TestServerSkew(t *testing.T) {
+	s := NewServer(testSeries, WithSkew(30*time.Second, 0.5))
+	defer s.Close()
+
+	got := queryRange(t, s, `up{job="node"}`, 0, 120, 60)
+	expected := []value.Point{{T: 60, V: 1.5}, {T: 120, V: 2.5}}
+	if !equalPoints(got["node"], expected) {
+		t.Fatalf("expected %v, got %v", expected, got["node"])
+	}
+}
+
+func TestServerPartialSeries(t *testing.T) {
+	s := NewServer(testSeries, WithPartialSeries(func(ls labels.Labels) bool {
+		return ls.Get("job") == "api"
+	}))
+	defer s.Close()
+
+	got := queryRange(t, s, `up`, 0, 60, 60)
+	if _, ok := got["node"]; ok || len(got) != 1 {
+		t.Fatalf("expected the series of job api only, got %v", got)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s := NewServer(testSeries, WithFailEvery(2))
+	defer s.Close()
+
+	for i, expected := range []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusOK} {
+		rsp, err := http.Get(s.URL + "/api/v1/query?query=up&time=0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != expected {
+			t.Fatalf("request %d: expected status %d, got %d", i+1, expected, rsp.StatusCode)
+		}
+	}
+	if n := s.Requests(); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	s.Configure(WithError(http.StatusInternalServerError))
+	rsp, err := http.Get(s.URL + "/api/v1/query?query=up&time=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res map[string]string
+	err = json.NewDecoder(rsp.Body).Decode(&res)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusInternalServerError || res["status"] != "error" || res["error"] == "" {
+		t.Fatalf("unexpected response %d %v", rsp.StatusCode, res)
+	}
+
+	s.Configure(WithError(0))
+	rsp, err = http.Get(s.URL + "/api/v1/query?query=rate(up[5m])&time=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a query other than a selector, got %d", http.StatusBadRequest, rsp.StatusCode)
+	}
+}
+
+func equalPoints(a, b []value.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].T != b[i].T || a[i].V != b[i].V {
+			return false
+		}
+	}
+	return true
+}
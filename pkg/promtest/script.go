@@ -0,0 +1,693 @@
+package promtest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/promql"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+// defaultReplica is the replica of the scripts loading no named replica.
+const defaultReplica = "default"
+
+// epsilon is the relative tolerance of the comparison of expected and actual
+// values.
+const epsilon = 1e-6
+
+// Script is a test script of the query engine, in a format close to the one
+// of the PromQL tests of Prometheus. Its data is served by fake backends, the
+// replicas of a group, which the engine queries through a remote.Reader.
+//
+// The commands of a script are:
+//
+//	load <step> [replica <name>] [offset <duration>]
+//	    <series> <values>
+//	    ...
+//	clear
+//	set <setting> <value>
+//	eval instant at <time> <selector>
+//	    <series> <value>
+//	    ...
+//	eval range from <time> to <time> step <step> <selector>
+//	    <series> <values>
+//	    ...
+//	eval_fail instant at <time> <selector>
+//	eval_fail range from <time> to <time> step <step> <selector>
+//
+// Lines starting with # are comments. Times are durations since the epoch.
+//
+// The values of a series are expanded as in Prometheus: `a+bxn` is n+1 values
+// from a by steps of b, `axn` is n+1 times a, `_` is a missing value and `_xn`
+// n missing values, and `stale` is a stale marker. The values loaded are one
+// step apart, from the offset. The values expected from range queries are
+// those of each step of the query, and missing values are steps without
+// sample.
+//
+// The data of load blocks without a replica is served by all the replicas, the
+// replica named "default" if the script names none. The settings are
+// lookback_delta and split_interval, which are durations, dedup, which is
+// merge or gap_fill, and counters, which is none, inferred or all. The
+// lookback delta is set on the engine, which sends it to the replicas.
+type Script struct {
+	name string
+	cmds []scriptCmd
+}
+
+type scriptCmd interface {
+	line() int
+}
+
+type loadCmd struct {
+	lineNum int
+	replica string // Empty for all replicas.
+	series  []Series
+}
+
+type clearCmd struct {
+	lineNum int
+}
+
+type setCmd struct {
+	lineNum    int
+	name, text string
+}
+
+type evalCmd struct {
+	lineNum    int
+	query      string
+	start, end int64
+	step       int64 // 0 for instant queries.
+	fail       bool
+	expected   []expectedSeries
+}
+
+type expectedSeries struct {
+	labels labels.Labels
+	values []*float64 // Nil for steps without sample.
+}
+
+func (c *loadCmd) line() int  { return c.lineNum }
+func (c *clearCmd) line() int { return c.lineNum }
+func (c *setCmd) line() int   { return c.lineNum }
+func (c *evalCmd) line() int  { return c.lineNum }
+
+// LoadScript reads and parses the script at the given path.
+func LoadScript(path string) (*Script, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScript(path, string(b))
+}
+
+// ParseScript parses a script. The name prefixes the errors.
+func ParseScript(name, input string) (*Script, error) {
+	s := &Script{name: name}
+	lines := strings.Split(input, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineNum := i + 1
+		// The indented lines following a command are its body.
+		var body []string
+		for i+1 < len(lines) && isBodyLine(lines[i+1]) {
+			i++
+			if l := strings.TrimSpace(lines[i]); !strings.HasPrefix(l, "#") {
+				body = append(body, l)
+			}
+		}
+		cmd, err := parseCmd(lineNum, line, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, lineNum, err)
+		}
+		s.cmds = append(s.cmds, cmd)
+	}
+	return s, nil
+}
+
+func isBodyLine(l string) bool {
+	return strings.TrimSpace(l) != "" && (l[0] == ' ' || l[0] == '\t')
+}
+
+func parseCmd(lineNum int, line string, body []string) (scriptCmd, error) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "load":
+		return parseLoad(lineNum, fields[1:], body)
+	case "clear":
+		return &clearCmd{lineNum: lineNum}, nil
+	case "set":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected set <setting> <value>, got %q", line)
+		}
+		return &setCmd{lineNum: lineNum, name: fields[1], text: fields[2]}, nil
+	case "eval", "eval_fail":
+		return parseEval(lineNum, line, body)
+	default:
+		return nil, fmt.Errorf("unknown command %q", fields[0])
+	}
+}
+
+func parseLoad(lineNum int, args []string, body []string) (*loadCmd, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing step of load")
+	}
+	step, err := parseDuration(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("load step must be positive")
+	}
+	cmd := &loadCmd{lineNum: lineNum}
+	var offset int64
+	for args = args[1:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("missing value of %q", args[0])
+		}
+		switch args[0] {
+		case "replica":
+			cmd.replica = args[1]
+		case "offset":
+			if offset, err = parseDuration(args[1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown load argument %q", args[0])
+		}
+	}
+	for _, l := range body {
+		ls, values, err := parseSeries(l)
+		if err != nil {
+			return nil, err
+		}
+		s := Series{Labels: ls}
+		for i, v := range values {
+			if v != nil {
+				s.Points = append(s.Points, value.Point{T: offset + int64(i)*step, V: *v})
+			}
+		}
+		cmd.series = append(cmd.series, s)
+	}
+	return cmd, nil
+}
+
+func parseEval(lineNum int, line string, body []string) (*evalCmd, error) {
+	cmd := &evalCmd{lineNum: lineNum, fail: strings.HasPrefix(line, "eval_fail")}
+	fields := strings.Fields(line)
+	var (
+		rest string
+		err  error
+	)
+	switch {
+	case len(fields) > 3 && fields[1] == "instant" && fields[2] == "at":
+		if cmd.start, err = parseDuration(fields[3]); err != nil {
+			return nil, err
+		}
+		cmd.end = cmd.start
+		rest = afterFields(line, 4)
+	case len(fields) > 7 && fields[1] == "range" && fields[2] == "from" && fields[4] == "to" && fields[6] == "step":
+		if cmd.start, err = parseDuration(fields[3]); err != nil {
+			return nil, err
+		}
+		if cmd.end, err = parseDuration(fields[5]); err != nil {
+			return nil, err
+		}
+		if cmd.step, err = parseDuration(fields[7]); err != nil {
+			return nil, err
+		}
+		if cmd.step <= 0 {
+			return nil, fmt.Errorf("eval step must be positive")
+		}
+		rest = afterFields(line, 8)
+	default:
+		return nil, fmt.Errorf("invalid eval command %q", line)
+	}
+	if cmd.query = strings.TrimSpace(rest); cmd.query == "" {
+		return nil, fmt.Errorf("missing query of eval")
+	}
+	if cmd.fail && len(body) > 0 {
+		return nil, fmt.Errorf("eval_fail expects no result")
+	}
+	for _, l := range body {
+		ls, values, err := parseSeries(l)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.step == 0 && (len(values) != 1 || values[0] == nil) {
+			return nil, fmt.Errorf("expected a single value for %s", ls)
+		}
+		cmd.expected = append(cmd.expected, expectedSeries{labels: ls, values: values})
+	}
+	return cmd, nil
+}
+
+// afterFields returns what follows the first n fields of line.
+func afterFields(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " \t")
+		line = line[strings.IndexAny(line+" ", " \t"):]
+	}
+	return line
+}
+
+func parseDuration(s string) (int64, error) {
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(time.Duration(d) / time.Second), nil
+}
+
+// parseSeries parses a series and its values, of which the missing ones are
+// nil.
+func parseSeries(line string) (labels.Labels, []*float64, error) {
+	end := strings.IndexAny(line, " \t")
+	if brace := strings.IndexByte(line, '{'); brace >= 0 && (end < 0 || brace < end) {
+		end = closingBrace(line, brace) + 1
+		if end == 0 {
+			return nil, nil, fmt.Errorf("unclosed braces in %q", line)
+		}
+	}
+	if end < 0 {
+		end = len(line)
+	}
+	ls, err := parseLabels(line[:end])
+	if err != nil {
+		return nil, nil, err
+	}
+	var values []*float64
+	for _, f := range strings.Fields(line[end:]) {
+		vs, err := expandValues(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, vs...)
+	}
+	return ls, values, nil
+}
+
+// closingBrace returns the index of the brace closing the one at index open,
+// or -1.
+func closingBrace(s string, open int) int {
+	inQuote := byte(0)
+	for i := open + 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case inQuote != 0 && c == '\\':
+			i++
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			inQuote = c
+		case c == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseLabels parses a series in the selector syntax with equality matchers
+// only, such as `up{job="node"}`.
+func parseLabels(s string) (labels.Labels, error) {
+	ms, err := labels.ParseSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	b := labels.NewBuilder(nil)
+	for _, m := range ms {
+		if m.Type != labels.MatchEqual {
+			return nil, fmt.Errorf("invalid label matcher %s in series %q", m, s)
+		}
+		b.Set(m.Name, m.Value)
+	}
+	return b.Labels(), nil
+}
+
+// expandValues expands a value of a series description.
+func expandValues(s string) ([]*float64, error) {
+	switch s {
+	case "_":
+		return []*float64{nil}, nil
+	case "stale":
+		v := math.Float64frombits(value.StaleNaN)
+		return []*float64{&v}, nil
+	}
+	base, times := s, 0
+	if i := strings.LastIndexByte(s, 'x'); i > 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid repetition in %q", s)
+		}
+		base, times = s[:i], n
+	}
+	if base == "_" {
+		return make([]*float64, times), nil
+	}
+
+	// The increment follows the sign separating it from the start value,
+	// which may have a sign of its own.
+	start, incr := base, "0"
+	if i := strings.LastIndexAny(base, "+-"); i > 0 && base[i-1] != 'e' && base[i-1] != 'E' {
+		start, incr = base[:i], base[i:]
+	}
+	a, err := parseValue(start)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseValue(incr)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*float64, 0, times+1)
+	for i := 0; i <= times; i++ {
+		v := a + float64(i)*b
+		values = append(values, &v)
+	}
+	return values, nil
+}
+
+func parseValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// scriptEnv is the state of a running script.
+type scriptEnv struct {
+	name     string
+	replicas []string // In the order they were loaded.
+	shared   []Series
+	data     map[string][]Series // By replica.
+	servers  map[string]*Server
+
+	lookbackDelta time.Duration
+	splitInterval time.Duration
+	dedup         remote.DedupMode
+	counters      remote.CounterMode
+}
+
+// Run runs the script, and returns an error listing the failed commands, if
+// any.
+func (s *Script) Run() error {
+	env := &scriptEnv{name: s.name, data: map[string][]Series{}, servers: map[string]*Server{}}
+	defer env.close()
+
+	var failures []string
+	for _, cmd := range s.cmds {
+		if err := env.run(cmd); err != nil {
+			failures = append(failures, fmt.Sprintf("%s:%d: %v", s.name, cmd.line(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// RunScripts runs the scripts matching the given glob pattern as subtests of
+// t, named after their files.
+func RunScripts(t *testing.T, pattern string) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no script matches %q", pattern)
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			s, err := LoadScript(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Run(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func (env *scriptEnv) close() {
+	for _, s := range env.servers {
+		s.Close()
+	}
+}
+
+func (env *scriptEnv) run(cmd scriptCmd) error {
+	switch cmd := cmd.(type) {
+	case *loadCmd:
+		if cmd.replica == "" {
+			env.shared = append(env.shared, cmd.series...)
+			return nil
+		}
+		if _, ok := env.data[cmd.replica]; !ok {
+			env.replicas = append(env.replicas, cmd.replica)
+		}
+		env.data[cmd.replica] = append(env.data[cmd.replica], cmd.series...)
+	case *clearCmd:
+		env.replicas, env.shared, env.data = nil, nil, map[string][]Series{}
+	case *setCmd:
+		return env.set(cmd.name, cmd.text)
+	case *evalCmd:
+		return env.eval(cmd)
+	}
+	return nil
+}
+
+func (env *scriptEnv) set(name, text string) error {
+	var err error
+	switch name {
+	case "lookback_delta", "split_interval":
+		var d model.Duration
+		if d, err = model.ParseDuration(text); err != nil {
+			return err
+		}
+		if name == "lookback_delta" {
+			env.lookbackDelta = time.Duration(d)
+		} else {
+			env.splitInterval = time.Duration(d)
+		}
+	case "dedup":
+		switch text {
+		case "merge":
+			env.dedup = remote.DedupMerge
+		case "gap_fill":
+			env.dedup = remote.DedupGapFill
+		default:
+			return fmt.Errorf("unknown dedup mode %q", text)
+		}
+	case "counters":
+		switch text {
+		case "none":
+			env.counters = remote.CountersNone
+		case "inferred":
+			env.counters = remote.CountersInferred
+		case "all":
+			env.counters = remote.CountersAll
+		default:
+			return fmt.Errorf("unknown counter mode %q", text)
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	return nil
+}
+
+// reader returns a Reader over the replicas loaded so far, serving their
+// current data.
+func (env *scriptEnv) reader() (*remote.Reader, error) {
+	replicas := env.replicas
+	if len(replicas) == 0 {
+		replicas = []string{defaultReplica}
+	}
+	var configs []*remote.ReadConfig
+	for _, r := range replicas {
+		series := mergeSeries(append(append([]Series(nil), env.shared...), env.data[r]...))
+		srv, ok := env.servers[r]
+		if !ok {
+			srv = NewServer(series)
+			env.servers[r] = srv
+		} else {
+			srv.SetSeries(series)
+		}
+		conf := srv.ReadConfig(10 * time.Second)
+		conf.Name = r
+		configs = append(configs, conf)
+	}
+	return remote.NewGroupedReader([]*remote.GroupConfig{{Name: env.name, Replicas: configs}},
+		remote.WithDedupMode(env.dedup),
+		remote.WithDefaultCounterMode(env.counters),
+	)
+}
+
+// mergeSeries merges the points of the series with equal labels, the latest
+// loaded winning at equal timestamps.
+func mergeSeries(series []Series) []Series {
+	var (
+		res   []Series
+		index = map[string]int{}
+	)
+	for _, s := range series {
+		key := s.Labels.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(res)
+			index[key] = i
+			res = append(res, Series{Labels: s.Labels})
+		}
+		res[i].Points = append(res[i].Points, s.Points...)
+	}
+	for i := range res {
+		points := res[i].Points
+		sort.SliceStable(points, func(i, j int) bool { return points[i].T < points[j].T })
+		kept := points[:0]
+		for _, p := range points {
+			if n := len(kept); n > 0 && kept[n-1].T == p.T {
+				kept[n-1] = p
+				continue
+			}
+			kept = append(kept, p)
+		}
+		res[i].Points = kept
+	}
+	return res
+}
+
+func (env *scriptEnv) eval(cmd *evalCmd) error {
+	reader, err := env.reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxConcurrent: 10,
+		MaxSamples:    50000000,
+		Timeout:       time.Minute,
+		SplitInterval: env.splitInterval,
+		LookbackDelta: env.lookbackDelta,
+	})
+	qry := engine.NewQuery(reader, cmd.query, cmd.start, cmd.end, int(cmd.step))
+	res := qry.Exec(context.Background())
+	switch {
+	case cmd.fail && res.Err == nil:
+		return fmt.Errorf("expected %q to fail", cmd.query)
+	case cmd.fail:
+		return nil
+	case res.Err != nil:
+		return fmt.Errorf("error evaluating %q: %w", cmd.query, res.Err)
+	}
+
+	var problems []string
+	actual := map[string][]*float64{}
+	switch v := res.Value.(type) {
+	case value.Vector:
+		for _, s := range v {
+			actual[s.Metric.String()] = []*float64{floatPtr(s.V)}
+		}
+	case value.Matrix:
+		numSteps := (cmd.end-cmd.start)/cmd.step + 1
+		for _, s := range v {
+			values := make([]*float64, numSteps)
+			for _, p := range s.Points {
+				i := (p.T - cmd.start) / cmd.step
+				if p.T < cmd.start || i >= numSteps || (p.T-cmd.start)%cmd.step != 0 {
+					problems = append(problems, fmt.Sprintf("series %s: unexpected point %g at %d", s.Metric, p.V, p.T))
+					continue
+				}
+				values[i] = floatPtr(p.V)
+			}
+			actual[s.Metric.String()] = values
+		}
+	default:
+		return fmt.Errorf("unexpected result type %s of %q", res.Value.Type(), cmd.query)
+	}
+
+	for _, exp := range cmd.expected {
+		key := exp.labels.String()
+		values, ok := actual[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing series %s", key))
+			continue
+		}
+		delete(actual, key)
+		if msg := compareValues(exp.values, values, cmd); msg != "" {
+			problems = append(problems, fmt.Sprintf("series %s: %s", key, msg))
+		}
+	}
+	var unexpected []string
+	for key := range actual {
+		unexpected = append(unexpected, key)
+	}
+	sort.Strings(unexpected)
+	for _, key := range unexpected {
+		problems = append(problems, fmt.Sprintf("unexpected series %s", key))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%q: %s", cmd.query, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// compareValues describes the first difference between the expected and
+// actual values, empty if they match.
+func compareValues(expected, actual []*float64, cmd *evalCmd) string {
+	n := len(actual)
+	if len(expected) > n {
+		n = len(expected)
+	}
+	for i := 0; i < n; i++ {
+		var e, a *float64
+		if i < len(expected) {
+			e = expected[i]
+		}
+		if i < len(actual) {
+			a = actual[i]
+		}
+		ts := cmd.start + int64(i)*cmd.step
+		switch {
+		case e == nil && a == nil:
+		case e == nil:
+			return fmt.Sprintf("unexpected value %g at %d", *a, ts)
+		case a == nil:
+			return fmt.Sprintf("missing value %g at %d", *e, ts)
+		case !almostEqual(*e, *a):
+			return fmt.Sprintf("expected %g at %d, got %g", *e, ts, *a)
+		}
+	}
+	return ""
+}
+
+func almostEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= epsilon*math.Max(math.Abs(a), math.Abs(b))
+}
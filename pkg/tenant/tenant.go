@@ -0,0 +1,17 @@
+// Package tenant carries the identity of the tenant issuing a query.
+package tenant
+
+import "context"
+
+type contextKey struct{}
+
+// WithID returns a context which identifies the tenant issuing queries with it.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the tenant set on ctx, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
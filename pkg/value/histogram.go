@@ -0,0 +1,114 @@
+package value
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Histogram is a native histogram sample, in the form of the Prometheus HTTP
+// API: the count and sum of the observations, and the populated buckets.
+type Histogram struct {
+	Count   float64
+	Sum     float64
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket is a bucket of a native histogram.
+type HistogramBucket struct {
+	// Boundaries tells which bounds are part of the bucket: 0 for the upper
+	// one only, 1 for the lower one only, 2 for none and 3 for both.
+	Boundaries int
+	Lower      float64
+	Upper      float64
+	Count      float64
+}
+
+func (h *Histogram) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "{count:%s, sum:%s", formatFloat(h.Count), formatFloat(h.Sum))
+	for _, bucket := range h.Buckets {
+		left, right := "(", "]"
+		switch bucket.Boundaries {
+		case 1:
+			left, right = "[", ")"
+		case 2:
+			right = ")"
+		case 3:
+			left = "["
+		}
+		fmt.Fprintf(&b, ", %s%s,%s%s:%s", left, formatFloat(bucket.Lower), formatFloat(bucket.Upper), right, formatFloat(bucket.Count))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+type histogramJSON struct {
+	Count   string               `json:"count"`
+	Sum     string               `json:"sum"`
+	Buckets [][4]json.RawMessage `json:"buckets,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	v := histogramJSON{
+		Count: formatFloat(h.Count),
+		Sum:   formatFloat(h.Sum),
+	}
+	for _, bucket := range h.Buckets {
+		v.Buckets = append(v.Buckets, [4]json.RawMessage{
+			json.RawMessage(strconv.Itoa(bucket.Boundaries)),
+			json.RawMessage(strconv.Quote(formatFloat(bucket.Lower))),
+			json.RawMessage(strconv.Quote(formatFloat(bucket.Upper))),
+			json.RawMessage(strconv.Quote(formatFloat(bucket.Count))),
+		})
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	var v histogramJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var err error
+	if h.Count, err = strconv.ParseFloat(v.Count, 64); err != nil {
+		return errors.New("histogram unmarshal err: count format err")
+	}
+	if h.Sum, err = strconv.ParseFloat(v.Sum, 64); err != nil {
+		return errors.New("histogram unmarshal err: sum format err")
+	}
+	h.Buckets = make([]HistogramBucket, 0, len(v.Buckets))
+	for _, raw := range v.Buckets {
+		var (
+			bucket HistogramBucket
+			fields [3]string
+		)
+		if err := json.Unmarshal(raw[0], &bucket.Boundaries); err != nil {
+			return errors.New("histogram unmarshal err: bucket boundaries format err")
+		}
+		for i := range fields {
+			if err := json.Unmarshal(raw[i+1], &fields[i]); err != nil {
+				return errors.New("histogram unmarshal err: bucket format err")
+			}
+		}
+		if bucket.Lower, err = strconv.ParseFloat(fields[0], 64); err != nil {
+			return errors.New("histogram unmarshal err: bucket format err")
+		}
+		if bucket.Upper, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return errors.New("histogram unmarshal err: bucket format err")
+		}
+		if bucket.Count, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return errors.New("histogram unmarshal err: bucket format err")
+		}
+		h.Buckets = append(h.Buckets, bucket)
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
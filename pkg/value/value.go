@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -100,6 +101,41 @@ type Series struct {
 	Points []Point       `json:"values"`
 }
 
+type seriesJSON struct {
+	Metric     labels.Labels `json:"metric"`
+	Values     []Point       `json:"values,omitempty"`
+	Histograms []Point       `json:"histograms,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Float and histogram points are
+// listed separately, as "values" and "histograms", each left out if empty.
+func (s Series) MarshalJSON() ([]byte, error) {
+	v := seriesJSON{Metric: s.Metric}
+	for _, p := range s.Points {
+		if p.H != nil {
+			v.Histograms = append(v.Histograms, p)
+		} else {
+			v.Values = append(v.Values, p)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Series) UnmarshalJSON(b []byte) error {
+	var v seriesJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	s.Metric = v.Metric
+	s.Points = v.Values
+	if len(v.Histograms) > 0 {
+		s.Points = append(s.Points, v.Histograms...)
+		sort.SliceStable(s.Points, func(i, j int) bool { return s.Points[i].T < s.Points[j].T })
+	}
+	return nil
+}
+
 func (s Series) String() string {
 	vals := make([]string, len(s.Points))
 	for i, v := range s.Points {
@@ -108,25 +144,33 @@ func (s Series) String() string {
 	return fmt.Sprintf("%s =>\n%s", s.Metric, strings.Join(vals, "\n"))
 }
 
-// Point represents a single data point for a given timestamp.
+// Point represents a single data point for a given timestamp. It holds a
+// native histogram if H is set, and a float otherwise.
 type Point struct {
 	T int64
 	V float64
+	H *Histogram
 }
 
 func (p Point) String() string {
+	if p.H != nil {
+		return fmt.Sprintf("%s @[%v]", p.H, p.T)
+	}
 	v := strconv.FormatFloat(p.V, 'f', -1, 64)
 	return fmt.Sprintf("%v @[%v]", v, p.T)
 }
 
 // MarshalJSON implements json.Marshaler.
 func (p Point) MarshalJSON() ([]byte, error) {
+	if p.H != nil {
+		return json.Marshal([...]interface{}{float64(p.T), p.H})
+	}
 	v := strconv.FormatFloat(p.V, 'f', -1, 64)
 	return json.Marshal([...]interface{}{float64(p.T), v})
 }
 
 func (p *Point) UnmarshalJSON(b []byte) error {
-	var v []interface{}
+	var v []json.RawMessage
 	err := json.Unmarshal(b, &v)
 	if err != nil {
 		return err
@@ -134,19 +178,23 @@ func (p *Point) UnmarshalJSON(b []byte) error {
 	if len(v) < 2 {
 		return errors.New("point unmarshal err: len<2")
 	}
-	ts, ok := v[0].(float64)
-	if !ok {
+	var ts float64
+	if err := json.Unmarshal(v[0], &ts); err != nil {
 		return errors.New("point unmarshal err: ts format err")
 	}
-	vs, ok := v[1].(string)
-	if !ok {
+	p.T = int64(ts)
+	if bytes.HasPrefix(bytes.TrimSpace(v[1]), []byte("{")) {
+		p.H = &Histogram{}
+		return p.H.UnmarshalJSON(v[1])
+	}
+	var vs string
+	if err := json.Unmarshal(v[1], &vs); err != nil {
 		return errors.New("point unmsarshal err: value format err")
 	}
 	vf, err := strconv.ParseFloat(vs, 64)
 	if err != nil {
 		return errors.New("point unmarshal err: float format err")
 	}
-	p.T = int64(ts)
 	p.V = vf
 	return nil
 }
@@ -162,29 +210,40 @@ func (s Sample) String() string {
 	return fmt.Sprintf("%s => %s", s.Metric, s.Point)
 }
 
+type sampleJSON struct {
+	M labels.Labels `json:"metric"`
+	V *Point        `json:"value,omitempty"`
+	H *Point        `json:"histogram,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. The point is a "value" for floats
+// and a "histogram" for native histograms.
 func (s Sample) MarshalJSON() ([]byte, error) {
-	v := struct {
-		M labels.Labels `json:"metric"`
-		V Point         `json:"value"`
-	}{
-		M: s.Metric,
-		V: s.Point,
+	v := sampleJSON{M: s.Metric}
+	if s.H != nil {
+		v.H = &s.Point
+	} else {
+		v.V = &s.Point
 	}
 	return json.Marshal(v)
 }
 
 func (s *Sample) UnmarshalJSON(b []byte) error {
-	v := struct {
-		M labels.Labels `json:"metric"`
-		V Point         `json:"value"`
-	}{}
+	var v sampleJSON
 	dec := json.NewDecoder(bytes.NewReader(b))
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&v); err != nil {
 		return err
 	}
 	s.Metric = v.M
-	s.Point = v.V
+	switch {
+	case v.H != nil:
+		s.Point = *v.H
+	case v.V != nil:
+		s.Point = *v.V
+	default:
+		return errors.New("sample unmarshal err: no value")
+	}
 	return nil
 }
 
@@ -274,6 +333,9 @@ func (m Matrix) ContainsSameLabelset() bool {
 type Result struct {
 	Err   error
 	Value Value
+	// Warnings are about the value, such as divergences between the
+	// backends it was computed from.
+	Warnings []string
 }
 
 // Vector returns a Vector if the result value is one. An error is returned if
@@ -0,0 +1,49 @@
+package value
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func TestSeriesJSON(t *testing.T) {
+	h := &Histogram{Count: 2, Sum: 3, Buckets: []HistogramBucket{{Boundaries: 0, Lower: 1, Upper: 2, Count: 2}}}
+	for _, tc := range []struct {
+		points []Point
+		json   string
+	}{
+		{
+			points: []Point{{T: 1, V: 1}, {T: 2, V: 2}},
+			json:   `{"metric":{"__name__":"up"},"values":[[1,"1"],[2,"2"]]}`,
+		},
+		{
+			points: []Point{{T: 1, H: h}},
+			json:   `{"metric":{"__name__":"up"},"histograms":[[1,{"count":"2","sum":"3","buckets":[[0,"1","2","2"]]}]]}`,
+		},
+		{
+			points: []Point{{T: 1, V: 1}, {T: 2, H: h}},
+			json:   `{"metric":{"__name__":"up"},"values":[[1,"1"]],"histograms":[[2,{"count":"2","sum":"3","buckets":[[0,"1","2","2"]]}]]}`,
+		},
+		{
+			json: `{"metric":{"__name__":"up"}}`,
+		},
+	} {
+		s := Series{Metric: labels.FromStrings("__name__", "up"), Points: tc.points}
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.json {
+			t.Fatalf("expected %s, got %s", tc.json, b)
+		}
+		var got Series
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, s) {
+			t.Fatalf("expected %v after a round trip, got %v", s, got)
+		}
+	}
+}
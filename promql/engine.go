@@ -3,15 +3,26 @@ package promql
 import (
 	"context"
 	"fmt"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-kit/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/lwangrabbit/prom-query/pkg/gate"
+	"github.com/lwangrabbit/prom-query/pkg/labels"
 	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/promql/parser"
 	"github.com/lwangrabbit/prom-query/remote"
 )
 
+const tracerName = "github.com/lwangrabbit/prom-query/promql"
+
 type (
 	// ErrQueryTimeout is returned if a query timed out during processing.
 	ErrQueryTimeout string
@@ -34,12 +45,25 @@ func (e ErrTooManySamples) Error() string {
 	return fmt.Sprintf("query processing would load too many samples into memory in %s", string(e))
 }
 
+// A Query is derived from a raw query string and can be run against an engine
+// it is associated with.
+type Query interface {
+	// Exec processes the query. Can only be called once.
+	Exec(ctx context.Context) *value.Result
+	// Close recovers memory used by the query result.
+	Close()
+	// Cancel signals that a running query execution should be aborted.
+	Cancel()
+}
+
 // query implements the Query interface.
 type query struct {
 	// Underlying data provider.
 	queryable remote.Queryable
 	// The original query string.
 	params *remote.SelectParams
+	// The time shifting constructs of the query.
+	timing parser.Timing
 	// Result matrix for reuse.
 	matrix value.Matrix
 	// Cancellation function for the query.
@@ -63,10 +87,16 @@ func (q *query) Close() {
 	}
 }
 
-// Exec implements the Query interface.
+// Exec implements the Query interface. The stats of the caller on ctx are
+// reused for it to read them.
 func (q *query) Exec(ctx context.Context) *value.Result {
+	stats := remote.StatsFromContext(ctx)
+	if stats == nil {
+		stats = &remote.Stats{}
+		ctx = remote.NewContextWithStats(ctx, stats)
+	}
 	res, err := q.ng.exec(ctx, q)
-	return &value.Result{Err: err, Value: res}
+	return &value.Result{Err: err, Value: res, Warnings: stats.Warnings()}
 }
 
 // contextDone returns an error if the context was canceled or timed out.
@@ -94,24 +124,115 @@ type Engine struct {
 	timeout            time.Duration
 	gate               *gate.Gate
 	maxSamplesPerQuery int
+	splitInterval      time.Duration
+	splitConcurrency   int
+	tenants            *tenantLimiter
+	logger             log.Logger
+	slowQueryThreshold time.Duration
+	activeQueryTracker *ActiveQueryTracker
+	tracerProvider     trace.TracerProvider
+	lookbackDelta      time.Duration
+	sendLookbackDelta  bool // Whether lookbackDelta was configured.
 }
 
 type EngineOpts struct {
 	MaxConcurrent int
 	MaxSamples    int
-	Timeout       time.Duration
+	// Timeout is the maximum time a query takes, waiting in the queue
+	// included. Zero means no timeout.
+	Timeout time.Duration
+
+	// SplitInterval is the time range covered by each sub-query of a range
+	// query. Range queries spanning more than SplitInterval are split into
+	// sub-queries which are executed concurrently, bounded by
+	// SplitConcurrency.
+	// Zero disables splitting.
+	SplitInterval time.Duration
+	// SplitConcurrency is the maximum number of sub-queries of a query
+	// executed concurrently, DefaultSplitConcurrency if 0.
+	SplitConcurrency int
+
+	// MaxQueued is the maximum number of queries waiting for execution,
+	// further queries are rejected. Zero means unlimited.
+	MaxQueued int
+	// ReservedConcurrent holds the number of MaxConcurrent execution slots
+	// reserved to each priority class, see gate.WithPriority. They must leave
+	// at least one slot to all classes, NewEngine panics otherwise.
+	ReservedConcurrent map[gate.Priority]int
+
+	// TenantLimits holds the limits applied to the queries of each tenant,
+	// see tenant.WithID. DefaultTenantLimits applies to the tenants missing
+	// from it, if set.
+	TenantLimits        map[string]TenantLimits
+	DefaultTenantLimits *TenantLimits
+
+	Logger log.Logger
+	// SlowQueryThreshold is the duration from which queries are logged at
+	// warn level. Zero disables slow query logging.
+	SlowQueryThreshold time.Duration
+	// ActiveQueryTracker records the queries in flight, if set. It needs
+	// MaxConcurrent slots, the queued queries aren't recorded.
+	ActiveQueryTracker *ActiveQueryTracker
+	// TracerProvider traces the execution of queries. The backend requests
+	// and queue waits are traced with it as well, unless configured otherwise.
+	TracerProvider trace.TracerProvider
+
+	// LookbackDelta is the time since the last sample after which a series
+	// is considered stale, see WithLookbackDelta to override it per query.
+	// The backends are asked to use it as well, if set. It defaults to the
+	// deprecated LookbackDelta variable, DefaultLookbackDelta unless changed.
+	LookbackDelta time.Duration
 }
 
 func NewEngine(opts EngineOpts) *Engine {
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = trace.NewNoopTracerProvider()
+	}
+	if opts.LookbackDelta <= 0 && LookbackDelta != DefaultLookbackDelta {
+		opts.LookbackDelta = LookbackDelta
+	}
+	// The backends may have been started with another lookback delta than
+	// the default, which is only used by the engine.
+	sendLookbackDelta := opts.LookbackDelta > 0
+	if opts.LookbackDelta <= 0 {
+		opts.LookbackDelta = DefaultLookbackDelta
+	}
+	if opts.SplitConcurrency <= 0 {
+		opts.SplitConcurrency = DefaultSplitConcurrency
+	}
+	g, err := gate.NewWithOpts(gate.Opts{
+		MaxConcurrent: opts.MaxConcurrent,
+		MaxQueued:     opts.MaxQueued,
+		Reserved:      opts.ReservedConcurrent,
+	})
+	if err != nil {
+		panic(fmt.Errorf("promql.NewEngine: %w", err))
+	}
 	return &Engine{
-		gate:               gate.New(opts.MaxConcurrent),
+		gate:               g,
 		timeout:            opts.Timeout,
 		maxSamplesPerQuery: opts.MaxSamples,
+		splitInterval:      opts.SplitInterval,
+		splitConcurrency:   opts.SplitConcurrency,
+		tenants:            newTenantLimiter(opts.TenantLimits, opts.DefaultTenantLimits),
+		logger:             opts.Logger,
+		slowQueryThreshold: opts.SlowQueryThreshold,
+		activeQueryTracker: opts.ActiveQueryTracker,
+		tracerProvider:     opts.TracerProvider,
+		lookbackDelta:      opts.LookbackDelta,
+		sendLookbackDelta:  sendLookbackDelta,
 	}
 }
 
 func (ng *Engine) NewQuery(q remote.Queryable, qs string, startTs, endTs int64, step int) *query {
+	// Queries the analysis fails on are evaluated as if they had no time
+	// shifting constructs, the backends report their errors.
+	timing, _ := parser.AnalyzeTiming(qs)
 	qry := &query{
+		timing:    timing,
 		queryable: q,
 		params: &remote.SelectParams{
 			Query: qs,
@@ -125,51 +246,155 @@ func (ng *Engine) NewQuery(q remote.Queryable, qs string, startTs, endTs int64,
 }
 
 // exec excutes the query.
-func (ng *Engine) exec(ctx context.Context, q *query) (value.Value, error) {
+func (ng *Engine) exec(ctx context.Context, q *query) (v value.Value, err error) {
+	if ng.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ng.timeout)
+		defer cancel()
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("query", q.params.Query),
+		attribute.Int64("start", q.params.Start),
+		attribute.Int64("end", q.params.End),
+		attribute.Int64("step", q.params.Step),
+	}
+	lookbackDelta, send := ng.lookbackDeltaFor(ctx)
+	if send {
+		q.params.LookbackDelta = durationSeconds(lookbackDelta)
+	}
+	// The data selected through @ modifiers can be at any time.
+	if !q.timing.At {
+		dataStart := q.params.Start - durationSeconds(q.timing.MaxLookback) - durationSeconds(lookbackDelta)
+		attrs = append(attrs, attribute.Int64("data_start", dataStart))
+	}
+	ctx, span := ng.tracerProvider.Tracer(tracerName).Start(ctx, "promql.Engine.exec", trace.WithAttributes(attrs...))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	start := time.Now()
+	// Exec put the stats on ctx.
+	stats := remote.StatsFromContext(ctx)
+	defer func() {
+		ng.logQuery(ctx, q.params, time.Since(start), stats, err)
+	}()
+
+	done, err := ng.tenants.start(ctx, q.params)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// A query takes a single spot in the gate, split or not.
 	if err := ng.gate.Start(ctx); err != nil {
 		return nil, contextErr(err, "query queue")
 	}
-	defer ng.gate.Done()
+	defer ng.gate.DoneWithPriority(gate.PriorityFromContext(ctx))
+	// The queries holding a spot are tracked, whether split or not, so the
+	// tracker needs no more slots than the gate has spots.
+	if ng.activeQueryTracker != nil {
+		defer ng.activeQueryTracker.Delete(ng.activeQueryTracker.Insert(ctx, q.params))
+	}
+
+	if q.params.Start == q.params.End && q.params.Step == 0 {
+		return ng.execInstant(ctx, q)
+	}
+	if ng.splitInterval > 0 && q.params.Step > 0 && q.params.End-q.params.Start > durationSeconds(ng.splitInterval) {
+		return ng.execSplit(ctx, q)
+	}
 
-	series, err := ng.populateSeries(ctx, q.queryable, q.params)
+	mat, err := ng.execRange(ctx, q, q.params, new(int64))
+	q.matrix = mat
 	if err != nil {
 		return nil, err
 	}
+	sort.Sort(mat)
+	return mat, nil
+}
 
-	if q.params.Start == q.params.End && q.params.Step == 0 {
-		start := q.params.Start
-		evaluator := &evaluator{
-			startTimestamp: start,
-			endTimestamp:   start,
-			interval:       1,
-			ctx:            ctx,
-			maxSamples:     ng.maxSamplesPerQuery,
+// execInstant executes an instant query at the single timestamp of its
+// params. The vectors returned by the backends are already evaluated, so they
+// are merged as they are rather than resampled: each series gets the sample
+// of the backend with the latest timestamp, and series missing from some
+// backends get the sample of the others.
+// The caller must hold a spot in the engine's gate.
+func (ng *Engine) execInstant(ctx context.Context, q *query) (value.Value, error) {
+	series, mergeSpan, err := ng.populateSeries(ctx, q.queryable, q.params)
+	if err != nil {
+		return nil, err
+	}
+	defer mergeSpan.End()
+
+	// The backends answer with points at the query time, older points are
+	// those of queryables returning raw samples, stale past the lookback.
+	d, _ := ng.lookbackDeltaFor(ctx)
+	minT := q.params.Start - durationSeconds(d)
+	maxSamples, samplesErr := ng.tenants.maxSamples(ctx, ng.maxSamplesPerQuery)
+	vector := make(value.Vector, 0, len(series))
+	for _, s := range series {
+		var (
+			it    = s.Iterator()
+			point value.Point
+			ok    bool
+		)
+		for it.Next() {
+			point.T, point.V = it.At()
+			_, point.H = it.AtHistogram()
+			ok = true
 		}
-		val := evaluator.eval(series)
-		mat, ok := val.(value.Matrix)
-		if !ok {
-			panic(fmt.Errorf("promql.Engine.exec: invalid expression type %q", val.Type()))
+		if err := it.Err(); err != nil {
+			return nil, err
 		}
-		q.matrix = mat
-		// Convert matrix with one value per series into vector.
-		vector := make(value.Vector, len(mat))
-		for i, s := range mat {
-			// Point might have a different timestamp, force it to the evaluation
-			// timestamp as that is when we ran the evaluation.
-			vector[i] = value.Sample{Metric: s.Metric, Point: value.Point{V: s.Points[0].V, T: start}}
+		if !ok || point.T < minT || (point.H == nil && value.IsStaleNaN(point.V)) {
+			continue
 		}
-		return vector, nil
+		if len(vector) >= maxSamples {
+			return nil, samplesErr
+		}
+		vector = append(vector, value.Sample{Metric: s.Labels(), Point: point})
 	}
+	if err := contextDone(ctx, "expression evaluation"); err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
 
-	// Range evaluation
+// execRange selects and evaluates the series of the given range of a range
+// query, counting the samples loaded into samples, which is shared by the
+// sub-queries of a split query. The caller must hold a spot in the engine's
+// gate.
+func (ng *Engine) execRange(ctx context.Context, q *query, params *remote.SelectParams, samples *int64) (value.Matrix, error) {
+	series, mergeSpan, err := ng.populateSeries(ctx, q.queryable, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// The backends evaluated the query at each step already. Series of
+	// queries shifting time have no sample at some steps, e.g. past the end
+	// of the data an offset points to, which the lookback must not fill in.
+	d, _ := ng.lookbackDeltaFor(ctx)
+	lookbackDelta := durationSeconds(d)
+	if q.timing.Shifted() {
+		lookbackDelta = 0
+	}
+
+	maxSamples, samplesErr := ng.tenants.maxSamples(ctx, ng.maxSamplesPerQuery)
 	evaluator := &evaluator{
-		startTimestamp: q.params.Start,
-		endTimestamp:   q.params.End,
-		interval:       q.params.Step,
+		startTimestamp: params.Start,
+		endTimestamp:   params.End,
+		interval:       params.Step,
 		ctx:            ctx,
-		maxSamples:     ng.maxSamplesPerQuery,
+		maxSamples:     maxSamples,
+		samples:        samples,
+		samplesErr:     samplesErr,
+		lookbackDelta:  lookbackDelta,
 	}
-	val := evaluator.eval(series)
+	val, err := evaluator.Eval(series)
+	mergeSpan.End()
 	if err != nil {
 		return nil, err
 	}
@@ -177,28 +402,177 @@ func (ng *Engine) exec(ctx context.Context, q *query) (value.Value, error) {
 	if !ok {
 		panic(fmt.Errorf("promql.Engine.exec: invalid expression type %q", val.Type()))
 	}
-	q.matrix = mat
 	if err := contextDone(ctx, "expression evaluation"); err != nil {
-		return nil, err
+		return mat, err
+	}
+	return mat, nil
+}
+
+// execSplit splits a range query into sub-queries of at most the engine's
+// split interval, executes them concurrently and stitches the resulting
+// series back together. The sub-queries run within the spot of the query in
+// the engine's gate, at most SplitConcurrency of them at a time. The samples of
+// all the sub-queries count towards the limit of the query.
+func (ng *Engine) execSplit(ctx context.Context, q *query) (value.Value, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	params := *q.params
+	if q.timing.AtStartEnd {
+		// start() and end() refer to the range of the whole query.
+		query, err := parser.ResolveAtStartEnd(params.Query, params.Start, params.End)
+		if err != nil {
+			return nil, err
+		}
+		params.Query = query
 	}
+	subParams := splitParams(&params, durationSeconds(ng.splitInterval))
+	results := make([]value.Matrix, len(subParams))
+
+	var (
+		samples  int64
+		next     = make(chan int)
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	// The sub-queries canceled because a sibling failed report the
+	// cancellation, the error of the first failure is the one which caused it.
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	workers := ng.splitConcurrency
+	if workers > len(subParams) {
+		workers = len(subParams)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				mat, err := ng.execRange(ctx, q, subParams[i], &samples)
+				results[i] = mat
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+Split:
+	for i := range subParams {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break Split
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = contextErr(ctx.Err(), "expression evaluation")
+	}
+	if firstErr != nil {
+		for _, mat := range results {
+			for _, s := range mat {
+				putPointSlice(s.Points)
+			}
+		}
+		return nil, firstErr
+	}
+
+	mat := stitchMatrices(results)
+	q.matrix = mat
 	sort.Sort(mat)
 	return mat, nil
 }
 
-func (ng *Engine) populateSeries(ctx context.Context, q remote.Queryable, params *remote.SelectParams) ([]remote.Series, error) {
-	queries, err := q.Querier(ctx)
+// splitParams splits the range of the given params into consecutive ranges
+// aligned to the query step, each covering at most interval seconds.
+func splitParams(params *remote.SelectParams, interval int64) []*remote.SelectParams {
+	stepsPerSplit := interval / params.Step
+	if stepsPerSplit < 1 {
+		stepsPerSplit = 1
+	}
+	var res []*remote.SelectParams
+	for start := params.Start; start <= params.End; start += stepsPerSplit * params.Step {
+		end := start + (stepsPerSplit-1)*params.Step
+		if end > params.End {
+			end = params.End
+		}
+		res = append(res, &remote.SelectParams{
+			Query:         params.Query,
+			Start:         start,
+			End:           end,
+			Step:          params.Step,
+			LookbackDelta: params.LookbackDelta,
+		})
+	}
+	return res
+}
+
+// stitchMatrices concatenates the points of series with equal labels across
+// the given matrices, which must be ordered by time and not overlap.
+func stitchMatrices(mats []value.Matrix) value.Matrix {
+	var (
+		res   value.Matrix
+		index = map[uint64][]int{} // Indexes in res by hash of the labels.
+	)
+	for _, mat := range mats {
+	Series:
+		for _, s := range mat {
+			h := s.Metric.Hash()
+			for _, i := range index[h] {
+				if labels.Equal(res[i].Metric, s.Metric) {
+					res[i].Points = append(res[i].Points, s.Points...)
+					putPointSlice(s.Points)
+					continue Series
+				}
+			}
+			index[h] = append(index[h], len(res))
+			res = append(res, value.Series{Metric: s.Metric, Points: append([]value.Point(nil), s.Points...)})
+			putPointSlice(s.Points)
+		}
+	}
+	return res
+}
+
+// populateSeries selects the series of the given params. The samples of the
+// series are merged as they are iterated, so the caller ends the returned
+// merge span once done with them.
+func (ng *Engine) populateSeries(ctx context.Context, q remote.Queryable, params *remote.SelectParams) ([]remote.Series, trace.Span, error) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	selectCtx, span := tracer.Start(ctx, "promql.Engine.populateSeries")
+	defer span.End()
+
+	queries, err := q.Querier(selectCtx)
 	if err != nil {
-		return nil, err
+		return nil, nil, selectErr(ctx, err)
 	}
 	set, err := queries.Select(params)
 	if err != nil {
-		return nil, err
+		return nil, nil, selectErr(ctx, err)
 	}
+	_, mergeSpan := tracer.Start(ctx, "remote.mergeSeriesSet")
 	ret, err := expandSeriesSet(ctx, set)
+	mergeSpan.SetAttributes(attribute.Int("series", len(ret)))
 	if err != nil {
-		return nil, err
+		mergeSpan.End()
+		return nil, nil, selectErr(ctx, err)
+	}
+	return ret, mergeSpan, nil
+}
+
+// selectErr returns the error of the query on ctx if it timed out or was
+// canceled, which the backends failed on, and err otherwise.
+func selectErr(ctx context.Context, err error) error {
+	if ctxErr := contextDone(ctx, "series selection"); ctxErr != nil {
+		return ctxErr
 	}
-	return ret, nil
+	return err
 }
 
 func expandSeriesSet(ctx context.Context, it remote.SeriesSet) (res []remote.Series, err error) {
@@ -234,14 +608,28 @@ type evaluator struct {
 	endTimestamp   int64
 	interval       int64
 
-	maxSamples     int
-	currentSamples int
+	maxSamples int
+	// samples counts the samples loaded, atomically. samplesErr is raised
+	// when more than maxSamples samples are loaded.
+	samples    *int64
+	samplesErr error
+
+	lookbackDelta int64 // In seconds.
+}
+
+// Eval evaluates the given series and recovers from errors raised during
+// evaluation.
+func (ev *evaluator) Eval(series []remote.Series) (v value.Value, err error) {
+	_, span := trace.SpanFromContext(ev.ctx).TracerProvider().Tracer(tracerName).Start(ev.ctx, "promql.evaluator.Eval")
+	defer span.End()
+	defer ev.recover(&err)
+	return ev.eval(series), nil
 }
 
 func (ev *evaluator) eval(series []remote.Series) value.Value {
 	numSteps := int((ev.endTimestamp-ev.startTimestamp)/ev.interval) + 1
 	mat := make(value.Matrix, 0, len(series))
-	it := remote.NewBuffer(durationSeconds(LookbackDelta))
+	it := remote.NewBuffer(ev.lookbackDelta)
 	for _, s := range series {
 		it.Reset(s.Iterator())
 		ss := value.Series{
@@ -250,14 +638,12 @@ func (ev *evaluator) eval(series []remote.Series) value.Value {
 		}
 
 		for ts := ev.startTimestamp; ts <= ev.endTimestamp; ts += ev.interval {
-			_, v, ok := ev.vectorSelectorSingle(it, ts)
+			_, v, h, ok := ev.vectorSelectorSingle(it, ts)
 			if ok {
-				if ev.currentSamples < ev.maxSamples {
-					ss.Points = append(ss.Points, value.Point{V: v, T: ts})
-					ev.currentSamples++
-				} else {
-					ev.error(ErrTooManySamples("query execution"))
+				if atomic.AddInt64(ev.samples, 1) > int64(ev.maxSamples) {
+					ev.error(ev.samplesErr)
 				}
+				ss.Points = append(ss.Points, value.Point{V: v, H: h, T: ts})
 			}
 		}
 
@@ -268,11 +654,13 @@ func (ev *evaluator) eval(series []remote.Series) value.Value {
 	return mat
 }
 
-// vectorSelectorSingle evaluates a instant vector for the iterator of one time series.
-func (ev *evaluator) vectorSelectorSingle(it *remote.BufferedSeriesIterator, ts int64) (int64, float64, bool) {
+// vectorSelectorSingle evaluates a instant vector for the iterator of one time
+// series. h is set if the sample is a native histogram.
+func (ev *evaluator) vectorSelectorSingle(it *remote.BufferedSeriesIterator, ts int64) (int64, float64, *value.Histogram, bool) {
 	refTime := ts
 	var t int64
 	var v float64
+	var h *value.Histogram
 
 	ok := it.Seek(refTime)
 	if !ok {
@@ -283,18 +671,27 @@ func (ev *evaluator) vectorSelectorSingle(it *remote.BufferedSeriesIterator, ts
 
 	if ok {
 		t, v = it.Values()
+		h = it.HistogramValue()
 	}
 
 	if !ok || t > refTime {
-		t, v, ok = it.PeekBack(1)
-		if !ok || t < refTime-durationSeconds(LookbackDelta) {
-			return 0, 0, false
+		t, v, h, ok = it.PeekBack(1)
+		if !ok || t < refTime-ev.lookbackDelta || ev.onStep(t) {
+			return 0, 0, nil, false
 		}
 	}
-	if value.IsStaleNaN(v) {
-		return 0, 0, false
+	if h == nil && value.IsStaleNaN(v) {
+		return 0, 0, nil, false
 	}
-	return t, v, true
+	return t, v, h, true
+}
+
+// onStep returns whether t is a step of the evaluation. The points the
+// backends return at the steps are their evaluation of the query at these
+// steps: the steps they have no point at are steps the series is absent from,
+// e.g. once stale, which the lookback must not fill from an earlier step.
+func (ev *evaluator) onStep(t int64) bool {
+	return t >= ev.startTimestamp && (t-ev.startTimestamp)%ev.interval == 0
 }
 
 // errorf causes a panic with the input formatted into an error.
@@ -307,14 +704,58 @@ func (ev *evaluator) error(err error) {
 	panic(err)
 }
 
+// recover is the handler that turns panics into returns from the top level of evaluation.
+func (ev *evaluator) recover(errp *error) {
+	e := recover()
+	if e == nil {
+		return
+	}
+	if err, ok := e.(runtime.Error); ok {
+		*errp = fmt.Errorf("unexpected error: %s", err)
+	} else if err, ok := e.(error); ok {
+		*errp = err
+	} else {
+		*errp = fmt.Errorf("unexpected error: %v", e)
+	}
+}
+
 func durationSeconds(d time.Duration) int64 {
 	return int64(d / (time.Second / time.Nanosecond))
 }
 
+// LookbackDelta is the lookback delta of the engines created without one.
+//
+// Deprecated: Use EngineOpts.LookbackDelta, or WithLookbackDelta per query.
+var LookbackDelta = DefaultLookbackDelta
+
 const (
 	DefaultLookbackDelta = 5 * time.Minute
+	// DefaultSplitConcurrency is the default maximum number of sub-queries
+	// of a split query executed concurrently.
+	DefaultSplitConcurrency = 4
 )
 
-// LookbackDelta determines the time since the last sample after which a time
-// series is considered stale.
-var LookbackDelta = DefaultLookbackDelta
+type contextKey int
+
+const lookbackDeltaKey contextKey = iota
+
+// WithLookbackDelta returns a context which makes the engine evaluate the
+// query with the given lookback delta instead of its own.
+func WithLookbackDelta(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, lookbackDeltaKey, d)
+}
+
+// LookbackDeltaFromContext returns the lookback delta set on ctx, if any.
+func LookbackDeltaFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(lookbackDeltaKey).(time.Duration)
+	return d, ok && d > 0
+}
+
+// lookbackDeltaFor returns the lookback delta of the query of ctx, and
+// whether it was configured, to be sent to the backends.
+func (ng *Engine) lookbackDeltaFor(ctx context.Context) (time.Duration, bool) {
+	if d, ok := LookbackDeltaFromContext(ctx); ok {
+		return d, true
+	}
+	return ng.lookbackDelta, ng.sendLookbackDelta
+}
@@ -0,0 +1,320 @@
+package promql
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+// failingQueryable fails the queries starting at failAt, and answers the
+// others after a while unless their context is canceled first.
+type failingQueryable struct {
+	remote.Queryable
+	failAt int64
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *failingQueryable) Querier(ctx context.Context) (remote.Querier, error) {
+	q, err := f.Queryable.Querier(ctx)
+	return &failingQuerier{Querier: q, ctx: ctx, failAt: f.failAt}, err
+}
+
+type failingQuerier struct {
+	remote.Querier
+	ctx    context.Context
+	failAt int64
+}
+
+func (q *failingQuerier) Select(p *remote.SelectParams) (remote.SeriesSet, error) {
+	if p.Start == q.failAt {
+		return nil, errInjected
+	}
+	select {
+	case <-q.ctx.Done():
+		return nil, q.ctx.Err()
+	case <-time.After(10 * time.Millisecond):
+	}
+	return q.Querier.Select(p)
+}
+
+func newTestStorage(t *testing.T, numSeries int, end int64) *remote.MemoryStorage {
+	t.Helper()
+	m := remote.NewMemoryStorage(0)
+	for i := 0; i < numSeries; i++ {
+		ls := labels.FromStrings("__name__", "up", "i", string(rune('a'+i)))
+		for ts := int64(0); ts <= end; ts += 60 {
+			if err := m.Append(ls, ts, float64(ts)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return m
+}
+
+func TestExecSplit(t *testing.T) {
+	m := newTestStorage(t, 2, 3600)
+	ng := NewEngine(EngineOpts{MaxConcurrent: 2, MaxSamples: 1000, Timeout: time.Minute, SplitInterval: 10 * time.Minute})
+	res := ng.NewQuery(m, "up", 0, 3600, 60).Exec(context.Background())
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	mat := res.Value.(value.Matrix)
+	if len(mat) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(mat))
+	}
+	for _, s := range mat {
+		if len(s.Points) != 61 {
+			t.Fatalf("expected 61 points for %s, got %d", s.Metric, len(s.Points))
+		}
+		for i, p := range s.Points {
+			if p.T != int64(i)*60 || p.V != float64(p.T) {
+				t.Fatalf("unexpected point %v at step %d of %s", p, i, s.Metric)
+			}
+		}
+	}
+}
+
+func TestExecSplitMaxSamples(t *testing.T) {
+	m := newTestStorage(t, 2, 3600)
+	// Each sub-query loads 20 samples at most, 122 altogether.
+	ng := NewEngine(EngineOpts{MaxConcurrent: 2, MaxSamples: 100, Timeout: time.Minute, SplitInterval: 10 * time.Minute})
+	res := ng.NewQuery(m, "up", 0, 3600, 60).Exec(context.Background())
+	if _, ok := res.Err.(ErrTooManySamples); !ok {
+		t.Fatalf("expected ErrTooManySamples, got %v", res.Err)
+	}
+}
+
+func TestExecSplitFirstError(t *testing.T) {
+	q := &failingQueryable{Queryable: newTestStorage(t, 1, 3600), failAt: 1800}
+	ng := NewEngine(EngineOpts{MaxConcurrent: 4, MaxSamples: 1000, Timeout: time.Minute, SplitInterval: 10 * time.Minute})
+	res := ng.NewQuery(q, "up", 0, 3600, 60).Exec(context.Background())
+	if !errors.Is(res.Err, errInjected) {
+		t.Fatalf("expected the injected error, got %v", res.Err)
+	}
+}
+
+func TestExecSplitSingleGateSpot(t *testing.T) {
+	m := newTestStorage(t, 1, 3600)
+	// The 7 sub-queries run within the spot of the query, rather than
+	// queueing behind each other.
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxQueued: 1, MaxSamples: 1000, Timeout: time.Minute, SplitInterval: 10 * time.Minute})
+	res := ng.NewQuery(m, "up", 0, 3600, 60).Exec(context.Background())
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	m := newTestStorage(t, 1, 600)
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxSamples: 1000, Timeout: 5 * time.Millisecond})
+
+	// The queryable answers after 10ms.
+	res := ng.NewQuery(&failingQueryable{Queryable: m, failAt: -1}, "up", 0, 600, 60).Exec(context.Background())
+	if _, ok := res.Err.(ErrQueryTimeout); !ok {
+		t.Fatalf("expected a timeout, got %v", res.Err)
+	}
+
+	// Waiting in the queue counts.
+	if err := ng.gate.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res = ng.NewQuery(m, "up", 600, 600, 0).Exec(context.Background())
+	ng.gate.Done()
+	if res.Err != ErrQueryTimeout("query queue") {
+		t.Fatalf("expected a timeout in the queue, got %v", res.Err)
+	}
+
+	res = ng.NewQuery(m, "up", 600, 600, 0).Exec(context.Background())
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+}
+
+func TestExecActiveQueryTracker(t *testing.T) {
+	m := newTestStorage(t, 1, 3600)
+	// The tracker needs a slot per gate spot, whatever the queued and split
+	// sub-queries.
+	tracker, err := NewActiveQueryTracker(t.TempDir(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxSamples: 1000, Timeout: time.Minute, SplitInterval: 10 * time.Minute, ActiveQueryTracker: tracker})
+
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- ng.NewQuery(m, "up", 0, 3600, 60).Exec(context.Background()).Err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("queries blocked on the active query tracker")
+		}
+	}
+}
+
+func TestExecMergeSpan(t *testing.T) {
+	m := newTestStorage(t, 1, 3600)
+	rec := tracetest.NewSpanRecorder()
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxSamples: 1000, Timeout: time.Minute, TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))})
+	if res := ng.NewQuery(m, "up", 0, 3600, 60).Exec(context.Background()); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// The samples are merged while evaluated, within the merge span.
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	merge, eval := spans["remote.mergeSeriesSet"], spans["promql.evaluator.Eval"]
+	if merge == nil || eval == nil {
+		t.Fatalf("expected merge and evaluation spans, got %v", spans)
+	}
+	if merge.EndTime().Before(eval.EndTime()) {
+		t.Fatalf("expected the merge span to end after the evaluation, ended at %s and %s", merge.EndTime(), eval.EndTime())
+	}
+}
+
+func TestExecLookbackDelta(t *testing.T) {
+	m := remote.NewMemoryStorage(0)
+	if err := m.Append(labels.FromStrings("__name__", "up"), 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxSamples: 1000, Timeout: time.Minute, LookbackDelta: time.Minute})
+
+	for _, tc := range []struct {
+		lookbackDelta time.Duration // Per query, the engine's if 0.
+		points        int           // Of the range query from 0 to 5m.
+		instant       int           // Series at 90s.
+	}{
+		{0, 1, 0},
+		{2 * time.Minute, 2, 1},
+		{10 * time.Minute, 6, 1},
+	} {
+		ctx := context.Background()
+		if tc.lookbackDelta > 0 {
+			ctx = WithLookbackDelta(ctx, tc.lookbackDelta)
+		}
+		res := ng.NewQuery(m, "up", 0, 300, 60).Exec(ctx)
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if mat := res.Value.(value.Matrix); len(mat) != 1 || len(mat[0].Points) != tc.points {
+			t.Errorf("lookback delta %s: expected %d points, got %v", tc.lookbackDelta, tc.points, mat)
+		}
+
+		res = ng.NewQuery(m, "up", 90, 90, 0).Exec(ctx)
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if vec := res.Value.(value.Vector); len(vec) != tc.instant {
+			t.Errorf("lookback delta %s: expected %d series at 90s, got %v", tc.lookbackDelta, tc.instant, vec)
+		}
+	}
+}
+
+// rawQueryable answers the queries with the raw samples of its storage up to
+// the query time, as backends returning unevaluated series do.
+type rawQueryable struct {
+	*remote.MemoryStorage
+}
+
+func (r rawQueryable) Querier(ctx context.Context) (remote.Querier, error) {
+	q, err := r.MemoryStorage.Querier(ctx)
+	return rawQuerier{Querier: q, storage: r.MemoryStorage}, err
+}
+
+type rawQuerier struct {
+	remote.Querier
+	storage *remote.MemoryStorage
+}
+
+func (q rawQuerier) Select(p *remote.SelectParams) (remote.SeriesSet, error) {
+	matchers, err := labels.ParseSelector(p.Query)
+	if err != nil {
+		return nil, err
+	}
+	return q.storage.SelectSamples(matchers, 0, p.End), nil
+}
+
+func TestExecInstant(t *testing.T) {
+	m := remote.NewMemoryStorage(0)
+	h := &value.Histogram{Count: 2, Sum: 3, Buckets: []value.HistogramBucket{{Lower: 0, Upper: 1, Count: 2}}}
+	for _, s := range []struct {
+		name    string
+		samples []value.Point
+	}{
+		{"current", []value.Point{{T: 0, V: 1}, {T: 60, V: 2}, {T: 120, V: 3}}},
+		{"old", []value.Point{{T: 0, V: 1}, {T: 60, V: 2}}},
+		{"stale", []value.Point{{T: 60, V: 1}, {T: 120, V: math.Float64frombits(value.StaleNaN)}}},
+		{"histogram", []value.Point{{T: 120, H: h}}},
+	} {
+		ls := labels.FromStrings("__name__", "up", "series", s.name)
+		for _, p := range s.samples {
+			var err error
+			if p.H != nil {
+				err = m.AppendHistogram(ls, p.T, p.H)
+			} else {
+				err = m.Append(ls, p.T, p.V)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ng := NewEngine(EngineOpts{MaxConcurrent: 1, MaxSamples: 1000, Timeout: time.Minute, LookbackDelta: time.Minute})
+
+	for name, queryable := range map[string]remote.Queryable{
+		"evaluated": m,
+		"raw":       rawQueryable{m},
+	} {
+		// The sample at 60s is older than the lookback delta at 150s.
+		res := ng.NewQuery(queryable, "up", 150, 150, 0).Exec(context.Background())
+		if res.Err != nil {
+			t.Fatalf("%s: %s", name, res.Err)
+		}
+		vec := res.Value.(value.Vector)
+		if len(vec) != 2 {
+			t.Fatalf("%s: expected 2 series, got %v", name, vec)
+		}
+		for _, s := range vec {
+			switch s.Metric.Get("series") {
+			case "current":
+				if s.H != nil || s.V != 3 {
+					t.Errorf("%s: unexpected sample %v", name, s)
+				}
+			case "histogram":
+				if s.H == nil || s.H.Count != 2 || s.H.Sum != 3 {
+					t.Errorf("%s: unexpected sample %v", name, s)
+				}
+			default:
+				t.Errorf("%s: unexpected series %s", name, s.Metric)
+			}
+		}
+
+		// Before the stale marker, the series of the stale one is current.
+		res = ng.NewQuery(queryable, `up{series="stale"}`, 90, 90, 0).Exec(context.Background())
+		if res.Err != nil {
+			t.Fatalf("%s: %s", name, res.Err)
+		}
+		if vec := res.Value.(value.Vector); len(vec) != 1 || vec[0].V != 1 {
+			t.Errorf("%s: expected the sample before the stale marker, got %v", name, vec)
+		}
+	}
+}
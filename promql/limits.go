@@ -0,0 +1,173 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lwangrabbit/prom-query/pkg/gate"
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+// TenantLimits holds the limits applied to the queries of a single tenant.
+// Zero values mean unlimited.
+type TenantLimits struct {
+	// MaxConcurrent is the maximum number of concurrently executing queries.
+	MaxConcurrent int
+	// MaxQueued is the maximum number of queries waiting for one of the
+	// MaxConcurrent spots. Further queries are rejected.
+	MaxQueued int
+	// MaxSamples is the maximum number of samples a query may load.
+	MaxSamples int
+	// MaxRange is the maximum time range of a range query.
+	MaxRange time.Duration
+	// MaxQueriesPerSecond is the sustained rate of accepted queries, with
+	// bursts of up to QueryBurst queries.
+	MaxQueriesPerSecond float64
+	QueryBurst          int
+}
+
+// ErrTenantLimit is returned if a query exceeds a limit of its tenant.
+type ErrTenantLimit struct {
+	Tenant string
+	Limit  string
+}
+
+func (e ErrTenantLimit) Error() string {
+	return fmt.Sprintf("query of tenant %q exceeds the %s limit", e.Tenant, e.Limit)
+}
+
+// tenantLimiter enforces the limits of every tenant.
+type tenantLimiter struct {
+	limits   map[string]TenantLimits
+	defaults *TenantLimits
+
+	mtx     sync.Mutex
+	gates   map[string]*gate.Gate
+	buckets map[string]*tokenBucket
+}
+
+func newTenantLimiter(limits map[string]TenantLimits, defaults *TenantLimits) *tenantLimiter {
+	return &tenantLimiter{
+		limits:   limits,
+		defaults: defaults,
+		gates:    map[string]*gate.Gate{},
+		buckets:  map[string]*tokenBucket{},
+	}
+}
+
+// get returns the limits of the tenant on ctx. Queries without tenant, and
+// of tenants without configured or default limits, are not limited.
+func (l *tenantLimiter) get(ctx context.Context) (string, TenantLimits, bool) {
+	id := tenant.FromContext(ctx)
+	if id == "" {
+		return "", TenantLimits{}, false
+	}
+	if lim, ok := l.limits[id]; ok {
+		return id, lim, true
+	}
+	if l.defaults != nil {
+		return id, *l.defaults, true
+	}
+	return id, TenantLimits{}, false
+}
+
+// start admits the query of the given params under the limits of its tenant
+// and returns the function releasing it.
+func (l *tenantLimiter) start(ctx context.Context, params *remote.SelectParams) (func(), error) {
+	id, lim, ok := l.get(ctx)
+	if !ok {
+		return func() {}, nil
+	}
+	if lim.MaxRange > 0 && params.End-params.Start > durationSeconds(lim.MaxRange) {
+		return nil, ErrTenantLimit{Tenant: id, Limit: "query range"}
+	}
+	if lim.MaxQueriesPerSecond > 0 && !l.bucket(id, lim).take(time.Now()) {
+		return nil, ErrTenantLimit{Tenant: id, Limit: "query rate"}
+	}
+	if lim.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	g := l.gate(id, lim)
+	if err := g.Start(ctx); err != nil {
+		if _, ok := err.(gate.ErrTooManyQueued); ok {
+			return nil, ErrTenantLimit{Tenant: id, Limit: "concurrency"}
+		}
+		return nil, contextErr(err, "tenant query queue")
+	}
+	p := gate.PriorityFromContext(ctx)
+	return func() { g.DoneWithPriority(p) }, nil
+}
+
+// maxSamples returns the sample limit of the query on ctx if it is lower
+// than max, along with the error to report when it is exceeded.
+func (l *tenantLimiter) maxSamples(ctx context.Context, max int) (int, error) {
+	id, lim, ok := l.get(ctx)
+	if !ok || lim.MaxSamples <= 0 || lim.MaxSamples >= max {
+		return max, ErrTooManySamples("query execution")
+	}
+	return lim.MaxSamples, ErrTenantLimit{Tenant: id, Limit: "samples"}
+}
+
+func (l *tenantLimiter) gate(id string, lim TenantLimits) *gate.Gate {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	g, ok := l.gates[id]
+	if !ok {
+		// The options are valid without reserved spots.
+		g, _ = gate.NewWithOpts(gate.Opts{MaxConcurrent: lim.MaxConcurrent, MaxQueued: lim.MaxQueued})
+		l.gates[id] = g
+	}
+	return g
+}
+
+func (l *tenantLimiter) bucket(id string, lim TenantLimits) *tokenBucket {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.buckets[id]
+	if !ok {
+		b = newTokenBucket(lim.MaxQueriesPerSecond, lim.QueryBurst)
+		l.buckets[id] = b
+	}
+	return b
+}
+
+// tokenBucket is a rate limiter refilling rate tokens per second up to burst.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// take takes a token if one is available at time now.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
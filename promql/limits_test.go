@@ -0,0 +1,113 @@
+package promql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Unix(0, 0)
+
+	// The burst is available at once.
+	for i := 0; i < 3; i++ {
+		if !b.take(now) {
+			t.Fatalf("expected token %d of the burst", i)
+		}
+	}
+	if b.take(now) {
+		t.Fatal("expected the bucket to be empty after the burst")
+	}
+
+	// Tokens are refilled at the rate, up to the burst.
+	if b.take(now.Add(400 * time.Millisecond)) {
+		t.Fatal("expected no token after 0.8 refilled")
+	}
+	if !b.take(now.Add(500 * time.Millisecond)) {
+		t.Fatal("expected a token after 1 refilled")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.take(now) {
+			t.Fatalf("expected token %d after the refill", i)
+		}
+	}
+	if b.take(now) {
+		t.Fatal("expected the refill to be capped at the burst")
+	}
+}
+
+func TestTenantLimiterRate(t *testing.T) {
+	l := newTenantLimiter(map[string]TenantLimits{"a": {MaxQueriesPerSecond: 1, QueryBurst: 1}}, nil)
+	ctx := tenant.WithID(context.Background(), "a")
+	params := &remote.SelectParams{Query: "up"}
+
+	done, err := l.start(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if _, err := l.start(ctx, params); err != (ErrTenantLimit{Tenant: "a", Limit: "query rate"}) {
+		t.Fatalf("expected the query rate limit, got %v", err)
+	}
+	// Other tenants aren't limited.
+	if _, err := l.start(tenant.WithID(context.Background(), "b"), params); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTenantLimiterConcurrency(t *testing.T) {
+	l := newTenantLimiter(nil, &TenantLimits{MaxConcurrent: 1, MaxQueued: 1})
+	ctx := tenant.WithID(context.Background(), "a")
+	params := &remote.SelectParams{Query: "up"}
+
+	done, err := l.start(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := ErrTenantLimit{Tenant: "a", Limit: "concurrency"}
+	queued := make(chan error)
+	go func() {
+		for {
+			done, err := l.start(ctx, params)
+			if err == limited {
+				// A probe below holds the queued spot for a moment.
+				continue
+			}
+			if err == nil {
+				done()
+			}
+			queued <- err
+			return
+		}
+	}()
+
+	// Once a query waits, the others are rejected without waiting.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		_, err := l.start(probeCtx, params)
+		cancel()
+		if err == limited {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the concurrency limit, got %v", err)
+		}
+	}
+	// Other tenants have gates of their own.
+	otherDone, err := l.start(tenant.WithID(context.Background(), "b"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDone()
+
+	done()
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,172 @@
+// Package parser provides lexical analysis of PromQL expressions, enough to
+// locate and rewrite the series selectors of a query without evaluating it.
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ItemType is the type of a lexed item.
+type ItemType int
+
+// The lexed item types.
+const (
+	ItemError ItemType = iota
+	ItemEOF
+	ItemSpace
+	ItemComment
+	ItemIdentifier
+	ItemString
+	ItemNumber
+	ItemLeftParen
+	ItemRightParen
+	ItemLeftBrace
+	ItemRightBrace
+	ItemLeftBracket
+	ItemRightBracket
+	ItemComma
+	ItemOperator
+)
+
+// Item is a token of a PromQL expression.
+type Item struct {
+	Typ ItemType
+	Pos int    // Byte offset of the item in the input.
+	Val string // The item's value as it appears in the input.
+}
+
+// End returns the byte offset in the input right after the item.
+func (i Item) End() int {
+	return i.Pos + len(i.Val)
+}
+
+func (i Item) String() string {
+	return fmt.Sprintf("%q@%d", i.Val, i.Pos)
+}
+
+// Lex splits the input into items. It returns an error for unterminated
+// strings and characters which can't start a token.
+func Lex(input string) ([]Item, error) {
+	var items []Item
+	pos := 0
+	for pos < len(input) {
+		r, w := utf8.DecodeRuneInString(input[pos:])
+		start := pos
+		typ := ItemOperator
+
+		switch {
+		case isSpace(r):
+			typ = ItemSpace
+			for pos < len(input) {
+				r, w = utf8.DecodeRuneInString(input[pos:])
+				if !isSpace(r) {
+					break
+				}
+				pos += w
+			}
+		case r == '#':
+			typ = ItemComment
+			if i := strings.IndexByte(input[pos:], '\n'); i >= 0 {
+				pos += i
+			} else {
+				pos = len(input)
+			}
+		case r == '"' || r == '\'' || r == '`':
+			typ = ItemString
+			end, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+		case isDigit(r) || (r == '.' && pos+1 < len(input) && isDigit(rune(input[pos+1]))):
+			typ = ItemNumber
+			pos = lexNumber(input, pos)
+		case isAlpha(r):
+			typ = ItemIdentifier
+			for pos < len(input) {
+				r, w = utf8.DecodeRuneInString(input[pos:])
+				if !isAlphaNumeric(r) && r != ':' {
+					break
+				}
+				pos += w
+			}
+		case r == '(':
+			typ, pos = ItemLeftParen, pos+w
+		case r == ')':
+			typ, pos = ItemRightParen, pos+w
+		case r == '{':
+			typ, pos = ItemLeftBrace, pos+w
+		case r == '}':
+			typ, pos = ItemRightBrace, pos+w
+		case r == '[':
+			typ, pos = ItemLeftBracket, pos+w
+		case r == ']':
+			typ, pos = ItemRightBracket, pos+w
+		case r == ',':
+			typ, pos = ItemComma, pos+w
+		case strings.ContainsRune("+-*/%^=!<>~@:", r):
+			pos += w
+			// Two character operators: ==, !=, <=, >=, =~, !~.
+			if pos < len(input) && strings.ContainsRune("=~", rune(input[pos])) && strings.ContainsRune("=!<>", r) {
+				pos++
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+		}
+		items = append(items, Item{Typ: typ, Pos: start, Val: input[start:pos]})
+	}
+	return items, nil
+}
+
+// lexString returns the end of the quoted string starting at pos.
+func lexString(input string, pos int) (int, error) {
+	quote := input[pos]
+	for i := pos + 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted string at position %d", pos)
+}
+
+// lexNumber returns the end of the number or duration starting at pos.
+func lexNumber(input string, pos int) int {
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case isAlphaNumeric(rune(c)) || c == '.':
+			pos++
+			// Exponents may be signed.
+			if (c == 'e' || c == 'E') && pos < len(input) && (input[pos] == '+' || input[pos] == '-') &&
+				!strings.HasPrefix(strings.ToLower(input[:pos]), "0x") {
+				pos++
+			}
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isAlpha(r rune) bool {
+	return r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+func isAlphaNumeric(r rune) bool {
+	return isAlpha(r) || isDigit(r)
+}
@@ -0,0 +1,382 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+// keywords of PromQL. Grouping keywords are followed by a parenthesized list of
+// label names. As in Prometheus, keywords found where an operand is expected
+// are metric names, except inf and nan which are numbers.
+var (
+	groupingKeywords = map[string]bool{
+		"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+	}
+	keywords = map[string]bool{
+		"and": true, "or": true, "unless": true, "bool": true, "offset": true, "atan2": true,
+		"inf": true, "nan": true,
+	}
+	aggregators = map[string]bool{
+		"sum": true, "avg": true, "count": true, "min": true, "max": true, "group": true,
+		"stddev": true, "stdvar": true, "topk": true, "bottomk": true, "count_values": true,
+		"quantile": true, "limitk": true, "limit_ratio": true,
+	}
+	binaryKeywords = map[string]bool{"and": true, "or": true, "unless": true, "atan2": true}
+	comparisons    = map[string]bool{"==": true, "!=": true, ">": true, "<": true, ">=": true, "<=": true}
+)
+
+// matchTypes are the label matching operators, and their match types.
+var matchTypes = map[string]labels.MatchType{
+	"=":  labels.MatchEqual,
+	"!=": labels.MatchNotEqual,
+	"=~": labels.MatchRegexp,
+	"!~": labels.MatchNotRegexp,
+}
+
+// LabelMatcher is a label matcher of a selector, along with its byte range
+// in the input.
+type LabelMatcher struct {
+	*labels.Matcher
+
+	Pos, End int // Byte range in the input.
+}
+
+// Selector is a vector selector of an expression.
+type Selector struct {
+	// Name is the metric name preceding the matchers, empty if there is none.
+	Name     string
+	Matchers []LabelMatcher
+
+	Pos, End int // Byte range in the input.
+	// LeftBrace is the byte offset of the opening brace of the matchers, or
+	// -1 if the selector has none.
+	LeftBrace int
+}
+
+// LabelMatchers returns the matchers of the selector, preceded by an equality
+// matcher on the metric name if it has one.
+func (s Selector) LabelMatchers() []*labels.Matcher {
+	ms := make([]*labels.Matcher, 0, len(s.Matchers)+1)
+	if s.Name != "" {
+		ms = append(ms, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, s.Name))
+	}
+	for _, m := range s.Matchers {
+		ms = append(ms, m.Matcher)
+	}
+	return ms
+}
+
+// FindSelectors returns the vector selectors of the given expression, in the
+// order they appear. Matrix selectors and subqueries are returned as the
+// vector selectors they wrap. It fails on invalid regular expressions, and on
+// identifiers which are neither selectors, functions nor keywords where they
+// are, for no selector to be missed.
+func FindSelectors(input string) ([]Selector, error) {
+	items, err := significantItems(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sels []Selector
+		// operand is whether the items so far end an operand, which keywords
+		// follow as operators or modifiers. Elsewhere, they are metric names.
+		operand bool
+		// parens holds whether each open parenthesis holds the arguments of
+		// an aggregation, which a grouping may follow once closed.
+		parens      []bool
+		aggregation bool // Whether the next parenthesis opens one.
+		aggregated  bool // Whether the previous item closed one.
+	)
+	for i := 0; i < len(items); i++ {
+		it, prev, next := items[i], peek(items, i-1), peek(items, i+1)
+		closed := aggregated
+		aggregated = false
+		switch it.Typ {
+		case ItemIdentifier:
+			name := strings.ToLower(it.Val)
+			switch {
+			case operand && (binaryKeywords[name] || name == "offset"):
+				operand = false
+				continue
+			case operand && closed && isGrouping(it) && next.Typ == ItemLeftParen:
+				if i, err = skipLabels(items, i+1); err != nil {
+					return nil, err
+				}
+				continue
+			case operand:
+				return nil, fmt.Errorf("unexpected %s", it)
+			case name == "inf" || name == "nan":
+				if next.Typ == ItemLeftBrace {
+					return nil, fmt.Errorf("unexpected %s after number %s", next, it)
+				}
+				operand = true
+				continue
+			case name == "bool" && prev.Typ == ItemOperator && comparisons[prev.Val]:
+				continue
+			case (name == "on" || name == "ignoring") && next.Typ == ItemLeftParen && isBinaryOperator(prev):
+				if i, err = skipLabels(items, i+1); err != nil {
+					return nil, err
+				}
+				if after := peek(items, i+1); after.Typ == ItemIdentifier {
+					if name := strings.ToLower(after.Val); name == "group_left" || name == "group_right" {
+						i++
+						if peek(items, i+1).Typ == ItemLeftParen {
+							if i, err = skipLabels(items, i+1); err != nil {
+								return nil, err
+							}
+						}
+					}
+				}
+				continue
+			case aggregators[name] && isGrouping(next) && peek(items, i+2).Typ == ItemLeftParen:
+				if i, err = skipLabels(items, i+2); err != nil {
+					return nil, err
+				}
+				if peek(items, i+1).Typ != ItemLeftParen {
+					return nil, fmt.Errorf("unexpected %s after the grouping of %s", peek(items, i+1), it)
+				}
+				aggregation = true
+				continue
+			case next.Typ == ItemLeftParen:
+				// Function call or aggregation.
+				aggregation = aggregators[name]
+				continue
+			}
+
+			sel := Selector{Name: it.Val, Pos: it.Pos, End: it.End(), LeftBrace: -1}
+			if next.Typ == ItemLeftBrace {
+				if i, err = parseMatchers(items, i+1, &sel); err != nil {
+					return nil, err
+				}
+			}
+			sels = append(sels, sel)
+			operand = true
+
+		case ItemLeftBrace:
+			if operand {
+				return nil, fmt.Errorf("unexpected %s", it)
+			}
+			sel := Selector{Pos: it.Pos}
+			if i, err = parseMatchers(items, i, &sel); err != nil {
+				return nil, err
+			}
+			sels = append(sels, sel)
+			operand = true
+
+		case ItemLeftBracket:
+			// Range and subquery durations.
+			if i, err = skip(items, i, ItemLeftBracket, ItemRightBracket); err != nil {
+				return nil, err
+			}
+			operand = true
+
+		case ItemLeftParen:
+			parens = append(parens, aggregation)
+			aggregation, operand = false, false
+
+		case ItemRightParen:
+			if len(parens) == 0 {
+				return nil, fmt.Errorf("unexpected %s", it)
+			}
+			aggregated = parens[len(parens)-1]
+			parens = parens[:len(parens)-1]
+			operand = true
+
+		case ItemNumber, ItemString:
+			operand = true
+
+		default:
+			// Operators and commas.
+			operand = false
+		}
+	}
+	return sels, nil
+}
+
+// isGrouping returns whether the given item is the by or without keyword of
+// an aggregation.
+func isGrouping(it Item) bool {
+	name := strings.ToLower(it.Val)
+	return it.Typ == ItemIdentifier && (name == "by" || name == "without")
+}
+
+// isBinaryOperator returns whether the given item is a binary operator, or
+// the bool modifier following one.
+func isBinaryOperator(it Item) bool {
+	name := strings.ToLower(it.Val)
+	return it.Typ == ItemOperator || it.Typ == ItemIdentifier && (binaryKeywords[name] || name == "bool")
+}
+
+// skipLabels returns the index of the parenthesis closing the list of label
+// names opened at items[i].
+func skipLabels(items []Item, i int) (int, error) {
+	for i++; i < len(items); i++ {
+		switch it := items[i]; it.Typ {
+		case ItemRightParen:
+			return i, nil
+		case ItemIdentifier, ItemString, ItemComma:
+		default:
+			return 0, fmt.Errorf("unexpected %s in grouping, expected label name", it)
+		}
+	}
+	return 0, fmt.Errorf("unexpected end of input in grouping")
+}
+
+// parseMatchers parses the matchers of sel starting at the left brace at
+// items[i], and returns the index of the closing brace.
+func parseMatchers(items []Item, i int, sel *Selector) (int, error) {
+	sel.LeftBrace = items[i].Pos
+	for i++; i < len(items); i++ {
+		it := items[i]
+		switch it.Typ {
+		case ItemRightBrace:
+			sel.End = it.End()
+			return i, nil
+		case ItemComma:
+			continue
+		case ItemIdentifier:
+			op, val := peek(items, i+1), peek(items, i+2)
+			t, ok := matchTypes[op.Val]
+			if op.Typ != ItemOperator || !ok {
+				return 0, fmt.Errorf("unexpected %s in label matching, expected label matching operator", op)
+			}
+			if val.Typ != ItemString {
+				return 0, fmt.Errorf("unexpected %s in label matching, expected string", val)
+			}
+			v, err := unquote(val.Val)
+			if err != nil {
+				return 0, err
+			}
+			m, err := labels.NewMatcher(t, it.Val, v)
+			if err != nil {
+				return 0, err
+			}
+			sel.Matchers = append(sel.Matchers, LabelMatcher{Matcher: m, Pos: it.Pos, End: val.End()})
+			i += 2
+		default:
+			return 0, fmt.Errorf("unexpected %s in label matching, expected label name", it)
+		}
+	}
+	return 0, fmt.Errorf("unexpected end of input inside braces")
+}
+
+// skip returns the index of the item closing the group opened at items[i].
+func skip(items []Item, i int, open, close ItemType) (int, error) {
+	depth := 0
+	for ; i < len(items); i++ {
+		switch items[i].Typ {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unclosed %q at position %d", items[i-1].Val, items[i-1].Pos)
+}
+
+func peek(items []Item, i int) Item {
+	if i >= 0 && i < len(items) {
+		return items[i]
+	}
+	return Item{Typ: ItemEOF}
+}
+
+// unquote returns the value of a quoted PromQL string.
+func unquote(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' {
+		// Go only allows single characters in single quotes.
+		s = `"` + strings.Replace(strings.Replace(s[1:len(s)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// EnforceLabels rewrites the given expression so that every vector selector
+// has an equality matcher for each of the given labels. Matchers on these
+// labels already present in a selector are replaced.
+func EnforceLabels(input string, ls labels.Labels) (string, error) {
+	if len(ls) == 0 {
+		return input, nil
+	}
+	sels, err := FindSelectors(input)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(sels, func(i, j int) bool { return sels[i].Pos < sels[j].Pos })
+
+	var (
+		b    strings.Builder
+		last int
+	)
+	for _, sel := range sels {
+		if sel.LeftBrace < 0 {
+			b.WriteString(input[last:sel.End])
+			b.WriteString(EnforcedMatchers(nil, ls))
+		} else {
+			b.WriteString(input[last:sel.LeftBrace])
+			kept := make([]string, 0, len(sel.Matchers))
+			for _, m := range sel.Matchers {
+				if !ls.Has(m.Name) {
+					kept = append(kept, input[m.Pos:m.End])
+				}
+			}
+			b.WriteString(EnforcedMatchers(kept, ls))
+		}
+		last = sel.End
+	}
+	b.WriteString(input[last:])
+	return b.String(), nil
+}
+
+// RemoveMatchers rewrites the given expression without the label matchers
+// for which drop returns true. Selectors which would be left with neither a
+// metric name nor matchers are kept as they are.
+func RemoveMatchers(input string, drop func(*labels.Matcher) bool) (string, error) {
+	sels, err := FindSelectors(input)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(sels, func(i, j int) bool { return sels[i].Pos < sels[j].Pos })
+
+	var (
+		b    strings.Builder
+		last int
+	)
+	for _, sel := range sels {
+		if sel.LeftBrace < 0 {
+			continue
+		}
+		kept := make([]string, 0, len(sel.Matchers))
+		for _, m := range sel.Matchers {
+			if !drop(m.Matcher) {
+				kept = append(kept, input[m.Pos:m.End])
+			}
+		}
+		if len(kept) == len(sel.Matchers) || (len(kept) == 0 && sel.Name == "") {
+			continue
+		}
+		b.WriteString(input[last:sel.LeftBrace])
+		if len(kept) > 0 {
+			b.WriteString("{" + strings.Join(kept, ",") + "}")
+		}
+		last = sel.End
+	}
+	b.WriteString(input[last:])
+	return b.String(), nil
+}
+
+// EnforcedMatchers returns the braced matchers of a selector made of the
+// given matchers and equality matchers for the given labels.
+func EnforcedMatchers(matchers []string, ls labels.Labels) string {
+	for _, l := range ls {
+		matchers = append(matchers, l.Name+"="+strconv.Quote(l.Value))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func TestFindSelectors(t *testing.T) {
+	sels, err := FindSelectors(`sum by (job) (rate(http_requests_total{job=~"api|web",code!="200"}[5m])) / on(job) up`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sels) != 2 {
+		t.Fatalf("expected 2 selectors, got %v", sels)
+	}
+	expected := `http_requests_total{job=~"api|web",code!="200"}`
+	if got := labels.FormatSelector(sels[0].LabelMatchers()); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	m := sels[0].Matchers[0]
+	if !m.Matches("web") || m.Matches("webs") {
+		t.Errorf("expected %s to be anchored", m)
+	}
+	if got := labels.FormatSelector(sels[1].LabelMatchers()); got != "up" {
+		t.Errorf("expected up, got %s", got)
+	}
+}
+
+func TestFindSelectorsInvalidRegexp(t *testing.T) {
+	if _, err := FindSelectors(`up{job=~"("}`); err == nil {
+		t.Fatal("expected an invalid regular expression to fail")
+	}
+}
+
+func TestRemoveMatchers(t *testing.T) {
+	got, err := RemoveMatchers(`up{env="prod",job="node"} + up{env=~"p.*"}`, func(m *labels.Matcher) bool {
+		return m.Name == "env" && m.Matches("prod")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `up{job="node"} + up`; got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestEnforceLabels(t *testing.T) {
+	ls := labels.FromStrings("namespace", "a")
+	for _, tc := range []struct {
+		input, expected string
+	}{
+		// Keywords where an operand is expected are metric names.
+		{`by`, `by{namespace="a"}`},
+		{`offset{}`, `offset{namespace="a"}`},
+		{`sum(and)`, `sum(and{namespace="a"})`},
+		{`bool`, `bool{namespace="a"}`},
+		{`on`, `on{namespace="a"}`},
+		{`group_left + atan2`, `group_left{namespace="a"} + atan2{namespace="a"}`},
+		{`atan2 atan2 atan2`, `atan2{namespace="a"} atan2 atan2{namespace="a"}`},
+		{`offset offset 5m`, `offset{namespace="a"} offset 5m`},
+		{`sum`, `sum{namespace="a"}`},
+		// Aggregations.
+		{`sum by (job) (up)`, `sum by (job) (up{namespace="a"})`},
+		{`sum(up) without (instance)`, `sum(up{namespace="a"}) without (instance)`},
+		{`sum by (by, offset) (by)`, `sum by (by, offset) (by{namespace="a"})`},
+		{`topk(5, up) by (job)`, `topk(5, up{namespace="a"}) by (job)`},
+		{`count_values("v", up)`, `count_values("v", up{namespace="a"})`},
+		// Binary operators and their modifiers.
+		{`a > bool b`, `a{namespace="a"} > bool b{namespace="a"}`},
+		{`a * on(job) group_left(instance) b`, `a{namespace="a"} * on(job) group_left(instance) b{namespace="a"}`},
+		{`a and ignoring(x) b or c unless on() group_right d`, `a{namespace="a"} and ignoring(x) b{namespace="a"} or c{namespace="a"} unless on() group_right d{namespace="a"}`},
+		{`up > inf or -Inf < NaN`, `up{namespace="a"} > inf or -Inf < NaN`},
+		// Offsets, @ modifiers and subqueries.
+		{`up offset 5m`, `up{namespace="a"} offset 5m`},
+		{`up @ 100 offset -5m`, `up{namespace="a"} @ 100 offset -5m`},
+		{`rate(up[5m] offset 1h)`, `rate(up{namespace="a"}[5m] offset 1h)`},
+		{`max_over_time(rate(up[5m])[1h:5m] @ start())`, `max_over_time(rate(up{namespace="a"}[5m])[1h:5m] @ start())`},
+		// Selectors without metric name, or matching the enforced labels.
+		{`{__name__="x"}`, `{__name__="x",namespace="a"}`},
+		{`up{namespace="b"}`, `up{namespace="a"}`},
+		{`up{namespace!="a",job="node"}`, `up{job="node",namespace="a"}`},
+		{`up{namespace=~".+"} / {namespace!~"a"}`, `up{namespace="a"} / {namespace="a"}`},
+	} {
+		got, err := EnforceLabels(tc.input, ls)
+		if err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.input, tc.expected, got)
+		}
+	}
+}
+
+func TestEnforceLabelsInvalid(t *testing.T) {
+	ls := labels.FromStrings("namespace", "a")
+	for _, input := range []string{
+		`up up`,
+		`inf{}`,
+		`sum(up) by`,
+		`sum by (rate(up)) (up)`,
+		`up{} {job="node"}`,
+		`up)`,
+	} {
+		if got, err := EnforceLabels(input, ls); err == nil {
+			t.Errorf("%s: expected an error, got %s", input, got)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Timing describes the constructs of an expression which select data at other
+// times than the evaluation time. The backends evaluate whole expressions at
+// the steps of the query, so the engine doesn't compute the data they select
+// nor align it: it only keeps the steps they leave empty as such, and resolves
+// @ start() and @ end() in the sub-queries of split queries. The data range
+// is reported for tracing.
+type Timing struct {
+	// At is set if the expression has @ modifiers, AtStartEnd if some of
+	// them are @ start() or @ end(), which depend on the range of the query.
+	At         bool
+	AtStartEnd bool
+	Offset     bool
+	Subquery   bool
+	// MaxLookback is the longest time before the evaluation time the
+	// expression selects data from, through ranges, subqueries and offsets,
+	// excluding the lookback delta. @ modifiers aren't accounted for.
+	MaxLookback time.Duration
+}
+
+// Shifted returns whether the expression has @ modifiers, offsets or
+// subqueries.
+func (t Timing) Shifted() bool {
+	return t.At || t.Offset || t.Subquery
+}
+
+// AnalyzeTiming returns the Timing of the given expression.
+func AnalyzeTiming(input string) (Timing, error) {
+	items, err := significantItems(input)
+	if err != nil {
+		return Timing{}, err
+	}
+	var t Timing
+	lookback, i, err := t.analyze(items, 0)
+	if err != nil {
+		return Timing{}, err
+	}
+	if i < len(items) {
+		return Timing{}, fmt.Errorf("unexpected %s", items[i])
+	}
+	t.MaxLookback = lookback
+	return t, nil
+}
+
+// analyze walks the operands of the expression starting at items[i] up to
+// the closing parenthesis of its level, and returns their longest lookback
+// along with the index of that parenthesis.
+func (t *Timing) analyze(items []Item, i int) (time.Duration, int, error) {
+	var max time.Duration
+	for i < len(items) {
+		var (
+			lookback time.Duration
+			err      error
+		)
+		it := items[i]
+		switch {
+		case it.Typ == ItemRightParen:
+			return max, i, nil
+
+		case it.Typ == ItemLeftParen:
+			if lookback, i, err = t.analyze(items, i+1); err != nil {
+				return 0, 0, err
+			}
+			if i >= len(items) {
+				return 0, 0, fmt.Errorf("unclosed %q at position %d", it.Val, it.Pos)
+			}
+			i++
+
+		case it.Typ == ItemIdentifier:
+			name := strings.ToLower(it.Val)
+			next := peek(items, i+1)
+			switch {
+			case groupingKeywords[name]:
+				i++
+				if next.Typ == ItemLeftParen {
+					if i, err = skip(items, i, ItemLeftParen, ItemRightParen); err != nil {
+						return 0, 0, err
+					}
+					i++
+				}
+				continue
+			case keywords[name] || next.Typ == ItemLeftParen:
+				// Operators and function names, the arguments of functions
+				// are walked as a parenthesized group.
+				i++
+				continue
+			case aggregators[name] && next.Typ == ItemIdentifier && groupingKeywords[strings.ToLower(next.Val)]:
+				i++
+				continue
+			}
+			// A selector.
+			i++
+			if next.Typ == ItemLeftBrace {
+				if i, err = skip(items, i, ItemLeftBrace, ItemRightBrace); err != nil {
+					return 0, 0, err
+				}
+				i++
+			}
+
+		case it.Typ == ItemLeftBrace:
+			if i, err = skip(items, i, ItemLeftBrace, ItemRightBrace); err != nil {
+				return 0, 0, err
+			}
+			i++
+
+		default:
+			// Numbers, strings and operators.
+			i++
+			continue
+		}
+
+		if lookback, i, err = t.analyzeModifiers(items, i, lookback); err != nil {
+			return 0, 0, err
+		}
+		if lookback > max {
+			max = lookback
+		}
+	}
+	return max, i, nil
+}
+
+// analyzeModifiers walks the ranges, subqueries, offsets and @ modifiers
+// following an operand at items[i], and returns the lookback of the operand
+// with them along with the index of the next item.
+func (t *Timing) analyzeModifiers(items []Item, i int, lookback time.Duration) (time.Duration, int, error) {
+	for i < len(items) {
+		switch it := items[i]; {
+		case it.Typ == ItemLeftBracket:
+			end, err := skip(items, i, ItemLeftBracket, ItemRightBracket)
+			if err != nil {
+				return 0, 0, err
+			}
+			var rng string
+			for _, it := range items[i+1 : end] {
+				if it.Typ == ItemOperator && it.Val == ":" {
+					t.Subquery = true
+					break
+				}
+				rng += it.Val
+			}
+			d, err := parseDuration(rng)
+			if err != nil {
+				return 0, 0, err
+			}
+			lookback += d
+			i = end + 1
+
+		case it.Typ == ItemIdentifier && strings.ToLower(it.Val) == "offset":
+			t.Offset = true
+			i++
+			sign := time.Duration(1)
+			if op := peek(items, i); op.Typ == ItemOperator && (op.Val == "-" || op.Val == "+") {
+				if op.Val == "-" {
+					sign = -1
+				}
+				i++
+			}
+			num := peek(items, i)
+			if num.Typ != ItemNumber {
+				return 0, 0, fmt.Errorf("unexpected %s in offset, expected duration", num)
+			}
+			d, err := parseDuration(num.Val)
+			if err != nil {
+				return 0, 0, err
+			}
+			if d *= sign; d > 0 {
+				lookback += d
+			}
+			i++
+
+		case it.Typ == ItemOperator && it.Val == "@":
+			t.At = true
+			i++
+			switch at := peek(items, i); {
+			case at.Typ == ItemIdentifier && (at.Val == "start" || at.Val == "end"):
+				t.AtStartEnd = true
+				if peek(items, i+1).Typ != ItemLeftParen || peek(items, i+2).Typ != ItemRightParen {
+					return 0, 0, fmt.Errorf("unexpected %s in @ modifier, expected \"()\"", peek(items, i+1))
+				}
+				i += 3
+			case at.Typ == ItemOperator && (at.Val == "-" || at.Val == "+") && peek(items, i+1).Typ == ItemNumber:
+				i += 2
+			case at.Typ == ItemNumber:
+				i++
+			default:
+				return 0, 0, fmt.Errorf("unexpected %s in @ modifier, expected timestamp", at)
+			}
+
+		default:
+			return lookback, i, nil
+		}
+	}
+	return lookback, i, nil
+}
+
+// ResolveAtStartEnd rewrites the @ start() and @ end() modifiers of the given
+// expression into the given start and end timestamps, in seconds, so that the
+// expression can be evaluated over parts of the range of the query.
+func ResolveAtStartEnd(input string, start, end int64) (string, error) {
+	items, err := significantItems(input)
+	if err != nil {
+		return "", err
+	}
+	var (
+		b    strings.Builder
+		last int
+	)
+	for i, it := range items {
+		if it.Typ != ItemOperator || it.Val != "@" {
+			continue
+		}
+		fn, lp, rp := peek(items, i+1), peek(items, i+2), peek(items, i+3)
+		if fn.Typ != ItemIdentifier || lp.Typ != ItemLeftParen || rp.Typ != ItemRightParen {
+			continue
+		}
+		ts := start
+		switch fn.Val {
+		case "start":
+		case "end":
+			ts = end
+		default:
+			continue
+		}
+		b.WriteString(input[last:fn.Pos])
+		b.WriteString(strconv.FormatInt(ts, 10))
+		last = rp.End()
+	}
+	b.WriteString(input[last:])
+	return b.String(), nil
+}
+
+// significantItems returns the items of the input, without spaces and
+// comments.
+func significantItems(input string) ([]Item, error) {
+	all, err := Lex(input)
+	if err != nil {
+		return nil, err
+	}
+	items := all[:0:0]
+	for _, it := range all {
+		if it.Typ != ItemSpace && it.Typ != ItemComment {
+			items = append(items, it)
+		}
+	}
+	return items, nil
+}
+
+// parseDuration parses a PromQL duration, either with units or as a number
+// of seconds.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnalyzeTiming(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected Timing
+	}{
+		{`up`, Timing{}},
+		{`rate(http_requests_total[5m])`, Timing{MaxLookback: 5 * time.Minute}},
+		{`up offset 10m`, Timing{Offset: true, MaxLookback: 10 * time.Minute}},
+		{`up offset -10m`, Timing{Offset: true}},
+		{
+			`max_over_time(rate(x[5m])[1h:1m] offset 10m) / sum(rate(y[30m]))`,
+			Timing{Offset: true, Subquery: true, MaxLookback: time.Hour + 15*time.Minute},
+		},
+		{`up @ 1609746000`, Timing{At: true}},
+		{`rate(x[5m] @ end())`, Timing{At: true, AtStartEnd: true, MaxLookback: 5 * time.Minute}},
+	} {
+		got, err := AnalyzeTiming(tc.input)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.input, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.input, tc.expected, got)
+		}
+	}
+}
+
+func TestResolveAtStartEnd(t *testing.T) {
+	got, err := ResolveAtStartEnd(`rate(x[5m] @ start()) - rate(x[5m] @ end())`, 100, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `rate(x[5m] @ 100) - rate(x[5m] @ 200)`; got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,189 @@
+package promql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+// ActiveQueryTracker records the queries being executed into a file, so that
+// the queries in flight when the process crashed are logged on restart.
+// The file holds one fixed-size line per slot, blank for free slots.
+type ActiveQueryTracker struct {
+	file   *os.File
+	logger log.Logger
+	slots  chan int
+}
+
+type activeQuery struct {
+	Query     string `json:"query"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	Step      int64  `json:"step"`
+	Tenant    string `json:"tenant,omitempty"`
+	Timestamp int64  `json:"timestamp_sec"`
+}
+
+const entrySize int = 1000
+
+// NewActiveQueryTracker returns a tracker of at most maxConcurrent queries
+// recorded in the queries.active file of the given directory. Queries left in
+// the file by a previous run are logged.
+func NewActiveQueryTracker(dir string, maxConcurrent int, logger log.Logger) (*ActiveQueryTracker, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(dir, "queries.active")
+	logUnfinishedQueries(filename, logger)
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error creating active query log: %v", err)
+	}
+	if err := file.Truncate(int64(maxConcurrent * entrySize)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error sizing active query log: %v", err)
+	}
+	tracker := &ActiveQueryTracker{
+		file:   file,
+		logger: logger,
+		slots:  make(chan int, maxConcurrent),
+	}
+	for i := 0; i < maxConcurrent; i++ {
+		tracker.slots <- i
+		tracker.write(i, nil)
+	}
+	return tracker, nil
+}
+
+func logUnfinishedQueries(filename string, logger log.Logger) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Error(logger).Log("msg", "Failed to read active query log", "file", filename, "err", err)
+		}
+		return
+	}
+	var queries []string
+	for _, line := range bytes.Split(content, []byte{'\n'}) {
+		line = bytes.Trim(line, " \x00")
+		if len(line) == 0 {
+			continue
+		}
+		queries = append(queries, string(line))
+	}
+	if len(queries) > 0 {
+		level.Info(logger).Log("msg", "These queries didn't finish in prom-query's last run", "queries", strings.Join(queries, ", "))
+	}
+}
+
+// Insert records the query of the given params as active, and returns the
+// slot to pass to Delete when it finished. If all slots are taken the query
+// isn't recorded and the returned slot is negative.
+func (t *ActiveQueryTracker) Insert(ctx context.Context, params *remote.SelectParams) int {
+	var i int
+	select {
+	case i = <-t.slots:
+	default:
+		level.Warn(t.logger).Log("msg", "Active query log is full, query not recorded", "query", params.Query)
+		return -1
+	}
+	entry, _ := json.Marshal(activeQuery{
+		Query:     params.Query,
+		Start:     params.Start,
+		End:       params.End,
+		Step:      params.Step,
+		Tenant:    tenant.FromContext(ctx),
+		Timestamp: time.Now().Unix(),
+	})
+	if len(entry) >= entrySize {
+		// Too long queries are truncated, which makes the entry invalid JSON
+		// but keeps it identifiable.
+		entry = entry[:entrySize-1]
+	}
+	t.write(i, entry)
+	return i
+}
+
+// Delete removes the query recorded in the given slot.
+func (t *ActiveQueryTracker) Delete(i int) {
+	if i < 0 {
+		return
+	}
+	t.write(i, nil)
+	t.slots <- i
+}
+
+// Close closes the active query log file.
+func (t *ActiveQueryTracker) Close() error {
+	return t.file.Close()
+}
+
+// write replaces the content of a slot by the given entry, padded with spaces.
+func (t *ActiveQueryTracker) write(i int, entry []byte) {
+	buf := bytes.Repeat([]byte{' '}, entrySize)
+	copy(buf, entry)
+	buf[entrySize-1] = '\n'
+	if _, err := t.file.WriteAt(buf, int64(i*entrySize)); err != nil {
+		level.Error(t.logger).Log("msg", "Failed to write active query log", "err", err)
+	}
+}
+
+// logQuery logs the execution of a query, at warn level if it was slower
+// than the engine's slow query threshold.
+func (ng *Engine) logQuery(ctx context.Context, params *remote.SelectParams, duration time.Duration, stats *remote.Stats, err error) {
+	outcomes := stats.Outcomes()
+	backends := make([]string, 0, len(outcomes))
+	for _, o := range outcomes {
+		outcome := "success"
+		switch {
+		case o.Err != nil:
+			outcome = o.Err.Error()
+		case o.Canceled:
+			outcome = "canceled"
+		}
+		backends = append(backends, fmt.Sprintf("%s %s %s %dB/%dB: %s", o.Backend, o.Path, o.Duration, o.ResponseBytes, o.DecodedBytes, outcome))
+	}
+	logger := log.With(ng.logger,
+		"query", params.Query,
+		"start", params.Start,
+		"end", params.End,
+		"step", params.Step,
+		"tenant", tenant.FromContext(ctx),
+		"duration", duration,
+		"backends", strings.Join(backends, "; "),
+	)
+	if n := len(stats.Coverage()); n > 0 {
+		logger = log.With(logger, "gap_filled_series", n)
+	}
+	if warnings := stats.Warnings(); len(warnings) > 0 {
+		logger = log.With(logger, "warnings", strings.Join(warnings, "; "))
+	}
+	if err != nil {
+		logger = log.With(logger, "err", err)
+	}
+
+	switch {
+	case ng.slowQueryThreshold > 0 && duration >= ng.slowQueryThreshold:
+		level.Warn(logger).Log("msg", "Slow query")
+	case err != nil:
+		level.Info(logger).Log("msg", "Query failed")
+	default:
+		level.Debug(logger).Log("msg", "Query executed")
+	}
+}
@@ -4,26 +4,54 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/google/go-querystring/query"
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context/ctxhttp"
 
+	"github.com/lwangrabbit/prom-query/pkg/labels"
 	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/promql/parser"
 )
 
 const maxErrMsgLen = 256
 
+const tracerName = "github.com/lwangrabbit/prom-query/remote"
+
 // Client allows reading and writing from/to a remote HTTP endpoint.
 type Client struct {
+	// Bytes of the responses as received and once decompressed, updated
+	// atomically.
+	responseBytes int64
+	decodedBytes  int64
+
 	index   int // Used to differentiate clients in metrics.
 	url     *config_util.URL
 	client  *http.Client
 	timeout time.Duration
+	logger  log.Logger
+	tracer  trace.TracerProvider
+
+	acceptEncoding string
+	externalLabels labels.Labels
+	interner       *labels.Interner // Nil if labels aren't interned.
+	latencies      *latencies       // Of the requests which didn't fail.
+	typeCache      *metricTypeCache
 }
 
 // ClientConfig configures a Client.
@@ -31,20 +59,55 @@ type ClientConfig struct {
 	URL              *config_util.URL
 	Timeout          model.Duration
 	HTTPClientConfig config_util.HTTPClientConfig
+	Logger           log.Logger
+	// TracerProvider traces the requests to the endpoint. If nil, the
+	// provider of the span in the request context is used.
+	TracerProvider trace.TracerProvider
+	// ExternalLabels are added to the series returned by the endpoint which
+	// don't have them already.
+	ExternalLabels labels.Labels
+	// Transport tunes the connections to the endpoint and the compression
+	// of its responses.
+	Transport TransportConfig
+	// Interner interns the labels of the series returned by the endpoint, if
+	// set. It is meant to be shared by the clients of the replicas.
+	Interner *labels.Interner
 }
 
 // NewClient creates a new Client.
 func NewClient(index int, conf *ClientConfig) (*Client, error) {
-	httpClient, err := config_util.NewClientFromConfig(conf.HTTPClientConfig, "read")
+	acceptEncoding, err := conf.Transport.acceptEncoding()
 	if err != nil {
 		return nil, err
 	}
+	rt, err := newRoundTripper(conf.HTTPClientConfig, &conf.Transport)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: rt}
+	if !conf.HTTPClientConfig.FollowRedirects {
+		httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
 
+	logger := conf.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
 	return &Client{
 		index:   index,
 		url:     conf.URL,
 		client:  httpClient,
 		timeout: time.Duration(conf.Timeout),
+		logger:  log.With(logger, "backend", conf.URL),
+		tracer:  conf.TracerProvider,
+
+		acceptEncoding: acceptEncoding,
+		externalLabels: conf.ExternalLabels,
+		interner:       conf.Interner,
+		latencies:      &latencies{},
+		typeCache:      &metricTypeCache{},
 	}, nil
 }
 
@@ -53,17 +116,25 @@ type recoverableError struct {
 }
 
 // Name identifies the client.
-func (c Client) Name() string {
+func (c *Client) Name() string {
 	return fmt.Sprintf("%d:%s", c.index, c.url)
 }
 
-func (c *Client) instantQueryUrl(qs string, ts int64) (string, error) {
+// ResponseBytes returns the total size of the responses of the endpoint, as
+// received and once decompressed.
+func (c *Client) ResponseBytes() (received, decoded int64) {
+	return atomic.LoadInt64(&c.responseBytes), atomic.LoadInt64(&c.decodedBytes)
+}
+
+func (c *Client) instantQueryUrl(qs string, ts, lookbackDelta int64) (string, error) {
 	p := struct {
-		Query string `url:"query"`
-		Time  int64  `url:"time"`
+		Query         string `url:"query"`
+		Time          int64  `url:"time"`
+		LookbackDelta int64  `url:"lookback_delta,omitempty"`
 	}{
-		Query: qs,
-		Time:  ts,
+		Query:         qs,
+		Time:          ts,
+		LookbackDelta: lookbackDelta,
 	}
 	v, err := query.Values(p)
 	if err != nil {
@@ -72,17 +143,19 @@ func (c *Client) instantQueryUrl(qs string, ts int64) (string, error) {
 	return fmt.Sprintf("%v/api/v1/query?%v", c.url.String(), v.Encode()), nil
 }
 
-func (c *Client) rangeQueryUrl(qs string, startTs, endTs int64, step int) (string, error) {
+func (c *Client) rangeQueryUrl(qs string, startTs, endTs int64, step int, lookbackDelta int64) (string, error) {
 	p := struct {
-		Query string `url:"query"`
-		Start int64  `url:"start"`
-		End   int64  `url:"end"`
-		Step  int    `url:"step"`
+		Query         string `url:"query"`
+		Start         int64  `url:"start"`
+		End           int64  `url:"end"`
+		Step          int    `url:"step"`
+		LookbackDelta int64  `url:"lookback_delta,omitempty"`
 	}{
-		Query: qs,
-		Start: startTs,
-		End:   endTs,
-		Step:  step,
+		Query:         qs,
+		Start:         startTs,
+		End:           endTs,
+		Step:          step,
+		LookbackDelta: lookbackDelta,
 	}
 	v, err := query.Values(p)
 	if err != nil {
@@ -93,37 +166,33 @@ func (c *Client) rangeQueryUrl(qs string, startTs, endTs int64, step int) (strin
 
 // QueryInstant execute instant query to a remote endpoint.
 func (c *Client) QueryInstant(ctx context.Context, qs string, ts int64) (*InstantQueryResult, error) {
-	url, err := c.instantQueryUrl(qs, ts)
-	if err != nil {
-		return nil, err
-	}
-	httpReq, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create request: %v", err)
-	}
-	httpReq.Header.Set("X-Prometheus-Instant-Query-Version", "0.1.0")
-
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
+	return c.queryInstant(ctx, qs, ts, 0)
+}
 
-	httpResp, err := ctxhttp.Do(ctx, c.client, httpReq)
+// queryInstant executes an instant query with the given lookback delta, in
+// seconds, or the one of the endpoint if 0.
+func (c *Client) queryInstant(ctx context.Context, qs string, ts, lookbackDelta int64) (*InstantQueryResult, error) {
+	qs, stripped, err := c.stripExternalMatchers(qs)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
-	}
-	defer httpResp.Body.Close()
-	if httpResp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+		return nil, err
 	}
-
-	raw, err := ioutil.ReadAll(httpResp.Body)
+	url, err := c.instantQueryUrl(qs, ts, lookbackDelta)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+		return nil, err
 	}
-
 	var rsp InstantQueryResult
-	err = json.Unmarshal(raw, &rsp)
-	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal response body: %v", err)
+	if err := c.get(ctx, url, "/api/v1/query", &rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Data != nil && rsp.Data.Result != nil {
+		res := (*rsp.Data.Result)[:0]
+		for _, s := range *rsp.Data.Result {
+			s.Metric = c.seriesLabels(s.Metric)
+			if matchesStripped(s.Metric, stripped) {
+				res = append(res, s)
+			}
+		}
+		*rsp.Data.Result = res
 	}
 	return &rsp, nil
 }
@@ -139,46 +208,356 @@ type InstantQueryData struct {
 
 // QueryRange execute range query to a remote endpoint.
 func (c *Client) QueryRange(ctx context.Context, qs string, startTs, endTs int64, step int) (*RangeQueryResult, error) {
-	url, err := c.rangeQueryUrl(qs, startTs, endTs, step)
+	return c.queryRange(ctx, qs, startTs, endTs, step, 0)
+}
+
+// queryRange executes a range query with the given lookback delta, in
+// seconds, or the one of the endpoint if 0.
+func (c *Client) queryRange(ctx context.Context, qs string, startTs, endTs int64, step int, lookbackDelta int64) (*RangeQueryResult, error) {
+	qs, stripped, err := c.stripExternalMatchers(qs)
+	if err != nil {
+		return nil, err
+	}
+	url, err := c.rangeQueryUrl(qs, startTs, endTs, step, lookbackDelta)
+	if err != nil {
+		return nil, err
+	}
+	var rsp RangeQueryResult
+	if err := c.get(ctx, url, "/api/v1/query_range", &rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Data != nil && rsp.Data.Result != nil {
+		res := (*rsp.Data.Result)[:0]
+		for _, s := range *rsp.Data.Result {
+			s.Metric = c.seriesLabels(s.Metric)
+			if matchesStripped(s.Metric, stripped) {
+				res = append(res, s)
+			}
+		}
+		*rsp.Data.Result = res
+	}
+	return &rsp, nil
+}
+
+type RangeQueryResult struct {
+	Data   *RangeQueryData `json:"data"`
+	Status string          `json:"status"`
+}
+type RangeQueryData struct {
+	ResultType value.ValueType `json:"resultType"`
+	Result     *value.Matrix   `json:"result"`
+}
+
+func (c *Client) labelValuesUrl(name string, selectors []string) string {
+	v := url.Values{}
+	for _, s := range selectors {
+		v.Add("match[]", s)
+	}
+	u := fmt.Sprintf("%v/api/v1/label/%v/values", c.url.String(), url.PathEscape(name))
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	return u
+}
+
+// LabelValues returns the values of a label from a remote endpoint, among the
+// series matching any of the given selectors if there are some.
+func (c *Client) LabelValues(ctx context.Context, name string, selectors []string) ([]string, error) {
+	stripped := make([]string, 0, len(selectors))
+	for _, s := range selectors {
+		s, _, err := c.stripExternalMatchers(s)
+		if err != nil {
+			return nil, err
+		}
+		stripped = append(stripped, s)
+	}
+	values, err := c.labelValues(ctx, name, stripped)
+	if err != nil {
+		return nil, err
+	}
+	// The value of an external label is that of the series lacking the
+	// label, so it is only added if some series match.
+	if v := c.externalLabels.Get(name); v != "" {
+		matched := len(values) > 0
+		if !matched {
+			names, err := c.labelValues(ctx, labels.MetricName, stripped)
+			if err != nil {
+				return nil, err
+			}
+			matched = len(names) > 0
+		}
+		if matched {
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return uniqueStrings(values), nil
+}
+
+// labelValues returns the values of a label from the remote endpoint, among
+// the series matching any of the given selectors if there are some.
+func (c *Client) labelValues(ctx context.Context, name string, selectors []string) ([]string, error) {
+	var rsp LabelValuesResult
+	if err := c.get(ctx, c.labelValuesUrl(name, selectors), "/api/v1/label/values", &rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Status != "success" {
+		return nil, fmt.Errorf("server returned status %s", rsp.Status)
+	}
+	return rsp.Data, nil
+}
+
+// stripExternalMatchers removes from the given query the matchers on external
+// labels which the external labels satisfy, as the series of the endpoint
+// may not carry them. It also returns these matchers for each selector of the
+// query, nil if there are none.
+func (c *Client) stripExternalMatchers(qs string) (string, [][]*labels.Matcher, error) {
+	if len(c.externalLabels) == 0 {
+		return qs, nil, nil
+	}
+	satisfied := func(m *labels.Matcher) bool {
+		return c.externalLabels.Has(m.Name) && m.Matches(c.externalLabels.Get(m.Name))
+	}
+	sels, err := parser.FindSelectors(qs)
 	if err != nil {
+		return "", nil, err
+	}
+	var stripped [][]*labels.Matcher
+	for i, sel := range sels {
+		for _, m := range sel.Matchers {
+			if satisfied(m.Matcher) {
+				if stripped == nil {
+					stripped = make([][]*labels.Matcher, len(sels))
+				}
+				stripped[i] = append(stripped[i], m.Matcher)
+			}
+		}
+	}
+	if stripped == nil {
+		return qs, nil, nil
+	}
+	qs, err = parser.RemoveMatchers(qs, satisfied)
+	return qs, stripped, err
+}
+
+// matchesStripped returns whether a series returned by the endpoint, with its
+// external labels, matches all the stripped matchers of any selector. The
+// series carrying external labels of their own may not.
+func matchesStripped(ls labels.Labels, stripped [][]*labels.Matcher) bool {
+	if stripped == nil {
+		return true
+	}
+	for _, ms := range stripped {
+		if labels.MatchLabels(ls, ms...) {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesLabels returns the labels of a series returned by the endpoint, with
+// the external labels they don't have, interned.
+func (c *Client) seriesLabels(ls labels.Labels) labels.Labels {
+	if len(c.externalLabels) > 0 {
+		ls = c.addExternalLabels(ls)
+	}
+	if c.interner != nil {
+		ls = c.interner.InternLabels(ls)
+	}
+	return ls
+}
+
+// addExternalLabels returns the given labels with the external labels they
+// don't have.
+func (c *Client) addExternalLabels(ls labels.Labels) labels.Labels {
+	b := labels.NewBuilder(ls)
+	for _, l := range c.externalLabels {
+		if !ls.Has(l.Name) {
+			b.Set(l.Name, l.Value)
+		}
+	}
+	return b.Labels()
+}
+
+// uniqueStrings removes the duplicates of a sorted slice.
+func uniqueStrings(ss []string) []string {
+	res := ss[:0]
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+type LabelValuesResult struct {
+	Data   []string `json:"data"`
+	Status string   `json:"status"`
+}
+
+type MetadataResult struct {
+	Data   map[string][]Metadata `json:"data"`
+	Status string                `json:"status"`
+}
+
+// Metadata is the metadata of a metric.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// MetricTypes returns the types of the metrics in the metadata of the remote
+// endpoint, such as "counter" or "gauge", by metric name.
+func (c *Client) MetricTypes(ctx context.Context) (map[string]string, error) {
+	u := fmt.Sprintf("%v/api/v1/metadata?%v", c.url.String(), url.Values{"limit_per_metric": {"1"}}.Encode())
+	var rsp MetadataResult
+	if err := c.get(ctx, u, "/api/v1/metadata", &rsp); err != nil {
 		return nil, err
 	}
+	if rsp.Status != "success" {
+		return nil, fmt.Errorf("server returned status %s", rsp.Status)
+	}
+	types := make(map[string]string, len(rsp.Data))
+	for name, md := range rsp.Data {
+		if len(md) > 0 {
+			types[name] = md[0].Type
+		}
+	}
+	return types, nil
+}
+
+const (
+	// metricTypesTTL is how long the metric types of an endpoint are cached.
+	metricTypesTTL = 10 * time.Minute
+	// metricTypesFailureTTL is how long an endpoint whose metric types
+	// couldn't be fetched isn't asked for them again.
+	metricTypesFailureTTL = 30 * time.Second
+)
+
+// metricTypeCache caches the metric types of an endpoint.
+type metricTypeCache struct {
+	mtx     sync.Mutex
+	types   map[string]string // Nil if they couldn't be fetched.
+	expires time.Time
+}
+
+// metricTypes returns the types of the metrics of the endpoint, cached, or
+// nil if they can't be fetched. Concurrent callers wait for the same request,
+// which isn't recorded into the Stats of ctx, not being part of the query.
+func (c *Client) metricTypes(ctx context.Context) map[string]string {
+	c.typeCache.mtx.Lock()
+	defer c.typeCache.mtx.Unlock()
+	if time.Now().Before(c.typeCache.expires) {
+		return c.typeCache.types
+	}
+
+	types, err := c.MetricTypes(NewContextWithStats(ctx, nil))
+	ttl := metricTypesTTL
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to get metric types", "err", err)
+		ttl = metricTypesFailureTTL
+	}
+	c.typeCache.types, c.typeCache.expires = types, time.Now().Add(ttl)
+	return types
+}
+
+// get sends a GET request to the given url and unmarshals the JSON response
+// into rsp. The outcome is logged and recorded into the Stats of ctx, under
+// the given API path.
+func (c *Client) get(ctx context.Context, url, path string, rsp interface{}) (err error) {
+	tp := c.tracer
+	if tp == nil {
+		tp = trace.SpanFromContext(ctx).TracerProvider()
+	}
+	tracer := tp.Tracer(tracerName)
+	ctx, span := tracer.Start(ctx, "remote.Client.get", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("backend", c.Name()), attribute.String("http.target", path)))
+	defer span.End()
+
+	var received, decoded countingReader
+	start := time.Now()
+	defer func() {
+		duration := time.Since(start)
+		// The requests of hedged reads canceled once another replica
+		// answered didn't fail, and took at least as long as they ran.
+		canceled := err != nil && canceledByHedging(ctx)
+		outcomeErr := err
+		if canceled {
+			outcomeErr = nil
+		}
+		if outcomeErr != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		atomic.AddInt64(&c.responseBytes, received.n)
+		atomic.AddInt64(&c.decodedBytes, decoded.n)
+		span.SetAttributes(attribute.Int64("http.response_content_length", received.n),
+			attribute.Int64("http.response_content_length_uncompressed", decoded.n))
+		if stats := StatsFromContext(ctx); stats != nil {
+			stats.addOutcome(BackendOutcome{
+				Backend:       c.Name(),
+				Path:          path,
+				Duration:      duration,
+				ResponseBytes: received.n,
+				DecodedBytes:  decoded.n,
+				Err:           outcomeErr,
+				Canceled:      canceled,
+			})
+		}
+		switch {
+		case canceled:
+			c.latencies.observe(duration)
+			level.Debug(c.logger).Log("msg", "Backend request canceled by a hedged read", "path", path, "duration", duration)
+		case err != nil:
+			level.Warn(c.logger).Log("msg", "Backend request failed", "path", path, "duration", duration, "err", err)
+		default:
+			c.latencies.observe(duration)
+			level.Debug(c.logger).Log("msg", "Backend request", "path", path, "duration", duration, "bytes", received.n, "decoded_bytes", decoded.n)
+		}
+	}()
+
 	httpReq, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create request: %v", err)
+		return fmt.Errorf("unable to create request: %v", err)
 	}
 	httpReq.Header.Set("X-Prometheus-Instant-Query-Version", "0.1.0")
+	if c.acceptEncoding != "" {
+		httpReq.Header.Set("Accept-Encoding", c.acceptEncoding)
+	}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
 
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
 	httpResp, err := ctxhttp.Do(ctx, c.client, httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+		return fmt.Errorf("error sending request: %v", err)
 	}
 	defer httpResp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", httpResp.StatusCode))
 	if httpResp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+		return fmt.Errorf("server returned HTTP status %s", httpResp.Status)
 	}
 
-	raw, err := ioutil.ReadAll(httpResp.Body)
+	// The response is decompressed and decoded as it is received.
+	received.r = httpResp.Body
+	body, release, err := decodedBody(httpResp, &received)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+		return fmt.Errorf("error reading response: %v", err)
 	}
+	decoded.r = body
+	defer func() {
+		// Drain the rest of the body so that the connection can be reused.
+		io.Copy(ioutil.Discard, &decoded)
+		release()
+		io.Copy(ioutil.Discard, &received)
+	}()
 
-	var rsp RangeQueryResult
-	err = json.Unmarshal(raw, &rsp)
-	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal response body: %v", err)
+	_, decodeSpan := tracer.Start(ctx, "remote.Client.decode")
+	defer decodeSpan.End()
+	if err := json.NewDecoder(&decoded).Decode(rsp); err != nil {
+		return fmt.Errorf("unable to unmarshal response body: %v", err)
 	}
-	return &rsp, nil
-}
-
-type RangeQueryResult struct {
-	Data   *RangeQueryData `json:"data"`
-	Status string          `json:"status"`
-}
-type RangeQueryData struct {
-	ResultType value.ValueType `json:"resultType"`
-	Result     *value.Matrix   `json:"result"`
+	return nil
 }
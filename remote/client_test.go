@@ -0,0 +1,120 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func newExternalLabelsClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(0, &ClientConfig{
+		URL:            &config_util.URL{URL: u},
+		Timeout:        model.Duration(time.Minute),
+		ExternalLabels: labels.FromStrings("cluster", "eu1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientExternalMatchers(t *testing.T) {
+	var query string
+	c := newExternalLabelsClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.FormValue("query")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"__name__":"up","job":"node"},"value":[10,"1"]},
+			{"metric":{"__name__":"up","cluster":"us1","job":"node"},"value":[10,"1"]}
+		]}}`))
+	})
+
+	for _, tc := range []struct {
+		query, sent string
+		series      int
+	}{
+		{`up{cluster="eu1"}`, `up`, 1},
+		{`up{cluster=~"eu.*"} or down{cluster="eu1"}`, `up or down`, 1},
+		{`up{cluster="eu1"} or down`, `up or down`, 2},
+		{`up`, `up`, 2},
+	} {
+		res, err := c.QueryInstant(context.Background(), tc.query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tc.sent {
+			t.Errorf("%s: expected %s to be sent, got %s", tc.query, tc.sent, query)
+		}
+		if n := len(*res.Data.Result); n != tc.series {
+			t.Errorf("%s: expected %d series, got %v", tc.query, tc.series, *res.Data.Result)
+		}
+	}
+}
+
+func TestClientExternalLabelValues(t *testing.T) {
+	matching := false
+	c := newExternalLabelsClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/label/__name__/values" && matching {
+			w.Write([]byte(`{"status":"success","data":["up"]}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	})
+
+	values, err := c.LabelValues(context.Background(), "cluster", []string{`down`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("expected no value without matching series, got %v", values)
+	}
+
+	matching = true
+	values, err = c.LabelValues(context.Background(), "cluster", []string{`up`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"eu1"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestClientLookbackDelta(t *testing.T) {
+	var form url.Values
+	c := newTestClient(t, 0, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.Form
+		emptyVector(w, r)
+	})
+
+	for _, tc := range []struct {
+		params *SelectParams
+		sent   string
+	}{
+		{&SelectParams{Query: "up", Start: 10}, ""},
+		{&SelectParams{Query: "up", Start: 10, LookbackDelta: 30}, "30"},
+		{&SelectParams{Query: "up", Start: 10, End: 70, Step: 60, LookbackDelta: 30}, "30"},
+	} {
+		if _, err := (&querier{ctx: context.Background(), client: c}).Select(tc.params); err != nil {
+			t.Fatal(err)
+		}
+		if got := form.Get("lookback_delta"); got != tc.sent {
+			t.Errorf("%+v: expected lookback delta %q to be sent, got %q", tc.params, tc.sent, got)
+		}
+	}
+}
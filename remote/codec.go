@@ -7,16 +7,18 @@ import (
 	"github.com/prometheus/common/model"
 
 	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
 	"github.com/lwangrabbit/prom-query/prompb"
 )
 
 // FromInstantQueryResult unpack a QueryResult proto.
 func FromInstantQueryResult(res *InstantQueryResult) SeriesSet {
 	if res.Status != "success" {
-		return nil
+		return errSeriesSet{err: fmt.Errorf("server returned status %s", res.Status)}
 	}
 	if res.Data == nil || res.Data.Result == nil {
-		return nil
+		// An empty result.
+		return &concreteSeriesSet{}
 	}
 	v := res.Data.Result
 	series := make([]Series, 0, len(*v))
@@ -25,13 +27,9 @@ func FromInstantQueryResult(res *InstantQueryResult) SeriesSet {
 		if err := validateLabelsAndMetricName(labels); err != nil {
 			return errSeriesSet{err: err}
 		}
-		sample := prompb.Sample{
-			Value:     s.V,
-			Timestamp: s.T,
-		}
 		series = append(series, &concreteSeries{
 			labels:  labels,
-			samples: []prompb.Sample{sample},
+			samples: []value.Point{s.Point},
 		})
 	}
 	sort.Sort(byLabel(series))
@@ -43,10 +41,11 @@ func FromInstantQueryResult(res *InstantQueryResult) SeriesSet {
 // FromRangeQueryResult unpack a QueryResult proto.
 func FromRangeQueryResult(res *RangeQueryResult) SeriesSet {
 	if res.Status != "success" {
-		return nil
+		return errSeriesSet{err: fmt.Errorf("server returned status %s", res.Status)}
 	}
 	if res.Data == nil || res.Data.Result == nil {
-		return nil
+		// An empty result.
+		return &concreteSeriesSet{}
 	}
 	v := res.Data.Result
 	series := make([]Series, 0, len(*v))
@@ -55,16 +54,9 @@ func FromRangeQueryResult(res *RangeQueryResult) SeriesSet {
 		if err := validateLabelsAndMetricName(labels); err != nil {
 			return errSeriesSet{err: err}
 		}
-		samples := make([]prompb.Sample, len(s.Points))
-		for _, pt := range s.Points {
-			samples = append(samples, prompb.Sample{
-				Value:     pt.V,
-				Timestamp: pt.T,
-			})
-		}
 		series = append(series, &concreteSeries{
 			labels:  labels,
-			samples: samples,
+			samples: s.Points,
 		})
 	}
 	sort.Sort(byLabel(series))
@@ -91,6 +83,59 @@ func labelProtosToLabels(labelPairs []*prompb.Label) labels.Labels {
 	return result
 }
 
+// ToLabelMatchers converts label matchers to their protobuf representation.
+func ToLabelMatchers(matchers []*labels.Matcher) ([]*prompb.LabelMatcher, error) {
+	pbMatchers := make([]*prompb.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		var mType prompb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			mType = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			mType = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			mType = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			mType = prompb.LabelMatcher_NRE
+		default:
+			return nil, fmt.Errorf("invalid matcher type")
+		}
+		pbMatchers = append(pbMatchers, &prompb.LabelMatcher{
+			Type:  mType,
+			Name:  m.Name,
+			Value: m.Value,
+		})
+	}
+	return pbMatchers, nil
+}
+
+// FromLabelMatchers converts protobuf label matchers to label matchers,
+// compiling their regular expressions.
+func FromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		var mtype labels.MatchType
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ:
+			mtype = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			mtype = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			mtype = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			mtype = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type")
+		}
+		matcher, err := labels.NewMatcher(mtype, matcher.Name, matcher.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+
 // validateLabelsAndMetricName validates the label names/values and metric names returned from remote read.
 func validateLabelsAndMetricName(ls labels.Labels) error {
 	for _, l := range ls {
@@ -145,12 +190,24 @@ func (c *concreteSeriesSet) Err() error {
 
 // concreteSeries implements remote.Series.
 type concreteSeries struct {
-	labels  labels.Labels
-	samples []prompb.Sample
+	labels  labels.Labels // Sorted, and not to be modified.
+	samples []value.Point
+
+	hash   uint64 // Of the labels, once hashed.
+	hashed bool
 }
 
+// Labels returns the labels of the series, without copying them.
 func (c *concreteSeries) Labels() labels.Labels {
-	return labels.New(c.labels...)
+	return c.labels
+}
+
+// labelsHash returns the hash of the labels, computed once.
+func (c *concreteSeries) labelsHash() uint64 {
+	if !c.hashed {
+		c.hash, c.hashed = c.labels.Hash(), true
+	}
+	return c.hash
 }
 
 func (c *concreteSeries) Iterator() SeriesIterator {
@@ -173,7 +230,7 @@ func newConcreteSeriersIterator(series *concreteSeries) SeriesIterator {
 // Seek implements remote.SeriesIterator.
 func (c *concreteSeriesIterator) Seek(t int64) bool {
 	c.cur = sort.Search(len(c.series.samples), func(n int) bool {
-		return c.series.samples[n].Timestamp >= t
+		return c.series.samples[n].T >= t
 	})
 	return c.cur < len(c.series.samples)
 }
@@ -181,7 +238,13 @@ func (c *concreteSeriesIterator) Seek(t int64) bool {
 // At implements remote.SeriesIterator.
 func (c *concreteSeriesIterator) At() (t int64, v float64) {
 	s := c.series.samples[c.cur]
-	return s.Timestamp, s.Value
+	return s.T, s.V
+}
+
+// AtHistogram implements remote.SeriesIterator.
+func (c *concreteSeriesIterator) AtHistogram() (t int64, h *value.Histogram) {
+	s := c.series.samples[c.cur]
+	return s.T, s.H
 }
 
 // Next implements remote.SeriesIterator.
@@ -0,0 +1,263 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// ConflictConfig configures the detection of diverging replicas.
+type ConflictConfig struct {
+	// Tolerance is the relative difference between the values of replicas
+	// at equal timestamps above which they conflict. It defaults to
+	// DefaultConflictTolerance if 0. With a negative value the values must be
+	// equal.
+	Tolerance float64
+}
+
+// DefaultConflictTolerance is the default relative difference between the
+// values of replicas above which they conflict, large enough for the replicas
+// scraping the same targets at different times not to conflict on gauges
+// changing slowly.
+const DefaultConflictTolerance = 0.001
+
+// tolerance returns the tolerance of the detection, with its default.
+func (c ConflictConfig) tolerance() float64 {
+	switch {
+	case c.Tolerance == 0:
+		return DefaultConflictTolerance
+	case c.Tolerance < 0:
+		return 0
+	default:
+		return c.Tolerance
+	}
+}
+
+// ConflictKind is a kind of divergence between replicas.
+type ConflictKind int
+
+const (
+	// ConflictValue is a series with different values on replicas at equal
+	// timestamps.
+	ConflictValue ConflictKind = iota
+	// ConflictMissing is a series missing from some replicas.
+	ConflictMissing
+)
+
+func (k ConflictKind) String() string {
+	switch k {
+	case ConflictValue:
+		return "value"
+	case ConflictMissing:
+		return "missing"
+	default:
+		return fmt.Sprintf("conflict(%d)", int(k))
+	}
+}
+
+// Conflict is a divergence between the replicas of a series.
+type Conflict struct {
+	Kind   ConflictKind
+	Labels labels.Labels
+	// Backends are the replicas missing the series for ConflictMissing. For
+	// ConflictValue, they are the replica of reference and the one whose
+	// values differ.
+	Backends []string
+	// Count is the number of timestamps whose values differ, Timestamp and
+	// Values those of the first one, for ConflictValue.
+	Count     int
+	Timestamp int64
+	Values    [2]float64
+}
+
+func (c Conflict) String() string {
+	if c.Kind == ConflictMissing {
+		return fmt.Sprintf("%s missing from %s", c.Labels, strings.Join(c.Backends, ", "))
+	}
+	return fmt.Sprintf("%s at %d: %g on %s, %g on %s (%d timestamps)", c.Labels, c.Timestamp,
+		c.Values[0], c.Backends[0], c.Values[1], c.Backends[1], c.Count)
+}
+
+// GroupConflicts counts the conflicts detected between the replicas of a
+// group since the Reader was created.
+type GroupConflicts struct {
+	Group          string
+	ValueConflicts int64
+	MissingSeries  int64
+}
+
+// conflictDetector detects the conflicts between the replicas of a group in
+// the queries, and counts them.
+type conflictDetector struct {
+	// Updated atomically.
+	valueConflicts int64
+	missingSeries  int64
+
+	tolerance float64
+}
+
+func (d *conflictDetector) count(c Conflict) {
+	if c.Kind == ConflictMissing {
+		atomic.AddInt64(&d.missingSeries, 1)
+	} else {
+		atomic.AddInt64(&d.valueConflicts, 1)
+	}
+}
+
+// findConflicts returns the conflicts between the samples of a series in the
+// given replicas, ordered by the index of their sets, which are compared to
+// the first one. The series is missing from the queried sets without samples.
+func findConflicts(ls labels.Labels, replicas []replicaSamples, queried []bool, clients []*Client, tolerance float64) []Conflict {
+	var conflicts []Conflict
+	present := make(map[int]bool, len(replicas))
+	for _, r := range replicas {
+		present[r.set] = true
+	}
+	var missing []string
+	for i, ok := range queried {
+		if ok && !present[i] {
+			missing = append(missing, clients[i].Name())
+		}
+	}
+	if len(missing) > 0 {
+		conflicts = append(conflicts, Conflict{Kind: ConflictMissing, Labels: ls, Backends: missing})
+	}
+
+	ref := replicas[0]
+	for _, r := range replicas[1:] {
+		c := Conflict{Kind: ConflictValue, Labels: ls, Backends: []string{clients[ref.set].Name(), clients[r.set].Name()}}
+		i, j := 0, 0
+		for i < len(ref.samples) && j < len(r.samples) {
+			a, b := ref.samples[i], r.samples[j]
+			switch {
+			case a.T < b.T:
+				i++
+				continue
+			case a.T > b.T:
+				j++
+				continue
+			}
+			if !equalSamples(a, b, tolerance) {
+				if c.Count == 0 {
+					c.Timestamp, c.Values = a.T, [2]float64{a.V, b.V}
+				}
+				c.Count++
+			}
+			i++
+			j++
+		}
+		if c.Count > 0 {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// equalSamples returns whether the values of two samples differ by at most
+// the given relative tolerance. Histograms are compared by count and sum.
+func equalSamples(a, b value.Point, tolerance float64) bool {
+	switch {
+	case a.H != nil && b.H != nil:
+		return equalValues(a.H.Count, b.H.Count, tolerance) && equalValues(a.H.Sum, b.H.Sum, tolerance)
+	case a.H != nil || b.H != nil:
+		return false
+	default:
+		return equalValues(a.V, b.V, tolerance)
+	}
+}
+
+func equalValues(a, b, tolerance float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// ConsistencyReport tells how the replicas of the groups of a Reader diverge.
+type ConsistencyReport struct {
+	Groups []GroupConsistency
+}
+
+// GroupConsistency tells how the replicas of a group diverge.
+type GroupConsistency struct {
+	Group    string
+	Replicas []string
+	// Series is the number of series of the replicas.
+	Series    int
+	Conflicts []Conflict
+}
+
+// ConsistencyReport compares the series selected by the given params on the
+// replicas of each group. The values of replicas at equal timestamps conflict
+// when their relative difference is above the given tolerance.
+func (s *Reader) ConsistencyReport(ctx context.Context, p *SelectParams, tolerance float64) (*ConsistencyReport, error) {
+	if s.rewriter != nil {
+		qs, err := s.rewriter.RewriteQuery(ctx, p.Query)
+		if err != nil {
+			return nil, err
+		}
+		rp := *p
+		rp.Query = qs
+		p = &rp
+	}
+	report := &ConsistencyReport{}
+	for _, g := range s.groups {
+		g.mtx.RLock()
+		replicas := g.replicas
+		g.mtx.RUnlock()
+
+		gc := GroupConsistency{Group: g.name}
+		sets := make([]SeriesSet, 0, len(replicas))
+		queried := make([]bool, 0, len(replicas))
+		for _, c := range replicas {
+			set, err := (&querier{ctx: ctx, client: c}).Select(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", c.Name(), err)
+			}
+			sets = append(sets, set)
+			queried = append(queried, set != NoopSeriesSet())
+			gc.Replicas = append(gc.Replicas, c.Name())
+		}
+		if len(sets) == 0 {
+			report.Groups = append(report.Groups, gc)
+			continue
+		}
+
+		merge := newMergeSeriesSet(sets)
+		for merge.Next() {
+			gc.Series++
+			samples, err := merge.replicaSamples()
+			if err != nil {
+				return nil, err
+			}
+			gc.Conflicts = append(gc.Conflicts, findConflicts(merge.currentLabels, samples, queried, replicas, tolerance)...)
+		}
+		if err := merge.Err(); err != nil {
+			return nil, err
+		}
+		report.Groups = append(report.Groups, gc)
+	}
+	return report, nil
+}
+
+// Conflicts returns the conflicts detected between the replicas of each group
+// in the queries so far.
+func (s *Reader) Conflicts() []GroupConflicts {
+	var res []GroupConflicts
+	for _, g := range s.groups {
+		if g.conflicts == nil {
+			continue
+		}
+		res = append(res, GroupConflicts{
+			Group:          g.name,
+			ValueConflicts: atomic.LoadInt64(&g.conflicts.valueConflicts),
+			MissingSeries:  atomic.LoadInt64(&g.conflicts.missingSeries),
+		})
+	}
+	return res
+}
@@ -0,0 +1,121 @@
+package remote
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// CounterMode tells which series are merged as counters. The samples of a
+// counter are taken from a single replica at a time, switching replicas only
+// at gaps, and their values are offset at the switches so that the counter
+// doesn't decrease because of the skew between replicas. Resets of the
+// replicas themselves are kept.
+type CounterMode int
+
+const (
+	// CountersNone merges no series as counters.
+	CountersNone CounterMode = iota
+	// CountersInferred merges as counters the series whose metric name ends
+	// with _total, _count or _bucket, or whose metric is of type counter in
+	// the metadata of the replicas.
+	CountersInferred
+	// CountersAll merges all the series as counters.
+	CountersAll
+)
+
+type counterModeKey struct{}
+
+// WithCounterMode returns a context which makes the queries executed with it
+// merge counters with the given mode, rather than the one of the Reader.
+func WithCounterMode(ctx context.Context, m CounterMode) context.Context {
+	return context.WithValue(ctx, counterModeKey{}, m)
+}
+
+// CounterModeFromContext returns the counter mode of ctx, and false if it
+// has none.
+func CounterModeFromContext(ctx context.Context) (CounterMode, bool) {
+	m, ok := ctx.Value(counterModeKey{}).(CounterMode)
+	return m, ok
+}
+
+// counterSuffixes are the suffixes of the metric names of counters.
+var counterSuffixes = []string{"_total", "_count", "_bucket"}
+
+// isCounter returns whether the series of the given labels is merged as a
+// counter.
+func (s *dedupSeriesSet) isCounter(ls labels.Labels) bool {
+	switch s.counters {
+	case CountersAll:
+		return true
+	case CountersInferred:
+	default:
+		return false
+	}
+	name := ls.Get(labels.MetricName)
+	if name == "" {
+		return false
+	}
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return s.types[name] == "counter"
+}
+
+// metricTypes returns the types of the metrics of the first of the given
+// replicas whose types can be fetched, or nil if none can.
+func metricTypes(ctx context.Context, replicas []*Client) map[string]string {
+	for _, c := range replicas {
+		if types := c.metricTypes(ctx); types != nil {
+			return types
+		}
+	}
+	return nil
+}
+
+// adjustCounter offsets the values of the samples of a counter taken from the
+// given replicas, so that they don't decrease when switching replicas. The
+// values taken from a replica are offset by the amount they are below the
+// previous sample at the switch, unless the replica itself was reset.
+func adjustCounter(samples []value.Point, owners []int, replicas []replicaSamples) []value.Point {
+	for _, p := range samples {
+		if p.H != nil {
+			// Native histograms are left as they are.
+			return samples
+		}
+	}
+	bySet := make(map[int][]value.Point, len(replicas))
+	for _, r := range replicas {
+		bySet[r.set] = r.samples
+	}
+
+	res := make([]value.Point, len(samples))
+	var offset, last float64
+	for i, p := range samples {
+		if i > 0 && owners[i] != owners[i-1] {
+			offset = 0
+			if p.V < last && !wasReset(bySet[owners[i]], p) {
+				offset = last - p.V
+			}
+		}
+		res[i] = p
+		res[i].V += offset
+		if !math.IsNaN(res[i].V) {
+			last = res[i].V
+		}
+	}
+	return res
+}
+
+// wasReset returns whether the replica of the given samples was reset before
+// the sample p, its previous sample being higher.
+func wasReset(samples []value.Point, p value.Point) bool {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].T >= p.T })
+	return i > 0 && samples[i-1].V > p.V
+}
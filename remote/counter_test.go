@@ -0,0 +1,46 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetricTypes(t *testing.T) {
+	var requests [3]int64
+	handler := func(i int, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests[i], 1)
+			if body == "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(body))
+		}
+	}
+	const metadata = `{"status":"success","data":{"requests":[{"type":"counter","help":"","unit":""}]}}`
+	replicas := []*Client{
+		newTestClient(t, 0, handler(0, "")),
+		newTestClient(t, 1, handler(1, metadata)),
+		newTestClient(t, 2, handler(2, metadata)),
+	}
+
+	stats := &Stats{}
+	ctx := NewContextWithStats(context.Background(), stats)
+	for i := 0; i < 2; i++ {
+		if types := metricTypes(ctx, replicas); types["requests"] != "counter" {
+			t.Fatalf("expected the types of the second replica, got %v", types)
+		}
+	}
+	// The failure of the first replica and the types of the second one are
+	// cached, and the third one isn't asked.
+	for i, expected := range []int64{1, 1, 0} {
+		if n := atomic.LoadInt64(&requests[i]); n != expected {
+			t.Errorf("replica %d: expected %d requests, got %d", i, expected, n)
+		}
+	}
+	if outcomes := stats.Outcomes(); len(outcomes) != 0 {
+		t.Errorf("expected no outcome recorded for the metadata, got %v", outcomes)
+	}
+}
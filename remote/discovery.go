@@ -0,0 +1,330 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+const (
+	// DefaultRefreshInterval is the refresh interval of target providers
+	// which don't set one.
+	DefaultRefreshInterval = 30 * time.Second
+	// DefaultTargetTimeout is the request timeout of the targets of
+	// providers which don't set one.
+	DefaultTargetTimeout = 2 * time.Minute
+)
+
+// TargetProvider discovers the replicas of a group at runtime.
+type TargetProvider interface {
+	// Run sends the complete list of targets on ch each time it changes,
+	// until ctx is done. Sends must not block once ctx is done. The first
+	// list is waited for by NewGroupedReader, so it should be sent without
+	// delay, even if empty.
+	Run(ctx context.Context, ch chan<- []*ReadConfig)
+}
+
+// Resolver looks up DNS records. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSConfig configures a DNSProvider.
+type DNSConfig struct {
+	// Names are the DNS names to look up.
+	Names []string
+	// Type is the record type, "SRV" or "A". It defaults to "SRV".
+	Type string
+	// Port is the port of the targets of A records.
+	Port int
+	// Scheme is the scheme of the target URLs. It defaults to "http".
+	Scheme          string
+	RefreshInterval time.Duration
+	// Timeout is the request timeout of the targets, DefaultTargetTimeout if
+	// 0.
+	Timeout model.Duration
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// DNSProvider discovers targets from DNS A or SRV records.
+type DNSProvider struct {
+	conf   DNSConfig
+	logger log.Logger
+}
+
+// NewDNSProvider returns a DNSProvider for the given config.
+func NewDNSProvider(conf *DNSConfig, logger log.Logger) (*DNSProvider, error) {
+	c := *conf
+	switch strings.ToUpper(c.Type) {
+	case "":
+		c.Type = "SRV"
+	case "SRV", "A":
+		c.Type = strings.ToUpper(c.Type)
+	default:
+		return nil, fmt.Errorf("invalid DNS record type %q", conf.Type)
+	}
+	if c.Type == "A" && c.Port == 0 {
+		return nil, fmt.Errorf("a port is required for DNS A records")
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = DefaultRefreshInterval
+	}
+	if c.Resolver == nil {
+		c.Resolver = net.DefaultResolver
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = model.Duration(DefaultTargetTimeout)
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &DNSProvider{conf: c, logger: log.With(logger, "discovery", "dns")}, nil
+}
+
+// Run implements TargetProvider. The targets of names whose lookup fails are
+// the ones of their last successful lookup.
+func (p *DNSProvider) Run(ctx context.Context, ch chan<- []*ReadConfig) {
+	last := map[string][]string{}
+	refresh := func() []string {
+		var hosts []string
+		for _, name := range p.conf.Names {
+			res, err := p.lookup(ctx, name)
+			if err != nil {
+				level.Error(p.logger).Log("msg", "DNS lookup failed", "name", name, "err", err)
+				res = last[name]
+			}
+			last[name] = res
+			hosts = append(hosts, res...)
+		}
+		return hosts
+	}
+	runRefresh(ctx, p.conf.RefreshInterval, ch, func() []*ReadConfig {
+		return targetConfigs(refresh(), nil, p.conf.Scheme, p.conf.Timeout)
+	})
+}
+
+// lookup returns the host:port addresses the given name resolves to.
+func (p *DNSProvider) lookup(ctx context.Context, name string) ([]string, error) {
+	var hosts []string
+	switch p.conf.Type {
+	case "SRV":
+		_, srvs, err := p.conf.Resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimRight(srv.Target, ".")
+			hosts = append(hosts, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	case "A":
+		addrs, err := p.conf.Resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			hosts = append(hosts, net.JoinHostPort(addr.IP.String(), strconv.Itoa(p.conf.Port)))
+		}
+	}
+	return hosts, nil
+}
+
+// FileConfig configures a FileProvider.
+type FileConfig struct {
+	// Files are the paths of the target files. They may contain glob patterns.
+	Files []string
+	// Scheme is the scheme of targets which aren't URLs. It defaults to "http".
+	Scheme string
+	// RefreshInterval is how often the files are checked for changes.
+	RefreshInterval time.Duration
+	// Timeout is the request timeout of the targets, DefaultTargetTimeout if
+	// 0.
+	Timeout model.Duration
+}
+
+// FileProvider discovers targets from JSON or YAML files in the file_sd
+// format of Prometheus. The files are polled every refresh interval, and
+// re-read when their modification time changed:
+//
+//	[{"targets": ["host:9090", "https://host:9091"], "labels": {"dc": "eu"}}]
+//
+// The labels of a target group are the external labels of its targets.
+// Labels starting with "__" are ignored.
+type FileProvider struct {
+	conf   FileConfig
+	logger log.Logger
+}
+
+// NewFileProvider returns a FileProvider for the given config.
+func NewFileProvider(conf *FileConfig, logger log.Logger) (*FileProvider, error) {
+	c := *conf
+	for _, pattern := range c.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = DefaultRefreshInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = model.Duration(DefaultTargetTimeout)
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &FileProvider{conf: c, logger: log.With(logger, "discovery", "file")}, nil
+}
+
+type fileTargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+type fileTargets struct {
+	modTime time.Time
+	targets []*ReadConfig
+}
+
+// Run implements TargetProvider. The targets of files which can't be read
+// are the ones of their last successful read.
+func (p *FileProvider) Run(ctx context.Context, ch chan<- []*ReadConfig) {
+	files := map[string]fileTargets{}
+	runRefresh(ctx, p.conf.RefreshInterval, ch, func() []*ReadConfig {
+		current := map[string]fileTargets{}
+		for _, pattern := range p.conf.Files {
+			paths, _ := filepath.Glob(pattern)
+			for _, path := range paths {
+				current[path] = p.read(path, files[path])
+			}
+		}
+		files = current
+
+		paths := make([]string, 0, len(files))
+		for path := range files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		var targets []*ReadConfig
+		for _, path := range paths {
+			targets = append(targets, files[path].targets...)
+		}
+		return targets
+	})
+}
+
+// read returns the targets of the given file, or prev if the file wasn't
+// modified since or can't be read.
+func (p *FileProvider) read(path string, prev fileTargets) fileTargets {
+	fi, err := os.Stat(path)
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Failed to read target file", "file", path, "err", err)
+		return prev
+	}
+	if fi.ModTime().Equal(prev.modTime) {
+		return prev
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Failed to read target file", "file", path, "err", err)
+		return prev
+	}
+
+	var groups []fileTargetGroup
+	switch ext := filepath.Ext(path); strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(content, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(content, &groups)
+	default:
+		err = fmt.Errorf("unknown file extension %q", ext)
+	}
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Failed to parse target file", "file", path, "err", err)
+		return prev
+	}
+
+	res := fileTargets{modTime: fi.ModTime()}
+	for _, tg := range groups {
+		ls := labels.Labels{}
+		for name, value := range tg.Labels {
+			if !strings.HasPrefix(name, "__") {
+				ls = append(ls, labels.Label{Name: name, Value: value})
+			}
+		}
+		sort.Sort(ls)
+		res.targets = append(res.targets, targetConfigs(tg.Targets, ls, p.conf.Scheme, p.conf.Timeout)...)
+	}
+	return res
+}
+
+// runRefresh sends the targets returned by refresh on ch every interval, if
+// they changed since the last send, until ctx is done.
+func runRefresh(ctx context.Context, interval time.Duration, ch chan<- []*ReadConfig, refresh func() []*ReadConfig) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []*ReadConfig
+	for first := true; ; first = false {
+		targets := refresh()
+		if first || !reflect.DeepEqual(targets, last) {
+			select {
+			case ch <- targets:
+				last = targets
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// targetConfigs returns the configs of the given targets, which are either
+// URLs or host:port addresses. Invalid targets are skipped.
+func targetConfigs(targets []string, ls labels.Labels, scheme string, timeout model.Duration) []*ReadConfig {
+	res := make([]*ReadConfig, 0, len(targets))
+	for _, t := range targets {
+		if !strings.Contains(t, "://") {
+			t = scheme + "://" + t
+		}
+		u, err := url.Parse(t)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		res = append(res, &ReadConfig{
+			URL:            &config_util.URL{URL: u},
+			Timeout:        timeout,
+			Name:           fmt.Sprintf("promql-read-%v", t),
+			ExternalLabels: ls,
+		})
+	}
+	return res
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
 )
 
 // mergeQuerier implements Querier.
@@ -50,10 +51,10 @@ func (q *mergeQuerier) Select(params *SelectParams) (SeriesSet, error) {
 }
 
 // LabelValues returns all potential values for a label name.
-func (q *mergeQuerier) LabelValues(name string) ([]string, error) {
+func (q *mergeQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
 	var results [][]string
 	for _, querier := range q.queriers {
-		values, err := querier.LabelValues(name)
+		values, err := querier.LabelValues(name, selectors...)
 		if err != nil {
 			return nil, err
 		}
@@ -113,10 +114,11 @@ func (q *mergeQuerier) Close() error {
 	return lastErr
 }
 
-// mergeSeriesSet implements SeriesSet
+// mergeSeriesSet implements SeriesSet. The series with equal labels of the
+// sets are merged in the order of the sets.
 type mergeSeriesSet struct {
 	currentLabels labels.Labels
-	currentSets   []SeriesSet
+	currentSets   []*indexedSeriesSet
 	heap          seriesSetHeap
 	sets          []SeriesSet
 }
@@ -127,13 +129,18 @@ func NewMergeSeriesSet(sets []SeriesSet) SeriesSet {
 	if len(sets) == 1 {
 		return sets[0]
 	}
+	return newMergeSeriesSet(sets)
+}
 
+func newMergeSeriesSet(sets []SeriesSet) *mergeSeriesSet {
 	// Sets need to be pre-advanced, so we can introspect the label of the
 	// series under the cursor.
 	var h seriesSetHeap
-	for _, set := range sets {
+	for i, set := range sets {
 		if set.Next() {
-			heap.Push(&h, set)
+			s := &indexedSeriesSet{SeriesSet: set, index: i}
+			s.load()
+			heap.Push(&h, s)
 		}
 	}
 	return &mergeSeriesSet{
@@ -147,6 +154,7 @@ func (c *mergeSeriesSet) Next() bool {
 	// we can drop them, otherwise they should be inserted back into the heap.
 	for _, set := range c.currentSets {
 		if set.Next() {
+			set.load()
 			heap.Push(&c.heap, set)
 		}
 	}
@@ -155,10 +163,11 @@ func (c *mergeSeriesSet) Next() bool {
 	}
 
 	// Now, pop items of the heap that have equal label sets.
-	c.currentSets = nil
-	c.currentLabels = c.heap[0].At().Labels()
-	for len(c.heap) > 0 && labels.Equal(c.currentLabels, c.heap[0].At().Labels()) {
-		set := heap.Pop(&c.heap).(SeriesSet)
+	c.currentSets = c.currentSets[:0]
+	c.currentLabels = c.heap[0].labels
+	hash := c.heap[0].hash
+	for len(c.heap) > 0 && c.heap[0].hash == hash && labels.Equal(c.currentLabels, c.heap[0].labels) {
+		set := heap.Pop(&c.heap).(*indexedSeriesSet)
 		c.currentSets = append(c.currentSets, set)
 	}
 	return true
@@ -187,18 +196,49 @@ func (c *mergeSeriesSet) Err() error {
 	return nil
 }
 
-type seriesSetHeap []SeriesSet
+// indexedSeriesSet is a set of a mergeSeriesSet along with its index, and
+// the labels and their hash of its current series.
+type indexedSeriesSet struct {
+	SeriesSet
+	index  int
+	labels labels.Labels
+	hash   uint64
+}
+
+// load caches the labels of the current series of the set.
+func (s *indexedSeriesSet) load() {
+	series := s.At()
+	s.labels, s.hash = series.Labels(), seriesHash(series)
+}
+
+// seriesHash returns the hash of the labels of s, cached by the series
+// decoded from the backends.
+func seriesHash(s Series) uint64 {
+	if c, ok := s.(*concreteSeries); ok {
+		return c.labelsHash()
+	}
+	return s.Labels().Hash()
+}
+
+type seriesSetHeap []*indexedSeriesSet
 
 func (h seriesSetHeap) Len() int      { return len(h) }
 func (h seriesSetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
 
+// Less orders the sets by the labels of their current series, then by index.
+// Equal labels, as those of the replicas of a series, are told by their
+// hashes without comparing them.
 func (h seriesSetHeap) Less(i, j int) bool {
-	a, b := h[i].At().Labels(), h[j].At().Labels()
-	return labels.Compare(a, b) < 0
+	if h[i].hash != h[j].hash || !labels.Equal(h[i].labels, h[j].labels) {
+		if c := labels.Compare(h[i].labels, h[j].labels); c != 0 {
+			return c < 0
+		}
+	}
+	return h[i].index < h[j].index
 }
 
 func (h *seriesSetHeap) Push(x interface{}) {
-	*h = append(*h, x.(SeriesSet))
+	*h = append(*h, x.(*indexedSeriesSet))
 }
 
 func (h *seriesSetHeap) Pop() interface{} {
@@ -226,6 +266,8 @@ func (m *mergeSeries) Iterator() SeriesIterator {
 	return newMergeIterator(iterators)
 }
 
+// mergeIterator merges the samples of iterators over the same series. Of
+// samples with equal timestamps, the one of the first iterator is kept.
 type mergeIterator struct {
 	iterators []SeriesIterator
 	h         seriesIteratorHeap
@@ -240,9 +282,9 @@ func newMergeIterator(iterators []SeriesIterator) SeriesIterator {
 
 func (c *mergeIterator) Seek(t int64) bool {
 	c.h = seriesIteratorHeap{}
-	for _, iter := range c.iterators {
+	for i, iter := range c.iterators {
 		if iter.Seek(t) {
-			heap.Push(&c.h, iter)
+			heap.Push(&c.h, indexedIterator{iter, i})
 		}
 	}
 	return len(c.h) > 0
@@ -256,11 +298,19 @@ func (c *mergeIterator) At() (t int64, v float64) {
 	return c.h[0].At()
 }
 
+func (c *mergeIterator) AtHistogram() (int64, *value.Histogram) {
+	if len(c.h) == 0 {
+		panic("mergeIterator.AtHistogram() called after .Next() returned false.")
+	}
+
+	return c.h[0].AtHistogram()
+}
+
 func (c *mergeIterator) Next() bool {
 	if c.h == nil {
-		for _, iter := range c.iterators {
+		for i, iter := range c.iterators {
 			if iter.Next() {
-				heap.Push(&c.h, iter)
+				heap.Push(&c.h, indexedIterator{iter, i})
 			}
 		}
 
@@ -278,7 +328,7 @@ func (c *mergeIterator) Next() bool {
 			break
 		}
 
-		iter := heap.Pop(&c.h).(SeriesIterator)
+		iter := heap.Pop(&c.h).(indexedIterator)
 		if iter.Next() {
 			heap.Push(&c.h, iter)
 		}
@@ -296,7 +346,13 @@ func (c *mergeIterator) Err() error {
 	return nil
 }
 
-type seriesIteratorHeap []SeriesIterator
+// indexedIterator is an iterator of a mergeIterator along with its index.
+type indexedIterator struct {
+	SeriesIterator
+	index int
+}
+
+type seriesIteratorHeap []indexedIterator
 
 func (h seriesIteratorHeap) Len() int      { return len(h) }
 func (h seriesIteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
@@ -304,11 +360,14 @@ func (h seriesIteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
 func (h seriesIteratorHeap) Less(i, j int) bool {
 	at, _ := h[i].At()
 	bt, _ := h[j].At()
-	return at < bt
+	if at != bt {
+		return at < bt
+	}
+	return h[i].index < h[j].index
 }
 
 func (h *seriesIteratorHeap) Push(x interface{}) {
-	*h = append(*h, x.(SeriesIterator))
+	*h = append(*h, x.(indexedIterator))
 }
 
 func (h *seriesIteratorHeap) Pop() interface{} {
@@ -0,0 +1,117 @@
+package remote
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+func TestMergeSeriesSetUnsortedLabels(t *testing.T) {
+	sorted := NewMemoryStorage(0)
+	if err := sorted.Append(labels.FromStrings("__name__", "up", "job", "node"), 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	unsorted := NewMemoryStorage(0)
+	ls := labels.Labels{{Name: "job", Value: "node"}, {Name: "__name__", Value: "up"}}
+	if err := unsorted.Append(ls, 20, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var queriers []Querier
+	for _, m := range []*MemoryStorage{sorted, unsorted} {
+		q, err := m.Querier(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queriers = append(queriers, q)
+	}
+	set, err := NewMergeQuerier(queriers).Select(&SelectParams{Query: "up", Start: 10, End: 20, Step: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []labels.Labels
+	for set.Next() {
+		got = append(got, set.At().Labels())
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].String() != `{__name__="up", job="node"}` {
+		t.Fatalf("expected a single merged series, got %v", got)
+	}
+}
+
+func TestMergeSeriesSetHashCollision(t *testing.T) {
+	// The series of each set have the same hash, as if their labels collided.
+	newSet := func(t0 int64, names ...string) SeriesSet {
+		var series []Series
+		for _, name := range names {
+			series = append(series, &concreteSeries{
+				labels:  labels.FromStrings("__name__", name),
+				samples: []value.Point{{T: t0, V: 1}},
+				hash:    42,
+				hashed:  true,
+			})
+		}
+		return &concreteSeriesSet{series: series}
+	}
+	set := NewMergeSeriesSet([]SeriesSet{newSet(10, "a", "c"), newSet(20, "b", "c"), newSet(30, "a")})
+
+	var got []string
+	for set.Next() {
+		s := set.At()
+		var ts []int64
+		it := s.Iterator()
+		for it.Next() {
+			t, _ := it.At()
+			ts = append(ts, t)
+		}
+		got = append(got, fmt.Sprint(s.Labels().Get("__name__"), ts))
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a[10 30]", "b[20]", "c[10 20]"}; fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected the series %v, got %v", expected, got)
+	}
+}
+
+// BenchmarkMergeSeriesSet merges the results of two replicas holding the same
+// series, as decoded from their responses.
+func BenchmarkMergeSeriesSet(b *testing.B) {
+	const numSeries = 200000
+	replicas := make([][]Series, 2)
+	for i := range replicas {
+		interner := labels.NewInterner(0)
+		for j := 0; j < numSeries; j++ {
+			ls := labels.FromStrings(
+				"__name__", "http_requests_total",
+				"instance", fmt.Sprintf("10.0.%d.%d:9090", j/256, j%256),
+				"job", "api",
+			)
+			replicas[i] = append(replicas[i], &concreteSeries{
+				labels:  interner.InternLabels(ls),
+				samples: []value.Point{{T: int64(i), V: float64(j)}},
+			})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sets := make([]SeriesSet, 0, len(replicas))
+		for _, series := range replicas {
+			sets = append(sets, &concreteSeriesSet{series: series})
+		}
+		set := NewMergeSeriesSet(sets)
+		n := 0
+		for set.Next() {
+			n++
+		}
+		if n != numSeries {
+			b.Fatalf("expected %d series, got %d", numSeries, n)
+		}
+	}
+}
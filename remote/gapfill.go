@@ -0,0 +1,308 @@
+package remote
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+)
+
+// DedupMode is how the series of the replicas of a group are deduplicated.
+type DedupMode int
+
+const (
+	// DedupMerge interleaves the samples of the replicas of a series. Of
+	// samples with equal timestamps, the one of the first replica is kept.
+	DedupMerge DedupMode = iota
+	// DedupGapFill takes the samples of a series from a primary replica, the
+	// one with the most samples, and fills the gaps between them from the
+	// other replicas. Gaps are detected from the interval between the samples
+	// of the primary.
+	DedupGapFill
+)
+
+// ReplicaRange is a time range of the samples of a series taken from a
+// replica, in seconds.
+type ReplicaRange struct {
+	Backend    string
+	Start, End int64
+}
+
+// SeriesCoverage tells which replicas the samples of a series were taken
+// from.
+type SeriesCoverage struct {
+	Labels labels.Labels
+	Ranges []ReplicaRange
+}
+
+// dedupQuerier queries the replicas of a group and deduplicates their
+// series with the mode of the group, merging counters as such.
+type dedupQuerier struct {
+	ctx      context.Context
+	group    *group
+	replicas []*Client
+	counters CounterMode
+}
+
+// Select implements Querier.
+func (q *dedupQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	sets := make([]SeriesSet, 0, len(q.replicas))
+	for _, c := range q.replicas {
+		set, err := (&querier{ctx: q.ctx, client: c}).Select(p)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return newDedupSeriesSet(q.ctx, q.group, sets, q.replicas, q.counters), nil
+}
+
+// LabelValues implements Querier, with the values of all the replicas.
+func (q *dedupQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	return NewMergeQuerier(replicaQueriers(q.ctx, q.replicas)).LabelValues(name, selectors...)
+}
+
+// Close implements Querier and is a noop.
+func (q *dedupQuerier) Close() error {
+	return nil
+}
+
+// replicaQueriers returns the queriers of the given replicas.
+func replicaQueriers(ctx context.Context, replicas []*Client) []Querier {
+	queriers := make([]Querier, 0, len(replicas))
+	for _, c := range replicas {
+		queriers = append(queriers, &querier{ctx: ctx, client: c})
+	}
+	return queriers
+}
+
+// dedupSeriesSet deduplicates the series of the sets of replicas with the
+// mode of their group. Counters are gap filled whatever the mode, with their
+// values adjusted across replicas. The series filled from several replicas
+// have their coverage recorded into the Stats of the context, as are the
+// conflicts between replicas if the group detects them.
+type dedupSeriesSet struct {
+	ctx      context.Context
+	merge    *mergeSeriesSet
+	replicas []*Client // Of the sets.
+	queried  []bool    // Whether the query was sent to the replica of each set.
+	dedup    DedupMode
+	counters CounterMode
+	types    map[string]string // Metric types, with CountersInferred.
+	detector *conflictDetector // Nil if conflicts aren't detected.
+	stats    *Stats
+
+	cur     Series
+	samples []replicaSamples // Of the current series, once collected.
+	err     error
+}
+
+func newDedupSeriesSet(ctx context.Context, g *group, sets []SeriesSet, replicas []*Client, counters CounterMode) SeriesSet {
+	queried := make([]bool, len(sets))
+	var queriedReplicas []*Client
+	for i, set := range sets {
+		queried[i] = set != NoopSeriesSet()
+		if queried[i] {
+			queriedReplicas = append(queriedReplicas, replicas[i])
+		}
+	}
+	// The metric types are fetched before iterating, once per Select.
+	var types map[string]string
+	if counters == CountersInferred {
+		types = metricTypes(ctx, queriedReplicas)
+	}
+	return &dedupSeriesSet{
+		ctx:      ctx,
+		merge:    newMergeSeriesSet(sets),
+		replicas: replicas,
+		queried:  queried,
+		dedup:    g.dedup,
+		counters: counters,
+		types:    types,
+		detector: g.conflicts,
+		stats:    StatsFromContext(ctx),
+	}
+}
+
+func (s *dedupSeriesSet) Next() bool {
+	s.cur, s.samples = nil, nil
+	if s.err != nil || !s.merge.Next() {
+		return false
+	}
+	if s.detector != nil {
+		s.detectConflicts()
+	}
+	return s.err == nil
+}
+
+// currentSamples returns the samples of the current series in each replica.
+func (s *dedupSeriesSet) currentSamples() ([]replicaSamples, error) {
+	if s.samples == nil {
+		samples, err := s.merge.replicaSamples()
+		if err != nil {
+			return nil, err
+		}
+		s.samples = samples
+	}
+	return s.samples, nil
+}
+
+// detectConflicts records the conflicts between the replicas of the current
+// series.
+func (s *dedupSeriesSet) detectConflicts() {
+	samples, err := s.currentSamples()
+	if err != nil {
+		s.err = err
+		return
+	}
+	for _, c := range findConflicts(s.merge.currentLabels, samples, s.queried, s.replicas, s.detector.tolerance) {
+		// The series are counted once per query, whether it is split or not.
+		if s.stats == nil || s.stats.addConflict(c) {
+			s.detector.count(c)
+		}
+	}
+}
+
+func (s *dedupSeriesSet) At() Series {
+	if s.cur == nil {
+		if len(s.merge.currentSets) == 1 {
+			s.cur = s.merge.currentSets[0].At()
+		} else if counter := s.isCounter(s.merge.currentLabels); counter || s.dedup == DedupGapFill {
+			s.cur = s.fill(counter)
+		} else {
+			s.cur = s.merge.At()
+		}
+	}
+	return s.cur
+}
+
+func (s *dedupSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.merge.Err()
+}
+
+// replicaSamples are the samples of a series in a replica.
+type replicaSamples struct {
+	set     int // Index of the set of the replica.
+	samples []value.Point
+}
+
+// replicaSamples returns the samples of the current series in each of the
+// sets having it, ordered by the index of the sets.
+func (c *mergeSeriesSet) replicaSamples() ([]replicaSamples, error) {
+	replicas := make([]replicaSamples, 0, len(c.currentSets))
+	for _, set := range c.currentSets {
+		samples, err := collectSamples(set.At().Iterator())
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replicaSamples{set: set.index, samples: samples})
+	}
+	return replicas, nil
+}
+
+// fill returns the current series, with the samples of its primary replica
+// and those of the other replicas filling its gaps.
+func (s *dedupSeriesSet) fill(counter bool) Series {
+	replicas, err := s.currentSamples()
+	if err != nil {
+		s.err = err
+		return &concreteSeries{labels: s.merge.currentLabels}
+	}
+	replicas = append([]replicaSamples(nil), replicas...)
+	// The primary has the most samples, then the first replica.
+	sort.SliceStable(replicas, func(i, j int) bool { return len(replicas[i].samples) > len(replicas[j].samples) })
+
+	samples := replicas[0].samples
+	owners := make([]int, len(samples))
+	for i := range owners {
+		owners[i] = replicas[0].set
+	}
+	if interval := sampleInterval(samples); interval > 0 {
+		for _, r := range replicas[1:] {
+			samples, owners = fillGaps(samples, owners, r.samples, r.set, interval)
+		}
+	}
+	if counter {
+		samples = adjustCounter(samples, owners, replicas)
+	}
+	if s.stats != nil {
+		if ranges := s.coverage(samples, owners); len(ranges) > 1 {
+			s.stats.addCoverage(SeriesCoverage{Labels: s.merge.currentLabels, Ranges: ranges})
+		}
+	}
+	return &concreteSeries{labels: s.merge.currentLabels, samples: samples}
+}
+
+// coverage returns the ranges of the consecutive samples taken from the same
+// replica.
+func (s *dedupSeriesSet) coverage(samples []value.Point, owners []int) []ReplicaRange {
+	var ranges []ReplicaRange
+	for i, p := range samples {
+		if i > 0 && owners[i] == owners[i-1] {
+			ranges[len(ranges)-1].End = p.T
+			continue
+		}
+		ranges = append(ranges, ReplicaRange{Backend: s.replicas[owners[i]].Name(), Start: p.T, End: p.T})
+	}
+	return ranges
+}
+
+func collectSamples(it SeriesIterator) ([]value.Point, error) {
+	var samples []value.Point
+	for it.Next() {
+		var p value.Point
+		p.T, p.V = it.At()
+		_, p.H = it.AtHistogram()
+		samples = append(samples, p)
+	}
+	return samples, it.Err()
+}
+
+// sampleInterval infers the interval between the samples of a series, as
+// the median spacing of its samples. It returns 0 for less than two samples.
+func sampleInterval(samples []value.Point) int64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	deltas := make([]int64, 0, len(samples)-1)
+	for i := 1; i < len(samples); i++ {
+		deltas = append(deltas, samples[i].T-samples[i-1].T)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+	return deltas[len(deltas)/2]
+}
+
+// fillGaps inserts the samples of other which fall into the gaps of samples,
+// and returns the samples along with the index of the replica each is taken
+// from. Spacings longer than 1.5 interval are gaps, as is the time before the
+// first sample and after the last one. The samples filling a gap are at least
+// half an interval away from its ends.
+func fillGaps(samples []value.Point, owners []int, other []value.Point, owner int, interval int64) ([]value.Point, []int) {
+	half := interval / 2
+	var (
+		res       = make([]value.Point, 0, len(samples))
+		resOwners = make([]int, 0, len(samples))
+		i         int
+	)
+	for _, p := range other {
+		for i < len(samples) && samples[i].T < p.T {
+			res = append(res, samples[i])
+			resOwners = append(resOwners, owners[i])
+			i++
+		}
+		prevOK := i == 0 || p.T > samples[i-1].T+half
+		nextOK := i == len(samples) || p.T < samples[i].T-half
+		inGap := i == 0 || i == len(samples) || samples[i].T-samples[i-1].T > interval*3/2
+		if prevOK && nextOK && inGap {
+			res = append(res, p)
+			resOwners = append(resOwners, owner)
+		}
+	}
+	res = append(res, samples[i:]...)
+	resOwners = append(resOwners, owners[i:]...)
+	return res, resOwners
+}
@@ -0,0 +1,296 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/promql/parser"
+)
+
+// GroupConfig configures a group of replicas holding the same data.
+type GroupConfig struct {
+	Name string
+	// ExternalLabels identify the data held by the group. Queries whose
+	// selectors all pin one of them to another value are not sent to the
+	// group. They are the default external labels of the replicas.
+	ExternalLabels labels.Labels
+	Replicas       []*ReadConfig
+	// Providers discover replicas at runtime, in addition to Replicas.
+	Providers []TargetProvider
+}
+
+// group is a set of replicas whose series are deduplicated.
+type group struct {
+	name           string
+	externalLabels labels.Labels
+	static         []*ReadConfig
+	hedge          *HedgeConfig
+	dedup          DedupMode
+	counters       CounterMode
+	conflicts      *conflictDetector // Nil if conflicts aren't detected.
+	logger         log.Logger
+
+	mtx        sync.RWMutex
+	discovered [][]*ReadConfig // Latest targets of each provider.
+	clients    map[string]*Client
+	replicas   []*Client // The clients in the order of their targets.
+	queryables []Queryable
+}
+
+// setDiscovered replaces the targets of the provider of the given index.
+func (g *group) setDiscovered(i int, targets []*ReadConfig, newClient func(*ReadConfig) (*Client, error)) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.discovered[i] = targets
+	return g.syncLocked(newClient)
+}
+
+// syncLocked creates the clients of new targets and drops those of targets
+// which are gone. Queriers already created keep using the dropped clients.
+// Targets whose client can't be created are skipped, and the first error is
+// returned.
+func (g *group) syncLocked(newClient func(*ReadConfig) (*Client, error)) error {
+	var (
+		clients    = map[string]*Client{}
+		replicas   []*Client
+		queryables []Queryable
+		firstErr   error
+	)
+	add := func(conf *ReadConfig) {
+		key := conf.URL.String() + conf.ExternalLabels.String()
+		if _, ok := clients[key]; ok {
+			return
+		}
+		c, ok := g.clients[key]
+		if !ok {
+			var err error
+			if c, err = newClient(conf); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+		}
+		clients[key] = c
+		replicas = append(replicas, c)
+		queryables = append(queryables, QueryableClient(c))
+	}
+	for _, conf := range g.static {
+		add(conf)
+	}
+	for _, targets := range g.discovered {
+		for _, conf := range targets {
+			add(conf)
+		}
+	}
+	for key, c := range g.clients {
+		if _, ok := clients[key]; !ok {
+			c.client.CloseIdleConnections()
+		}
+	}
+	g.clients = clients
+	g.replicas = replicas
+	g.queryables = queryables
+	return firstErr
+}
+
+// Querier returns a Querier deduplicating the series of the replicas of the
+// group, or hedging its reads across the replicas if configured to.
+func (g *group) Querier(ctx context.Context) (Querier, error) {
+	g.mtx.RLock()
+	replicas, queryables := g.replicas, g.queryables
+	g.mtx.RUnlock()
+
+	if len(replicas) == 0 && len(g.discovered) > 0 {
+		return noReplicasQuerier{group: g.name}, nil
+	}
+	counters, ok := CounterModeFromContext(ctx)
+	if !ok {
+		counters = g.counters
+	}
+	if g.hedge != nil && len(replicas) > 1 {
+		return &hedgedQuerier{ctx: ctx, group: g, replicas: replicas, conf: g.hedge, counters: counters, logger: g.logger}, nil
+	}
+	if (g.dedup != DedupMerge || counters != CountersNone || g.conflicts != nil) && len(replicas) > 1 {
+		return &dedupQuerier{ctx: ctx, group: g, replicas: replicas, counters: counters}, nil
+	}
+
+	queriers := make([]Querier, 0, len(queryables))
+	for _, queryable := range queryables {
+		q, err := queryable.Querier(ctx)
+		if err != nil {
+			return nil, err
+		}
+		queriers = append(queriers, q)
+	}
+	return NewMergeQuerier(queriers), nil
+}
+
+// ErrNoReplicas is the error of the queries of a group whose providers have
+// discovered no replica.
+var ErrNoReplicas = errors.New("no replicas")
+
+// noReplicasQuerier is the Querier of a group whose providers have
+// discovered no replica. Its queries fail rather than silently returning no
+// series.
+type noReplicasQuerier struct {
+	group string
+}
+
+// Select implements Querier.
+func (q noReplicasQuerier) Select(*SelectParams) (SeriesSet, error) {
+	return nil, fmt.Errorf("group %q: %w", q.group, ErrNoReplicas)
+}
+
+// LabelValues implements Querier.
+func (q noReplicasQuerier) LabelValues(string, ...string) ([]string, error) {
+	return nil, fmt.Errorf("group %q: %w", q.group, ErrNoReplicas)
+}
+
+// Close implements Querier.
+func (q noReplicasQuerier) Close() error {
+	return nil
+}
+
+// matchesExternalLabels returns whether any of the given selectors can select
+// series of a backend with the given external labels. Selectors which can't
+// be parsed match every backend, for it to report the error.
+func matchesExternalLabels(ls labels.Labels, selectors ...string) bool {
+	if len(ls) == 0 {
+		return true
+	}
+	sels, ok := parseSelectors(selectors)
+	return !ok || matchesSelectors(ls, sels)
+}
+
+// parseSelectors returns the vector selectors of the given expressions, and
+// false if any can't be parsed or has none.
+func parseSelectors(exprs []string) ([]parser.Selector, bool) {
+	var res []parser.Selector
+	for _, s := range exprs {
+		sels, err := parser.FindSelectors(s)
+		if err != nil || len(sels) == 0 {
+			return nil, false
+		}
+		res = append(res, sels...)
+	}
+	return res, true
+}
+
+// matchesSelectors returns whether any of the given selectors can select
+// series with the given external labels.
+func matchesSelectors(ls labels.Labels, sels []parser.Selector) bool {
+	for _, sel := range sels {
+		if matchesSelector(ls, sel) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSelector(ls labels.Labels, sel parser.Selector) bool {
+	for _, m := range sel.Matchers {
+		if ls.Has(m.Name) && !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupQuerier unions the series of groups of replicas, sending each query
+// only to the groups it can select series of.
+type groupQuerier struct {
+	groups   []*group
+	queriers []Querier
+}
+
+// route returns the indexes of the groups matching the given selectors.
+func (q *groupQuerier) route(selectors ...string) []int {
+	// The selectors are parsed once for all the groups.
+	sels, ok := parseSelectors(selectors)
+	routed := make([]int, 0, len(q.groups))
+	for i, g := range q.groups {
+		if len(g.externalLabels) == 0 || !ok || matchesSelectors(g.externalLabels, sels) {
+			routed = append(routed, i)
+		}
+	}
+	return routed
+}
+
+// Select implements Querier. The groups hold different data, so the series
+// returned by several groups, e.g. aggregated across their external labels,
+// fail the query rather than being merged as replicas.
+func (q *groupQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	routed := q.route(p.Query)
+	sets := make([]SeriesSet, 0, len(routed))
+	groups := make([]*group, 0, len(routed))
+	for _, i := range routed {
+		set, err := q.queriers[i].Select(p)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+		groups = append(groups, q.groups[i])
+	}
+	switch len(sets) {
+	case 0:
+		return NoopSeriesSet(), nil
+	case 1:
+		return sets[0], nil
+	}
+	return &unionSeriesSet{merge: newMergeSeriesSet(sets), groups: groups}, nil
+}
+
+// LabelValues implements Querier.
+func (q *groupQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	if len(selectors) == 0 {
+		return NewMergeQuerier(q.queriers).LabelValues(name)
+	}
+	routed := q.route(selectors...)
+	queriers := make([]Querier, 0, len(routed))
+	for _, i := range routed {
+		queriers = append(queriers, q.queriers[i])
+	}
+	return NewMergeQuerier(queriers).LabelValues(name, selectors...)
+}
+
+// Close implements Querier.
+func (q *groupQuerier) Close() error {
+	return NewMergeQuerier(q.queriers).Close()
+}
+
+// unionSeriesSet unions the series of the sets of groups, failing on the
+// series returned by several groups.
+type unionSeriesSet struct {
+	merge  *mergeSeriesSet
+	groups []*group // Of the sets.
+	err    error
+}
+
+func (s *unionSeriesSet) Next() bool {
+	if s.err != nil || !s.merge.Next() {
+		return false
+	}
+	if sets := s.merge.currentSets; len(sets) > 1 {
+		s.err = fmt.Errorf("series %s returned by groups %q and %q, whose series can't be merged", s.merge.currentLabels,
+			s.groups[sets[0].index].name, s.groups[sets[1].index].name)
+		return false
+	}
+	return true
+}
+
+func (s *unionSeriesSet) At() Series {
+	return s.merge.currentSets[0].At()
+}
+
+func (s *unionSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.merge.Err()
+}
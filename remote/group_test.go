@@ -0,0 +1,30 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func TestMatchesExternalLabels(t *testing.T) {
+	ls := labels.FromStrings("cluster", "eu-1")
+	for _, tc := range []struct {
+		selectors []string
+		expected  bool
+	}{
+		{[]string{`up`}, true},
+		{[]string{`up{cluster="eu-1"}`}, true},
+		{[]string{`up{cluster="us-1"}`}, false},
+		{[]string{`up{cluster=~"eu-.*"}`}, true},
+		{[]string{`up{cluster=~"eu"}`}, false},
+		{[]string{`up{cluster!~"eu-.*"}`}, false},
+		{[]string{`up{cluster="us-1"}`, `up{cluster="eu-1"}`}, true},
+		{[]string{`sum(up{cluster="us-1"}) + sum(up{cluster="eu-1"})`}, true},
+		// Left to the backends to report the errors.
+		{[]string{`up{cluster=~"("}`}, true},
+	} {
+		if got := matchesExternalLabels(ls, tc.selectors...); got != tc.expected {
+			t.Errorf("%v: expected %t, got %t", tc.selectors, tc.expected, got)
+		}
+	}
+}
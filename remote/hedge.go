@@ -0,0 +1,248 @@
+package remote
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// DefaultHedgePercentile is the default percentile of the latencies of a
+	// replica after which the other replicas are queried.
+	DefaultHedgePercentile = 0.95
+	// DefaultHedgeMaxDelay is the default longest wait for a replica before
+	// querying the other replicas.
+	DefaultHedgeMaxDelay = time.Second
+
+	// latencyWindow is the number of recent request latencies kept per
+	// backend, and minLatencies the number needed to rely on them.
+	latencyWindow = 128
+	minLatencies  = 10
+)
+
+// HedgeConfig configures hedged reads: the replicas of a group are queried
+// one first, and the others only if it fails or doesn't answer in time. The
+// first answer is used.
+type HedgeConfig struct {
+	// Percentile of the recent latencies of the replica queried first after
+	// which the other replicas are queried, DefaultHedgePercentile if 0.
+	Percentile float64
+	// MinDelay and MaxDelay bound the wait for the replica queried first.
+	// Until the replica has enough latencies recorded, MaxDelay is waited.
+	// MaxDelay is DefaultHedgeMaxDelay if 0.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// PreferFastest queries the replica of the lowest median latency first,
+	// rather than the first replica of the group.
+	PreferFastest bool
+	// FillGaps queries the other replicas after the first answer as well, and
+	// fills the gaps of the answer with their series. It trades latency for
+	// completeness, and only saves the time of failing or slow replicas.
+	FillGaps bool
+}
+
+// latencies keeps the recent latencies of a backend.
+type latencies struct {
+	mtx  sync.Mutex
+	ring [latencyWindow]time.Duration
+	n    int // Number of latencies recorded.
+}
+
+func (l *latencies) observe(d time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.ring[l.n%latencyWindow] = d
+	l.n++
+}
+
+// quantile returns the q-quantile of the recent latencies, and false if too
+// few were recorded.
+func (l *latencies) quantile(q float64) (time.Duration, bool) {
+	l.mtx.Lock()
+	n := l.n
+	if n > latencyWindow {
+		n = latencyWindow
+	}
+	recent := append([]time.Duration(nil), l.ring[:n]...)
+	l.mtx.Unlock()
+
+	if n < minLatencies {
+		return 0, false
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[int(q*float64(n-1))], true
+}
+
+type hedgeKey struct{}
+
+// hedgeState tells the requests of a hedged read whether they were canceled
+// because another replica answered.
+type hedgeState struct {
+	parent context.Context
+	done   int32 // Set atomically once the read has its answer.
+}
+
+// canceledByHedging returns whether the request of ctx was canceled because
+// another replica answered a hedged read, rather than failed.
+func canceledByHedging(ctx context.Context) bool {
+	s, ok := ctx.Value(hedgeKey{}).(*hedgeState)
+	return ok && ctx.Err() == context.Canceled && atomic.LoadInt32(&s.done) == 1 && s.parent.Err() == nil
+}
+
+// hedgedQuerier queries the replicas of a group as configured by a
+// HedgeConfig.
+type hedgedQuerier struct {
+	ctx      context.Context
+	replicas []*Client
+	group    *group
+	conf     *HedgeConfig
+	counters CounterMode
+	logger   log.Logger
+}
+
+// order returns the replicas in the order they are queried.
+func (q *hedgedQuerier) order() []*Client {
+	replicas := append([]*Client(nil), q.replicas...)
+	if !q.conf.PreferFastest {
+		return replicas
+	}
+	medians := make(map[*Client]time.Duration, len(replicas))
+	for _, c := range replicas {
+		// Replicas without enough latencies come last, the requests of slow
+		// replicas being canceled before they complete.
+		if d, ok := c.latencies.quantile(0.5); ok {
+			medians[c] = d
+		} else {
+			medians[c] = math.MaxInt64
+		}
+	}
+	sort.SliceStable(replicas, func(i, j int) bool { return medians[replicas[i]] < medians[replicas[j]] })
+	return replicas
+}
+
+// delay returns the time to wait for the given replica before querying the
+// others.
+func (q *hedgedQuerier) delay(c *Client) time.Duration {
+	max := q.conf.MaxDelay
+	if max == 0 {
+		max = DefaultHedgeMaxDelay
+	}
+	p := q.conf.Percentile
+	if p == 0 {
+		p = DefaultHedgePercentile
+	}
+	d, ok := c.latencies.quantile(p)
+	switch {
+	case !ok || d > max:
+		return max
+	case d < q.conf.MinDelay:
+		return q.conf.MinDelay
+	default:
+		return d
+	}
+}
+
+type hedgedResult struct {
+	replica int
+	set     SeriesSet
+	err     error
+}
+
+// Select implements Querier.
+func (q *hedgedQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	replicas := q.order()
+	// The series sets of the clients are decoded before being returned, so
+	// the requests still in flight are canceled once done.
+	state := &hedgeState{parent: q.ctx}
+	ctx, cancel := context.WithCancel(context.WithValue(q.ctx, hedgeKey{}, state))
+	defer func() {
+		atomic.StoreInt32(&state.done, 1)
+		cancel()
+	}()
+
+	results := make(chan hedgedResult, len(replicas))
+	var started, pending int
+	startNext := func() {
+		i := started
+		started++
+		pending++
+		go func() {
+			set, err := (&querier{ctx: ctx, client: replicas[i]}).Select(p)
+			results <- hedgedResult{replica: i, set: set, err: err}
+		}()
+	}
+	startRest := func() {
+		for started < len(replicas) {
+			startNext()
+		}
+	}
+
+	startNext()
+	timer := time.NewTimer(q.delay(replicas[0]))
+	defer timer.Stop()
+
+	var (
+		first    *hedgedResult
+		firstErr error
+	)
+	for first == nil && pending > 0 {
+		select {
+		case <-timer.C:
+			startRest()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				startRest()
+				continue
+			}
+			first = &r
+		}
+	}
+	if first == nil {
+		return nil, firstErr
+	}
+	if !q.conf.FillGaps {
+		return first.set, nil
+	}
+
+	// The first answer wins on conflicts, the others fill its gaps in the
+	// order of the replicas.
+	startRest()
+	sets := make([]SeriesSet, len(replicas))
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err != nil {
+			level.Warn(q.logger).Log("msg", "Failed to fill gaps from replica", "backend", replicas[r.replica].Name(), "err", r.err)
+			continue
+		}
+		sets[r.replica] = r.set
+	}
+	merged := []SeriesSet{first.set}
+	mergedReplicas := []*Client{replicas[first.replica]}
+	for i, set := range sets {
+		if set != nil && i != first.replica {
+			merged = append(merged, set)
+			mergedReplicas = append(mergedReplicas, replicas[i])
+		}
+	}
+	return newDedupSeriesSet(q.ctx, q.group, merged, mergedReplicas, q.counters), nil
+}
+
+// LabelValues implements Querier, with the values of all the replicas.
+func (q *hedgedQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	return NewMergeQuerier(replicaQueriers(q.ctx, q.replicas)).LabelValues(name, selectors...)
+}
+
+// Close implements Querier and is a noop.
+func (q *hedgedQuerier) Close() error {
+	return nil
+}
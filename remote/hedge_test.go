@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+)
+
+func newTestClient(t *testing.T, index int, h http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(index, &ClientConfig{URL: &config_util.URL{URL: u}, Timeout: model.Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func emptyVector(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+}
+
+func TestHedgedReadCanceledReplica(t *testing.T) {
+	slow := newTestClient(t, 0, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		emptyVector(w, r)
+	})
+	fast := newTestClient(t, 1, emptyVector)
+
+	stats := &Stats{}
+	q := &hedgedQuerier{
+		ctx:      NewContextWithStats(context.Background(), stats),
+		replicas: []*Client{slow, fast},
+		conf:     &HedgeConfig{MaxDelay: 20 * time.Millisecond},
+	}
+	if _, err := q.Select(&SelectParams{Query: "up", Start: 0, End: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request to the slow replica is canceled once the fast one answered.
+	deadline := time.Now().Add(time.Second)
+	for len(stats.Outcomes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	var canceled *BackendOutcome
+	for _, o := range stats.Outcomes() {
+		if o.Err != nil {
+			t.Fatalf("unexpected failed outcome %+v", o)
+		}
+		if o.Backend == slow.Name() {
+			o := o
+			canceled = &o
+		}
+	}
+	if canceled == nil || !canceled.Canceled {
+		t.Fatalf("expected the request to the slow replica to be canceled, got %+v", stats.Outcomes())
+	}
+	slow.latencies.mtx.Lock()
+	n, d := slow.latencies.n, slow.latencies.ring[0]
+	slow.latencies.mtx.Unlock()
+	if n != 1 || d < 20*time.Millisecond {
+		t.Fatalf("expected the latency of the canceled request to be recorded as at least the hedge delay, got %d latencies, first %s", n, d)
+	}
+}
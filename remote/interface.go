@@ -18,6 +18,7 @@ import (
 	"errors"
 
 	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
 )
 
 // The errors exposed.
@@ -26,6 +27,7 @@ var (
 	ErrOutOfOrderSample            = errors.New("out of order sample")
 	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp")
 	ErrOutOfBounds                 = errors.New("out of bounds")
+	ErrUnsupportedQuery            = errors.New("unsupported query")
 )
 
 // A Queryable handles queries against a remote.
@@ -39,8 +41,9 @@ type Querier interface {
 	// Select returns a set of series that matches the given label matchers.
 	Select(*SelectParams) (SeriesSet, error)
 
-	// LabelValues returns all potential values for a label name.
-	LabelValues(name string) ([]string, error)
+	// LabelValues returns all potential values for a label name, among the
+	// series matching any of the given selectors, if there are some.
+	LabelValues(name string, selectors ...string) ([]string, error)
 
 	// Close releases the resources of the Querier.
 	Close() error
@@ -52,6 +55,10 @@ type SelectParams struct {
 	Start int64  // Start time for this select.
 	End   int64  // End time for this select.
 	Step  int64  // Query step size.
+
+	// LookbackDelta is the time since the last sample after which a series
+	// is stale, in seconds. The backends use their own if 0.
+	LookbackDelta int64
 }
 
 // QueryableFunc is an adapter to allow the use of ordinary functions as
@@ -86,6 +93,9 @@ type SeriesIterator interface {
 	Seek(t int64) bool
 	// At returns the current timestamp/value pair.
 	At() (t int64, v float64)
+	// AtHistogram returns the current timestamp and native histogram. The
+	// histogram is nil if the current sample is a float.
+	AtHistogram() (t int64, h *value.Histogram)
 	// Next advances the iterator by one.
 	Next() bool
 	// Err returns the current error.
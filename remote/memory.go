@@ -0,0 +1,301 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/promql/parser"
+)
+
+// DefaultMemoryLookbackDelta is the default lookback delta of the queries of
+// a MemoryStorage.
+const DefaultMemoryLookbackDelta = 5 * time.Minute
+
+// MemoryStorage is a Queryable over series held in memory, e.g. synthetic or
+// locally computed series, or the data of tests. Its queriers evaluate queries
+// as a backend would, at the query time or each step of the query range, but
+// only support single vector selectors, such as `up{job="node"}`. The other
+// queries fail if they select series of the storage.
+type MemoryStorage struct {
+	lookbackDelta int64 // In seconds.
+
+	mtx    sync.RWMutex
+	series map[uint64][]*memSeries // By hash of their labels.
+}
+
+type memSeries struct {
+	labels  labels.Labels
+	samples []value.Point
+}
+
+// NewMemoryStorage returns an empty MemoryStorage whose queries select the
+// latest sample within lookbackDelta, DefaultMemoryLookbackDelta if 0.
+func NewMemoryStorage(lookbackDelta time.Duration) *MemoryStorage {
+	if lookbackDelta == 0 {
+		lookbackDelta = DefaultMemoryLookbackDelta
+	}
+	return &MemoryStorage{
+		lookbackDelta: int64(lookbackDelta / time.Second),
+		series:        map[uint64][]*memSeries{},
+	}
+}
+
+// Append adds a sample at the time t, in seconds, to the series of the given
+// labels. The samples of a series must be appended in time order.
+func (m *MemoryStorage) Append(ls labels.Labels, t int64, v float64) error {
+	return m.append(ls, value.Point{T: t, V: v})
+}
+
+// AppendHistogram adds a native histogram sample at the time t, in seconds,
+// to the series of the given labels.
+func (m *MemoryStorage) AppendHistogram(ls labels.Labels, t int64, h *value.Histogram) error {
+	return m.append(ls, value.Point{T: t, H: h})
+}
+
+func (m *MemoryStorage) append(ls labels.Labels, p value.Point) error {
+	if err := validateLabelsAndMetricName(ls); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s := m.getOrCreate(ls)
+	if n := len(s.samples); n > 0 {
+		switch last := s.samples[n-1].T; {
+		case p.T < last:
+			return ErrOutOfOrderSample
+		case p.T == last:
+			return ErrDuplicateSampleForTimestamp
+		}
+	}
+	s.samples = append(s.samples, p)
+	return nil
+}
+
+// getOrCreate returns the series of the given labels, in any order, creating
+// it with a sorted copy of them if there is none. The caller must hold the
+// write lock.
+func (m *MemoryStorage) getOrCreate(ls labels.Labels) *memSeries {
+	if !sort.IsSorted(ls) {
+		ls = labels.New(ls...)
+	}
+	h := ls.Hash()
+	for _, s := range m.series[h] {
+		if labels.Equal(s.labels, ls) {
+			return s
+		}
+	}
+	s := &memSeries{labels: ls.Copy()}
+	m.series[h] = append(m.series[h], s)
+	return s
+}
+
+// Truncate drops the samples before the time mint, in seconds, and the series
+// left without samples.
+func (m *MemoryStorage) Truncate(mint int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for h, series := range m.series {
+		kept := series[:0]
+		for _, s := range series {
+			i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].T >= mint })
+			if i == len(s.samples) {
+				continue
+			}
+			s.samples = append([]value.Point(nil), s.samples[i:]...)
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(m.series, h)
+		} else {
+			m.series[h] = kept
+		}
+	}
+}
+
+// SelectSamples returns the series matching all the given matchers, with
+// their samples between mint and maxt included, in seconds. The series are
+// sorted by labels, those without samples in the range are left out.
+func (m *MemoryStorage) SelectSamples(matchers []*labels.Matcher, mint, maxt int64) SeriesSet {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var series []Series
+	for _, s := range m.matching(matchers) {
+		i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].T >= mint })
+		j := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].T > maxt })
+		if i < j {
+			series = append(series, &concreteSeries{
+				labels:  s.labels,
+				samples: append([]value.Point(nil), s.samples[i:j]...),
+			})
+		}
+	}
+	sort.Sort(byLabel(series))
+	return &concreteSeriesSet{series: series}
+}
+
+// matching returns the series matching all the given matchers. The caller
+// must hold the lock.
+func (m *MemoryStorage) matching(matchers []*labels.Matcher) []*memSeries {
+	var res []*memSeries
+	for _, series := range m.series {
+	Series:
+		for _, s := range series {
+			for _, lm := range matchers {
+				if !lm.Matches(s.labels.Get(lm.Name)) {
+					continue Series
+				}
+			}
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Querier implements Queryable.
+func (m *MemoryStorage) Querier(ctx context.Context) (Querier, error) {
+	return &memQuerier{storage: m}, nil
+}
+
+// memQuerier evaluates queries over a MemoryStorage.
+type memQuerier struct {
+	storage *MemoryStorage
+}
+
+// Select implements Querier. The query is evaluated at the start time of
+// instant queries, and at each step of range queries, with the lookback delta
+// of the params if set. Queries other than a
+// single vector selector fail with ErrUnsupportedQuery if none of their
+// selectors match series of the storage, for them to be answered without
+// it, and with an error otherwise, as they would miss its series.
+func (q *memQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	matchers, err := selectorMatchers(p.Query)
+	if errors.Is(err, ErrUnsupportedQuery) {
+		if sel := q.storage.selectedBy(p.Query); sel != "" {
+			return nil, fmt.Errorf("only vector selectors can be queried from memory, and %s selects series held in memory", sel)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	end := p.End
+	if p.Step == 0 {
+		end = p.Start
+	}
+	lookbackDelta := q.storage.lookbackDelta
+	if p.LookbackDelta > 0 {
+		lookbackDelta = p.LookbackDelta
+	}
+	set := q.storage.SelectSamples(matchers, p.Start-lookbackDelta+1, end)
+
+	var series []Series
+	for set.Next() {
+		s := set.At().(*concreteSeries)
+		var points []value.Point
+		for ts := p.Start; ts <= end; ts += p.Step {
+			if pt, ok := pointAt(s.samples, ts, lookbackDelta); ok {
+				pt.T = ts
+				points = append(points, pt)
+			}
+			if p.Step == 0 {
+				break
+			}
+		}
+		if len(points) > 0 {
+			series = append(series, &concreteSeries{labels: s.labels, samples: points})
+		}
+	}
+	return &concreteSeriesSet{series: series}, nil
+}
+
+// pointAt returns the latest of the given samples within the lookback delta
+// before ts, unless it is a stale marker.
+func pointAt(samples []value.Point, ts, lookbackDelta int64) (value.Point, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].T > ts })
+	if i == 0 {
+		return value.Point{}, false
+	}
+	p := samples[i-1]
+	if p.T <= ts-lookbackDelta || (p.H == nil && value.IsStaleNaN(p.V)) {
+		return value.Point{}, false
+	}
+	return p, true
+}
+
+// LabelValues implements Querier.
+func (q *memQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	matcherSets := [][]*labels.Matcher{nil}
+	if len(selectors) > 0 {
+		matcherSets = matcherSets[:0]
+		for _, s := range selectors {
+			matchers, err := selectorMatchers(s)
+			if err != nil {
+				return nil, err
+			}
+			matcherSets = append(matcherSets, matchers)
+		}
+	}
+
+	q.storage.mtx.RLock()
+	seen := map[string]struct{}{}
+	for _, matchers := range matcherSets {
+		for _, s := range q.storage.matching(matchers) {
+			if v := s.labels.Get(name); v != "" {
+				seen[v] = struct{}{}
+			}
+		}
+	}
+	q.storage.mtx.RUnlock()
+
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// Close implements Querier and is a noop.
+func (q *memQuerier) Close() error {
+	return nil
+}
+
+// selectedBy returns the first vector selector of the given expression which
+// selects series of m, or "" if none does.
+func (m *MemoryStorage) selectedBy(expr string) string {
+	sels, err := parser.FindSelectors(expr)
+	if err != nil {
+		return ""
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, sel := range sels {
+		if len(m.matching(sel.LabelMatchers())) > 0 {
+			return expr[sel.Pos:sel.End]
+		}
+	}
+	return ""
+}
+
+// selectorMatchers returns the matchers of the given vector selector. It
+// fails with ErrUnsupportedQuery if the input is a valid expression other than
+// a single vector selector, and with the parse error if it isn't valid.
+func selectorMatchers(input string) ([]*labels.Matcher, error) {
+	matchers, err := labels.ParseSelector(input)
+	if err == nil {
+		return matchers, nil
+	}
+	if sels, perr := parser.FindSelectors(input); perr != nil || len(sels) == 1 && strings.TrimSpace(input[:sels[0].Pos]+input[sels[0].End:]) == "" {
+		// Invalid, or a single vector selector failing to parse.
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: only vector selectors can be queried from memory", ErrUnsupportedQuery)
+}
@@ -0,0 +1,58 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func TestMemoryStorageQueries(t *testing.T) {
+	m := NewMemoryStorage(0)
+	if err := m.Append(labels.FromStrings("__name__", "up", "job", "node"), 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	q, err := m.Querier(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query       string
+		series      int
+		unsupported bool // Answered without the storage.
+		fails       bool
+	}{
+		{query: ` up{job="node"} `, series: 1},
+		{query: `down`, series: 0},
+		{query: `sum(down)`, unsupported: true},
+		{query: `rate(down[5m])`, unsupported: true},
+		{query: `sum(up)`, fails: true},
+		{query: `rate(up[5m])`, fails: true},
+		{query: `up offset 5m`, fails: true},
+		{query: `up{job=~"("}`, fails: true},
+		{query: `{job=""}`, fails: true},
+	} {
+		set, err := q.Select(&SelectParams{Query: tc.query, Start: 10})
+		switch {
+		case tc.unsupported:
+			if !errors.Is(err, ErrUnsupportedQuery) {
+				t.Errorf("%s: expected ErrUnsupportedQuery, got %v", tc.query, err)
+			}
+		case tc.fails:
+			if err == nil || errors.Is(err, ErrUnsupportedQuery) {
+				t.Errorf("%s: expected an error other than ErrUnsupportedQuery, got %v", tc.query, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.query, err)
+		default:
+			n := 0
+			for set.Next() {
+				n++
+			}
+			if n != tc.series {
+				t.Errorf("%s: expected %d series, got %d", tc.query, tc.series, n)
+			}
+		}
+	}
+}
@@ -15,6 +15,8 @@ package remote
 
 import (
 	"math"
+
+	"github.com/lwangrabbit/prom-query/pkg/value"
 )
 
 type noopQuerier struct{}
@@ -28,7 +30,7 @@ func (noopQuerier) Select(*SelectParams) (SeriesSet, error) {
 	return NoopSeriesSet(), nil
 }
 
-func (noopQuerier) LabelValues(name string) ([]string, error) {
+func (noopQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
 	return nil, nil
 }
 
@@ -64,6 +66,10 @@ func (noopSeriesIterator) At() (int64, float64) {
 	return math.MinInt64, 0
 }
 
+func (noopSeriesIterator) AtHistogram() (int64, *value.Histogram) {
+	return math.MinInt64, nil
+}
+
 func (noopSeriesIterator) Seek(t int64) bool {
 	return false
 }
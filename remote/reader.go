@@ -2,52 +2,346 @@ package remote
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
 )
 
 type Reader struct {
-	queryables []Queryable
+	groups    []*group
+	rewriter  QueryRewriter
+	logger    log.Logger
+	tracer    trace.TracerProvider
+	transport TransportConfig
+	hedge     *HedgeConfig
+	dedup     DedupMode
+	counters  CounterMode
+	conflicts *ConflictConfig
+	local     []Queryable
+	interner  *labels.Interner
+
+	firstTargetsTimeout time.Duration
+
+	index  int64 // Index of the next client.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// ReaderOption configures a Reader.
+type ReaderOption func(*Reader)
+
+// WithLogger sets the logger of the Reader and its backend clients.
+func WithLogger(logger log.Logger) ReaderOption {
+	return func(s *Reader) {
+		s.logger = logger
+	}
+}
+
+// WithTracerProvider sets the tracer provider of the backend clients.
+func WithTracerProvider(tp trace.TracerProvider) ReaderOption {
+	return func(s *Reader) {
+		s.tracer = tp
+	}
+}
+
+// WithQueryRewriter makes the Reader rewrite queries with r before sending
+// them to the backends.
+func WithQueryRewriter(r QueryRewriter) ReaderOption {
+	return func(s *Reader) {
+		s.rewriter = r
+	}
+}
+
+// WithTransportConfig tunes the connections to the backends and the
+// compression of their responses.
+func WithTransportConfig(tc TransportConfig) ReaderOption {
+	return func(s *Reader) {
+		s.transport = tc
+	}
+}
+
+// WithHedging hedges the reads of the replicas of each group as configured
+// by hc, rather than merging the series of all the replicas.
+func WithHedging(hc HedgeConfig) ReaderOption {
+	return func(s *Reader) {
+		s.hedge = &hc
+	}
+}
+
+// WithDedupMode sets how the series of the replicas of each group are
+// deduplicated, DedupMerge by default.
+func WithDedupMode(m DedupMode) ReaderOption {
+	return func(s *Reader) {
+		s.dedup = m
+	}
+}
+
+// WithDefaultCounterMode sets which series are merged as counters, for the
+// queries without a mode of their own, see WithCounterMode. It defaults to
+// CountersNone.
+func WithDefaultCounterMode(m CounterMode) ReaderOption {
+	return func(s *Reader) {
+		s.counters = m
+	}
+}
+
+// WithConflictDetection detects the conflicts between the replicas of each
+// group in the queries. They are recorded into the query Stats and counted,
+// see Reader.Conflicts. With WithHedging, it requires FillGaps for all the
+// replicas to answer.
+func WithConflictDetection(cc ConflictConfig) ReaderOption {
+	return func(s *Reader) {
+		s.conflicts = &cc
+	}
+}
+
+// WithFirstTargetsTimeout sets how long NewGroupedReader waits for the first
+// targets of the target providers, DefaultFirstTargetsTimeout by default. Zero
+// doesn't wait.
+func WithFirstTargetsTimeout(d time.Duration) ReaderOption {
+	return func(s *Reader) {
+		s.firstTargetsTimeout = d
+	}
+}
+
+// WithQueryable adds q as a source of series in addition to the groups of
+// backends, e.g. a MemoryStorage. Its series are merged with those of the
+// groups, as those of a group of its own without external labels. The queries
+// it fails with ErrUnsupportedQuery are answered by the groups alone.
+func WithQueryable(q Queryable) ReaderOption {
+	return func(s *Reader) {
+		s.local = append(s.local, q)
+	}
 }
 
 type ReadConfig struct {
 	URL     *config_util.URL
 	Timeout model.Duration
 	Name    string
+	// ExternalLabels are added to the series of the backend which don't have
+	// them already. They default to the external labels of the backend's group.
+	ExternalLabels labels.Labels
+}
+
+func NewReader(configs []*ReadConfig, opts ...ReaderOption) (*Reader, error) {
+	return NewGroupedReader([]*GroupConfig{{Replicas: configs}}, opts...)
+}
+
+// NewGroupedReader returns a Reader over groups of replicas. The series of
+// the replicas of a group are deduplicated, and the series of the groups are
+// unioned. The target providers of the groups run until the Reader is closed,
+// their first targets being waited for, see WithFirstTargetsTimeout.
+func NewGroupedReader(groups []*GroupConfig, opts ...ReaderOption) (*Reader, error) {
+	s := &Reader{
+		logger:              log.NewNopLogger(),
+		interner:            labels.NewInterner(0),
+		firstTargetsTimeout: DefaultFirstTargetsTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.conflicts != nil && s.hedge != nil && !s.hedge.FillGaps {
+		return nil, errors.New("conflicts can't be detected when hedging reads without filling gaps, as a single replica answers")
+	}
+	for _, gconf := range groups {
+		g := &group{
+			name:           gconf.Name,
+			externalLabels: gconf.ExternalLabels,
+			static:         gconf.Replicas,
+			discovered:     make([][]*ReadConfig, len(gconf.Providers)),
+			hedge:          s.hedge,
+			dedup:          s.dedup,
+			counters:       s.counters,
+			logger:         s.logger,
+		}
+		if s.conflicts != nil {
+			g.conflicts = &conflictDetector{tolerance: s.conflicts.tolerance()}
+		}
+		if err := g.syncLocked(s.clientFactory(g)); err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, g)
+	}
+
+	// The first targets of the providers are waited for, for the queries not
+	// to find their groups without replicas.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	var first sync.WaitGroup
+	for i, gconf := range groups {
+		for j, p := range gconf.Providers {
+			s.wg.Add(1)
+			first.Add(1)
+			go s.runProvider(ctx, s.groups[i], j, p, first.Done)
+		}
+	}
+	if s.firstTargetsTimeout <= 0 {
+		return s, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		first.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(s.firstTargetsTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		level.Warn(s.logger).Log("msg", "Timed out waiting for the first targets of the providers", "timeout", s.firstTargetsTimeout)
+	}
+	return s, nil
 }
 
-func NewReader(configs []*ReadConfig) (*Reader, error) {
-	queryables := make([]Queryable, 0, len(configs))
-	for i, conf := range configs {
-		c, err := NewClient(i, &ClientConfig{
+// DefaultFirstTargetsTimeout is how long NewGroupedReader waits for the first
+// targets of the providers by default.
+const DefaultFirstTargetsTimeout = 10 * time.Second
+
+// clientFactory returns the function creating the clients of the group.
+func (s *Reader) clientFactory(g *group) func(*ReadConfig) (*Client, error) {
+	return func(conf *ReadConfig) (*Client, error) {
+		return NewClient(int(atomic.AddInt64(&s.index, 1)-1), &ClientConfig{
 			URL:              conf.URL,
 			Timeout:          conf.Timeout,
 			HTTPClientConfig: config_util.HTTPClientConfig{},
+			Logger:           s.logger,
+			TracerProvider:   s.tracer,
+			ExternalLabels:   mergeLabels(g.externalLabels, conf.ExternalLabels),
+			Transport:        s.transport,
+			Interner:         s.interner,
 		})
-		if err != nil {
-			return nil, err
+	}
+}
+
+// runProvider updates the replicas of the group with the targets sent by the
+// provider of the given index, until ctx is done. It calls ready once the
+// first targets are set, or when returning before.
+func (s *Reader) runProvider(ctx context.Context, g *group, i int, p TargetProvider, ready func()) {
+	defer s.wg.Done()
+	var once sync.Once
+	defer once.Do(ready)
+
+	ch := make(chan []*ReadConfig)
+	go p.Run(ctx, ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-ch:
+			if err := g.setDiscovered(i, targets, s.clientFactory(g)); err != nil {
+				level.Error(s.logger).Log("msg", "Failed to create client for discovered target", "group", g.name, "err", err)
+			}
+			once.Do(ready)
 		}
-		q := QueryableClient(c)
-		queryables = append(queryables, q)
 	}
-	return &Reader{queryables: queryables}, nil
+}
+
+// mergeLabels returns the union of the given labels. On conflicts the
+// labels of o win.
+func mergeLabels(ls, o labels.Labels) labels.Labels {
+	b := labels.NewBuilder(ls)
+	for _, l := range o {
+		b.Set(l.Name, l.Value)
+	}
+	return b.Labels()
 }
 
 func (s *Reader) Querier(ctx context.Context) (Querier, error) {
-	querables := s.queryables
-	queriers := make([]Querier, 0, len(querables))
-	for _, queryable := range querables {
-		q, err := queryable.Querier(ctx)
+	queriers := make([]Querier, 0, len(s.groups))
+	for _, g := range s.groups {
+		q, err := g.Querier(ctx)
 		if err != nil {
 			return nil, err
 		}
 		queriers = append(queriers, q)
 	}
-	return NewMergeQuerier(queriers), nil
+
+	var q Querier
+	if len(s.groups) == 1 && len(s.groups[0].externalLabels) == 0 {
+		q = queriers[0]
+	} else {
+		q = &groupQuerier{groups: s.groups, queriers: queriers}
+	}
+	if len(s.local) > 0 {
+		local := []Querier{q}
+		for _, queryable := range s.local {
+			lq, err := queryable.Querier(ctx)
+			if err != nil {
+				return nil, err
+			}
+			local = append(local, &localQuerier{Querier: lq})
+		}
+		q = NewMergeQuerier(local)
+	}
+	if s.rewriter != nil {
+		q = &rewriteQuerier{Querier: q, ctx: ctx, rewriter: s.rewriter}
+	}
+	return q, nil
+}
+
+// localQuerier is a Querier of a Reader source other than its groups, which
+// contributes no series to the queries it doesn't support.
+type localQuerier struct {
+	Querier
+}
+
+// Select implements Querier.
+func (q *localQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	set, err := q.Querier.Select(p)
+	if errors.Is(err, ErrUnsupportedQuery) {
+		return NoopSeriesSet(), nil
+	}
+	return set, err
+}
+
+// LabelValues implements Querier.
+func (q *localQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	values, err := q.Querier.LabelValues(name, selectors...)
+	if errors.Is(err, ErrUnsupportedQuery) {
+		return nil, nil
+	}
+	return values, err
+}
+
+// BackendBytes is the total size of the responses of a backend.
+type BackendBytes struct {
+	Backend string
+	// Received is the size of the responses as received, Decoded once
+	// decompressed.
+	Received int64
+	Decoded  int64
+}
+
+// ResponseBytes returns the response sizes of the current backends of the
+// groups.
+func (s *Reader) ResponseBytes() []BackendBytes {
+	var res []BackendBytes
+	for _, g := range s.groups {
+		g.mtx.RLock()
+		for _, c := range g.clients {
+			received, decoded := c.ResponseBytes()
+			res = append(res, BackendBytes{Backend: c.Name(), Received: received, Decoded: decoded})
+		}
+		g.mtx.RUnlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Backend < res[j].Backend })
+	return res
 }
 
+// Close stops the discovery of targets.
 func (s *Reader) Close() error {
+	s.cancel()
+	s.wg.Wait()
 	return nil
 }
 
@@ -73,25 +367,30 @@ type querier struct {
 // Select implements remote.Querier and uses the given matchers to read series
 // sets from the Client.
 func (q *querier) Select(p *SelectParams) (SeriesSet, error) {
+	if !matchesExternalLabels(q.client.externalLabels, p.Query) {
+		return NoopSeriesSet(), nil
+	}
 	if p.Step == 0 {
-		res, err := q.client.QueryInstant(q.ctx, p.Query, p.Start)
+		res, err := q.client.queryInstant(q.ctx, p.Query, p.Start, p.LookbackDelta)
 		if err != nil {
 			return nil, err
 		}
 		return FromInstantQueryResult(res), nil
 	}
 
-	res, err := q.client.QueryRange(q.ctx, p.Query, p.Start, p.End, int(p.Step))
+	res, err := q.client.queryRange(q.ctx, p.Query, p.Start, p.End, int(p.Step), p.LookbackDelta)
 	if err != nil {
 		return nil, err
 	}
 	return FromRangeQueryResult(res), nil
 }
 
-// LabelValues implements remote.Querier and is a noop.
-func (q *querier) LabelValues(name string) ([]string, error) {
-	// TODO implement?
-	return nil, nil
+// LabelValues implements remote.Querier.
+func (q *querier) LabelValues(name string, selectors ...string) ([]string, error) {
+	if len(selectors) > 0 && !matchesExternalLabels(q.client.externalLabels, selectors...) {
+		return nil, nil
+	}
+	return q.client.LabelValues(q.ctx, name, selectors)
 }
 
 // Close implements remote.Querier and is a noop.
@@ -0,0 +1,325 @@
+package remote_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/promtest"
+	"github.com/lwangrabbit/prom-query/pkg/value"
+	"github.com/lwangrabbit/prom-query/remote"
+)
+
+var upNode = labels.FromStrings("__name__", "up", "job", "node")
+
+// selectPoints runs the range query of up from 0 to 5m by 1m on r, and
+// returns the points of each series by labels.
+func selectPoints(r *remote.Reader) (map[string][]value.Point, error) {
+	q, err := r.Querier(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	set, err := q.Select(&remote.SelectParams{Query: "up", Start: 0, End: 300, Step: 60})
+	if err != nil {
+		return nil, err
+	}
+	res := map[string][]value.Point{}
+	for set.Next() {
+		s := set.At()
+		var points []value.Point
+		it := s.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			points = append(points, value.Point{T: t, V: v})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		res[s.Labels().String()] = points
+	}
+	return res, set.Err()
+}
+
+func TestReaderDedup(t *testing.T) {
+	a := promtest.NewServer([]promtest.Series{{
+		Labels: upNode,
+		Points: []value.Point{{T: 0, V: 1}, {T: 60, V: 2}},
+	}}, promtest.WithLookbackDelta(time.Minute))
+	defer a.Close()
+	b := promtest.NewServer([]promtest.Series{{
+		Labels: upNode,
+		Points: []value.Point{{T: 180, V: 4}, {T: 240, V: 5}, {T: 300, V: 6}},
+	}}, promtest.WithLookbackDelta(time.Minute))
+	defer b.Close()
+
+	r, err := remote.NewReader([]*remote.ReadConfig{a.ReadConfig(time.Second), b.ReadConfig(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := selectPoints(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []value.Point{{T: 0, V: 1}, {T: 60, V: 2}, {T: 180, V: 4}, {T: 240, V: 5}, {T: 300, V: 6}}
+	if len(got) != 1 || !equalPoints(got[upNode.String()], expected) {
+		t.Fatalf("expected a single series %v, got %v", expected, got)
+	}
+}
+
+func TestReaderPartialFailure(t *testing.T) {
+	series := []promtest.Series{{Labels: upNode, Points: []value.Point{{T: 0, V: 1}}}}
+	ok := promtest.NewServer(series)
+	defer ok.Close()
+	failing := promtest.NewServer(series, promtest.WithError(http.StatusInternalServerError))
+	defer failing.Close()
+	configs := []*remote.ReadConfig{failing.ReadConfig(time.Second), ok.ReadConfig(time.Second)}
+
+	// Merged replicas fail with any of them.
+	r, err := remote.NewReader(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := selectPoints(r); err == nil {
+		t.Fatal("expected the query to fail with a failing replica")
+	}
+
+	// Hedged reads are answered by the replicas which don't fail.
+	hedged, err := remote.NewReader(configs, remote.WithHedging(remote.HedgeConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hedged.Close()
+	got, err := selectPoints(hedged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[upNode.String()]) != 5 {
+		t.Fatalf("expected the series of the other replica, got %v", got)
+	}
+	if failing.Requests() < 2 {
+		t.Fatalf("expected the failing replica to be queried first")
+	}
+}
+
+func TestReaderTimeout(t *testing.T) {
+	slow := promtest.NewServer(nil, promtest.WithLatency(5*time.Second))
+	defer slow.Close()
+
+	r, err := remote.NewReader([]*remote.ReadConfig{slow.ReadConfig(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	start := time.Now()
+	if _, err := selectPoints(r); err == nil {
+		t.Fatal("expected the query to time out")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the query to time out after 50ms, took %s", d)
+	}
+}
+
+func TestReaderConflicts(t *testing.T) {
+	a := promtest.NewServer([]promtest.Series{{
+		Labels: upNode,
+		Points: []value.Point{{T: 0, V: 1000}, {T: 60, V: 2000}},
+	}})
+	defer a.Close()
+	b := promtest.NewServer([]promtest.Series{{
+		Labels: upNode,
+		Points: []value.Point{{T: 0, V: 1000.5}, {T: 60, V: 2100}},
+	}})
+	defer b.Close()
+	configs := []*remote.ReadConfig{a.ReadConfig(time.Second), b.ReadConfig(time.Second)}
+
+	// Only the values differing by more than the default tolerance conflict.
+	r, err := remote.NewReader(configs, remote.WithConflictDetection(remote.ConflictConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stats := &remote.Stats{}
+	q, err := r.Querier(remote.NewContextWithStats(context.Background(), stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	set, err := q.Select(&remote.SelectParams{Query: "up", Start: 0, End: 60, Step: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for set.Next() {
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	conflicts := stats.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Count != 1 || conflicts[0].Timestamp != 60 {
+		t.Fatalf("expected a single conflict at 60, got %v", conflicts)
+	}
+
+	// A single replica answers hedged reads without gap filling.
+	if _, err := remote.NewReader(configs, remote.WithConflictDetection(remote.ConflictConfig{}), remote.WithHedging(remote.HedgeConfig{})); err == nil {
+		t.Fatal("expected conflict detection to be rejected with hedged reads")
+	}
+	r, err = remote.NewReader(configs, remote.WithConflictDetection(remote.ConflictConfig{}), remote.WithHedging(remote.HedgeConfig{FillGaps: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestReaderGroupConflicts(t *testing.T) {
+	newReader := func(eu, us labels.Labels) *remote.Reader {
+		var groups []*remote.GroupConfig
+		for i, ls := range []labels.Labels{eu, us} {
+			srv := promtest.NewServer([]promtest.Series{{Labels: ls, Points: []value.Point{{T: 0, V: float64(i)}}}})
+			t.Cleanup(srv.Close)
+			groups = append(groups, &remote.GroupConfig{
+				Name:           []string{"eu", "us"}[i],
+				ExternalLabels: labels.FromStrings("cluster", []string{"eu", "us"}[i]),
+				Replicas:       []*remote.ReadConfig{srv.ReadConfig(time.Second)},
+			})
+		}
+		r, err := remote.NewGroupedReader(groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+
+	// The series of the groups are told apart by their external labels.
+	got, err := selectPoints(newReader(upNode, upNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the series of both groups, got %v", got)
+	}
+
+	// The series returned by both groups aren't merged as replicas.
+	upEU := labels.FromStrings("__name__", "up", "cluster", "eu", "job", "node")
+	if _, err := selectPoints(newReader(upEU, upEU)); err == nil {
+		t.Fatal("expected a series returned by two groups to fail the query")
+	}
+}
+
+func equalPoints(a, b []value.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].T != b[i].T || a[i].V != b[i].V {
+			return false
+		}
+	}
+	return true
+}
+
+// staticProvider sends the same targets once, after a delay.
+type staticProvider struct {
+	targets []*remote.ReadConfig
+	delay   time.Duration
+}
+
+func (p staticProvider) Run(ctx context.Context, ch chan<- []*remote.ReadConfig) {
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case ch <- p.targets:
+	case <-ctx.Done():
+	}
+}
+
+func TestReaderProviders(t *testing.T) {
+	srv := promtest.NewServer([]promtest.Series{{Labels: upNode, Points: []value.Point{{T: 0, V: 1}}}})
+	defer srv.Close()
+
+	// The first targets are set before the Reader is returned.
+	r, err := remote.NewGroupedReader([]*remote.GroupConfig{{
+		Providers: []remote.TargetProvider{staticProvider{targets: []*remote.ReadConfig{srv.ReadConfig(time.Second)}, delay: 50 * time.Millisecond}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := selectPoints(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the series of the discovered replica, got %v", got)
+	}
+
+	// The queries of a group without replicas fail.
+	empty, err := remote.NewGroupedReader([]*remote.GroupConfig{{
+		Providers: []remote.TargetProvider{staticProvider{}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if _, err := selectPoints(empty); !errors.Is(err, remote.ErrNoReplicas) {
+		t.Fatalf("expected ErrNoReplicas, got %v", err)
+	}
+}
+
+func TestFileProviderDefaultTimeout(t *testing.T) {
+	srv := promtest.NewServer([]promtest.Series{{Labels: upNode, Points: []value.Point{{T: 0, V: 1}}}})
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "targets.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"targets": ["`+srv.URL+`"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The targets of a provider without timeout get the default one, rather
+	// than none which fails every request.
+	p, err := remote.NewFileProvider(&remote.FileConfig{Files: []string{path}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := remote.NewGroupedReader([]*remote.GroupConfig{{Providers: []remote.TargetProvider{p}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := selectPoints(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the series of the discovered replica, got %v", got)
+	}
+}
+
+func TestReaderFirstTargetsTimeout(t *testing.T) {
+	srv := promtest.NewServer([]promtest.Series{{Labels: upNode, Points: []value.Point{{T: 0, V: 1}}}})
+	defer srv.Close()
+
+	start := time.Now()
+	r, err := remote.NewGroupedReader([]*remote.GroupConfig{{
+		Providers: []remote.TargetProvider{staticProvider{targets: []*remote.ReadConfig{srv.ReadConfig(time.Second)}, delay: time.Second}},
+	}}, remote.WithFirstTargetsTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the first targets to be waited for 10ms, waited %s", d)
+	}
+	if _, err := selectPoints(r); !errors.Is(err, remote.ErrNoReplicas) {
+		t.Fatalf("expected ErrNoReplicas before the first targets, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
+	"github.com/lwangrabbit/prom-query/promql/parser"
+)
+
+// QueryRewriter rewrites the queries sent to the backends on behalf of the
+// caller identified by the context the Querier was created with.
+type QueryRewriter interface {
+	// RewriteQuery returns the PromQL query to send in place of the given one.
+	RewriteQuery(ctx context.Context, query string) (string, error)
+	// RewriteSelectors returns the series selectors to restrict label
+	// lookups with in place of the given ones.
+	RewriteSelectors(ctx context.Context, selectors []string) ([]string, error)
+}
+
+// ErrUnknownTenant is returned by TenantLabels for the queries of tenants it
+// has no entry for.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// TenantLabels is a QueryRewriter which restricts the queries of each tenant
+// to the series having the tenant's labels, by injecting equality matchers
+// into every selector. The queries of tenants missing from the map, including
+// the queries without tenant unless the empty tenant has an entry, fail with
+// ErrUnknownTenant. A tenant whose entry has no labels is not restricted.
+//
+// The series lookups of Prometheus have no counterpart among the Querier
+// methods, only queries and label values lookups are rewritten.
+type TenantLabels map[string]labels.Labels
+
+// labels returns the labels enforced on the tenant of ctx.
+func (t TenantLabels) labels(ctx context.Context) (labels.Labels, error) {
+	id := tenant.FromContext(ctx)
+	ls, ok := t[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTenant, id)
+	}
+	return ls, nil
+}
+
+// RewriteQuery implements QueryRewriter.
+func (t TenantLabels) RewriteQuery(ctx context.Context, query string) (string, error) {
+	ls, err := t.labels(ctx)
+	if err != nil || len(ls) == 0 {
+		return query, err
+	}
+	return parser.EnforceLabels(query, ls)
+}
+
+// RewriteSelectors implements QueryRewriter.
+func (t TenantLabels) RewriteSelectors(ctx context.Context, selectors []string) ([]string, error) {
+	ls, err := t.labels(ctx)
+	if err != nil || len(ls) == 0 {
+		return selectors, err
+	}
+	if len(selectors) == 0 {
+		return []string{parser.EnforcedMatchers(nil, ls)}, nil
+	}
+	res := make([]string, 0, len(selectors))
+	for _, s := range selectors {
+		r, err := parser.EnforceLabels(s, ls)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// rewriteQuerier rewrites the queries of the wrapped Querier.
+type rewriteQuerier struct {
+	Querier
+	ctx      context.Context
+	rewriter QueryRewriter
+}
+
+// Select implements Querier.
+func (q *rewriteQuerier) Select(p *SelectParams) (SeriesSet, error) {
+	qs, err := q.rewriter.RewriteQuery(q.ctx, p.Query)
+	if err != nil {
+		return nil, err
+	}
+	rp := *p
+	rp.Query = qs
+	return q.Querier.Select(&rp)
+}
+
+// LabelValues implements Querier.
+func (q *rewriteQuerier) LabelValues(name string, selectors ...string) ([]string, error) {
+	selectors, err := q.rewriter.RewriteSelectors(q.ctx, selectors)
+	if err != nil {
+		return nil, err
+	}
+	return q.Querier.LabelValues(name, selectors...)
+}
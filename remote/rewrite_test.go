@@ -0,0 +1,65 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+	"github.com/lwangrabbit/prom-query/pkg/tenant"
+)
+
+func TestTenantLabels(t *testing.T) {
+	tl := TenantLabels{
+		"team-a": labels.FromStrings("namespace", "a"),
+		"admin":  nil,
+	}
+	for _, tc := range []struct {
+		tenant   string
+		expected string
+		err      error
+	}{
+		{tenant: "team-a", expected: `up{namespace="a"}`},
+		{tenant: "admin", expected: `up`},
+		{tenant: "team-b", err: ErrUnknownTenant},
+		{tenant: "", err: ErrUnknownTenant},
+	} {
+		ctx := tenant.WithID(context.Background(), tc.tenant)
+		q, err := tl.RewriteQuery(ctx, "up")
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("tenant %q: expected error %v, got %v", tc.tenant, tc.err, err)
+		}
+		if q2, err := tl.RewriteSelectors(ctx, []string{"up"}); !errors.Is(err, tc.err) {
+			t.Fatalf("tenant %q: expected error %v for selectors, got %v", tc.tenant, tc.err, err)
+		} else if err == nil && q2[0] != tc.expected {
+			t.Fatalf("tenant %q: expected selector %s, got %s", tc.tenant, tc.expected, q2[0])
+		}
+		if err == nil && q != tc.expected {
+			t.Fatalf("tenant %q: expected %s, got %s", tc.tenant, tc.expected, q)
+		}
+	}
+}
+
+func TestTenantLabelsKeywords(t *testing.T) {
+	tl := TenantLabels{"team-a": labels.FromStrings("namespace", "a")}
+	ctx := tenant.WithID(context.Background(), "team-a")
+	for _, tc := range []struct {
+		query, expected string
+	}{
+		{`by`, `by{namespace="a"}`},
+		{`sum by (job) (offset{})`, `sum by (job) (offset{namespace="a"})`},
+		{`up{namespace!="a"}`, `up{namespace="a"}`},
+	} {
+		q, err := tl.RewriteQuery(ctx, tc.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if q != tc.expected {
+			t.Fatalf("%s: expected %s, got %s", tc.query, tc.expected, q)
+		}
+	}
+	// Queries whose selectors can't all be found aren't sent.
+	if q, err := tl.RewriteQuery(ctx, `up up`); err == nil {
+		t.Fatalf("expected an error, got %s", q)
+	}
+}
@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendOutcome is the outcome of a single request to a backend.
+type BackendOutcome struct {
+	Backend  string
+	Path     string
+	Duration time.Duration
+	// ResponseBytes is the size of the response as received, DecodedBytes
+	// once decompressed.
+	ResponseBytes int64
+	DecodedBytes  int64
+	Err           error
+	// Canceled is set if the request was canceled by a hedged read once
+	// another replica answered, Err being nil then.
+	Canceled bool
+}
+
+// Stats collects what happened on the backends while executing a query.
+// It is safe for concurrent use.
+type Stats struct {
+	mtx       sync.Mutex
+	outcomes  []BackendOutcome
+	coverage  []SeriesCoverage // The first maxCoverage ones.
+	conflicts []Conflict       // The first maxConflicts ones.
+	// Index in conflicts of each conflict kept, by seriesConflict.
+	conflictIndex map[seriesConflict]int
+	// Series with conflicts of each kind, and their number.
+	conflictSeries map[seriesConflict]struct{}
+	conflictCounts map[ConflictKind]int
+}
+
+// seriesConflict identifies the conflicts of a kind of a series, and of
+// replicas if set. The sub-queries of a query split by time detect the same
+// conflicts in turn.
+type seriesConflict struct {
+	kind     ConflictKind
+	labels   string
+	backends string
+}
+
+const (
+	// maxCoverage is the number of series coverages kept by Stats.
+	maxCoverage = 100
+	// maxConflicts is the number of conflicts kept by Stats.
+	maxConflicts = 100
+)
+
+// Outcomes returns the outcomes of the backend requests recorded so far.
+func (s *Stats) Outcomes() []BackendOutcome {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]BackendOutcome(nil), s.outcomes...)
+}
+
+func (s *Stats) addOutcome(o BackendOutcome) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.outcomes = append(s.outcomes, o)
+}
+
+// Coverage returns the replicas the series deduplicated with DedupGapFill
+// were taken from, for the first hundred series taken from more than one
+// replica.
+func (s *Stats) Coverage() []SeriesCoverage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]SeriesCoverage(nil), s.coverage...)
+}
+
+func (s *Stats) addCoverage(c SeriesCoverage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.coverage) < maxCoverage {
+		s.coverage = append(s.coverage, c)
+	}
+}
+
+// Conflicts returns the first conflicts detected between replicas, up to a
+// hundred of them.
+func (s *Stats) Conflicts() []Conflict {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Conflict(nil), s.conflicts...)
+}
+
+// addConflict records c, merged with the conflict of the same series and
+// replicas recorded by another sub-query if any. It returns whether it is the
+// first conflict of its kind recorded for the series.
+func (s *Stats) addConflict(c Conflict) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.conflictIndex == nil {
+		s.conflictIndex = map[seriesConflict]int{}
+		s.conflictSeries = map[seriesConflict]struct{}{}
+		s.conflictCounts = map[ConflictKind]int{}
+	}
+
+	key := seriesConflict{kind: c.Kind, labels: c.Labels.String(), backends: strings.Join(c.Backends, ",")}
+	if i, ok := s.conflictIndex[key]; ok {
+		if i >= 0 && c.Kind == ConflictValue {
+			s.conflicts[i].Count += c.Count
+		}
+	} else if len(s.conflicts) < maxConflicts {
+		s.conflictIndex[key] = len(s.conflicts)
+		s.conflicts = append(s.conflicts, c)
+	} else {
+		s.conflictIndex[key] = -1
+	}
+
+	key.backends = ""
+	if _, ok := s.conflictSeries[key]; ok {
+		return false
+	}
+	s.conflictSeries[key] = struct{}{}
+	s.conflictCounts[c.Kind]++
+	return true
+}
+
+// Warnings returns the warnings about the results of the query, such as the
+// conflicts between replicas.
+func (s *Stats) Warnings() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var warnings []string
+	for _, kind := range []ConflictKind{ConflictMissing, ConflictValue} {
+		n := s.conflictCounts[kind]
+		if n == 0 {
+			continue
+		}
+		var example Conflict
+		for _, c := range s.conflicts {
+			if c.Kind == kind {
+				example = c
+				break
+			}
+		}
+		what := "with diverging values between replicas"
+		if kind == ConflictMissing {
+			what = "missing from some replicas"
+		}
+		warnings = append(warnings, fmt.Sprintf("%d series %s, e.g. %s", n, what, example))
+	}
+	return warnings
+}
+
+type statsKey struct{}
+
+// NewContextWithStats returns a context which makes the queriers created
+// with it record their backend requests into s.
+func NewContextWithStats(ctx context.Context, s *Stats) context.Context {
+	return context.WithValue(ctx, statsKey{}, s)
+}
+
+// StatsFromContext returns the Stats of ctx, or nil if there are none.
+func StatsFromContext(ctx context.Context) *Stats {
+	s, _ := ctx.Value(statsKey{}).(*Stats)
+	return s
+}
@@ -0,0 +1,63 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/lwangrabbit/prom-query/pkg/labels"
+)
+
+func TestStatsConflictsOfSplitQuery(t *testing.T) {
+	ls := labels.FromStrings("__name__", "up", "job", "node")
+	value := func(other string, count int) Conflict {
+		return Conflict{Kind: ConflictValue, Labels: ls, Backends: []string{"a", other}, Count: count}
+	}
+	missing := Conflict{Kind: ConflictMissing, Labels: ls, Backends: []string{"b"}}
+
+	s := &Stats{}
+	// Two sub-queries detecting the same conflicts, the series conflicting
+	// with two replicas.
+	for _, c := range []Conflict{value("b", 2), value("c", 1), missing, value("b", 3), missing} {
+		s.addConflict(c)
+	}
+
+	conflicts := s.Conflicts()
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts, got %v", conflicts)
+	}
+	if conflicts[0].Count != 5 {
+		t.Errorf("expected the counts of the sub-queries to add up to 5, got %d", conflicts[0].Count)
+	}
+	warnings := s.Warnings()
+	if len(warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %v", warnings)
+	}
+	for _, w := range warnings {
+		if w[:9] != "1 series " {
+			t.Errorf("expected a single series, got %q", w)
+		}
+	}
+}
+
+func TestConflictTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		tolerance, expected float64
+	}{
+		{0, DefaultConflictTolerance},
+		{-1, 0},
+		{0.1, 0.1},
+	} {
+		if got := (ConflictConfig{Tolerance: tc.tolerance}).tolerance(); got != tc.expected {
+			t.Errorf("tolerance %g: expected %g, got %g", tc.tolerance, tc.expected, got)
+		}
+	}
+}
+
+func TestStatsCoverageCap(t *testing.T) {
+	s := &Stats{}
+	for i := 0; i < 2*maxCoverage; i++ {
+		s.addCoverage(SeriesCoverage{})
+	}
+	if n := len(s.Coverage()); n != maxCoverage {
+		t.Fatalf("expected %d coverages, got %d", maxCoverage, n)
+	}
+}
@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	config_util "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// DefaultMaxIdleConns is the default number of idle connections kept to
+	// a backend.
+	DefaultMaxIdleConns = 1000
+	// DefaultIdleConnTimeout is the default time idle connections to a
+	// backend are kept.
+	DefaultIdleConnTimeout = 5 * time.Minute
+	// DefaultHTTP2ReadIdleTimeout is the default time after which idle
+	// HTTP/2 connections are health checked.
+	DefaultHTTP2ReadIdleTimeout = time.Minute
+)
+
+// TransportConfig tunes the connections to a backend and the encoding of its
+// responses.
+type TransportConfig struct {
+	// Compression lists the content encodings accepted from the backend,
+	// "gzip" and "zstd", in order of preference. Responses are not
+	// compressed if it is empty.
+	Compression []string
+	// MaxIdleConns is the number of idle connections kept to the backend,
+	// DefaultMaxIdleConns if 0.
+	MaxIdleConns int
+	// MaxConns limits the connections to the backend, including those in
+	// use. There's no limit if it is 0.
+	MaxConns int
+	// IdleConnTimeout is the time idle connections are kept,
+	// DefaultIdleConnTimeout if 0. They are kept until the backend closes
+	// them if it is negative.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the period of TCP keep-alive probes, 15s if 0 and
+	// disabled if negative.
+	KeepAlive time.Duration
+	// DisableKeepAlives opens a connection per request.
+	DisableKeepAlives bool
+	// EnableHTTP2 negotiates HTTP/2 with TLS backends.
+	EnableHTTP2 bool
+	// HTTP2ReadIdleTimeout is the time without frames received after which
+	// an HTTP/2 connection is health checked with a ping, so that dead
+	// connections are closed rather than used by the requests multiplexed
+	// on them. It is DefaultHTTP2ReadIdleTimeout if 0, and health checks
+	// are disabled if it is negative.
+	HTTP2ReadIdleTimeout time.Duration
+}
+
+// acceptEncoding returns the value of the Accept-Encoding header of the
+// configured compressions, or an error for unknown ones.
+func (tc *TransportConfig) acceptEncoding() (string, error) {
+	encodings := make([]string, 0, len(tc.Compression))
+	for i, c := range tc.Compression {
+		switch c {
+		case "gzip", "zstd":
+		default:
+			return "", fmt.Errorf("unknown compression %q", c)
+		}
+		// Lower the quality value of each encoding after the first one.
+		switch {
+		case i == 0:
+			encodings = append(encodings, c)
+		case i < 9:
+			encodings = append(encodings, fmt.Sprintf("%s;q=0.%d", c, 10-i))
+		default:
+			encodings = append(encodings, c+";q=0.1")
+		}
+	}
+	return strings.Join(encodings, ", "), nil
+}
+
+// newRoundTripper returns the round tripper of the given HTTP client config,
+// as config_util.NewRoundTripperFromConfig does but with connections tuned
+// by tc. OAuth2 isn't supported.
+func newRoundTripper(cfg config_util.HTTPClientConfig, tc *TransportConfig) (http.RoundTripper, error) {
+	// Validate moves the bearer token settings into Authorization.
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.OAuth2 != nil {
+		return nil, errors.New("oauth2 is not supported by remote clients")
+	}
+	maxIdleConns := tc.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = DefaultMaxIdleConns
+	}
+	idleConnTimeout := tc.IdleConnTimeout
+	switch {
+	case idleConnTimeout == 0:
+		idleConnTimeout = DefaultIdleConnTimeout
+	case idleConnTimeout < 0:
+		idleConnTimeout = 0
+	}
+	readIdleTimeout := tc.HTTP2ReadIdleTimeout
+	switch {
+	case readIdleTimeout == 0:
+		readIdleTimeout = DefaultHTTP2ReadIdleTimeout
+	case readIdleTimeout < 0:
+		readIdleTimeout = 0
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: tc.KeepAlive}
+
+	newRT := func(tlsConfig *tls.Config) (http.RoundTripper, error) {
+		t := &http.Transport{
+			Proxy:                 http.ProxyURL(cfg.ProxyURL.URL),
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			MaxIdleConns:          maxIdleConns,
+			MaxIdleConnsPerHost:   maxIdleConns,
+			MaxConnsPerHost:       tc.MaxConns,
+			IdleConnTimeout:       idleConnTimeout,
+			DisableKeepAlives:     tc.DisableKeepAlives,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			// The responses are decompressed by the client, which negotiates
+			// the encodings itself.
+			DisableCompression: true,
+		}
+		if tc.EnableHTTP2 || cfg.EnableHTTP2 {
+			t2, err := http2.ConfigureTransports(t)
+			if err != nil {
+				return nil, err
+			}
+			t2.ReadIdleTimeout = readIdleTimeout
+		}
+
+		var rt http.RoundTripper = t
+		if auth := cfg.Authorization; auth != nil && len(auth.Credentials) > 0 {
+			rt = config_util.NewAuthorizationCredentialsRoundTripper(auth.Type, auth.Credentials, rt)
+		} else if auth != nil && len(auth.CredentialsFile) > 0 {
+			rt = config_util.NewAuthorizationCredentialsFileRoundTripper(auth.Type, auth.CredentialsFile, rt)
+		}
+		if cfg.BasicAuth != nil {
+			rt = config_util.NewBasicAuthRoundTripper(cfg.BasicAuth.Username, cfg.BasicAuth.Password, cfg.BasicAuth.PasswordFile, rt)
+		}
+		return rt, nil
+	}
+
+	tlsConfig, err := config_util.NewTLSConfig(&cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.TLSConfig.CAFile) == 0 {
+		return newRT(tlsConfig)
+	}
+	// Reload the CA file when it changes.
+	return config_util.NewTLSRoundTripper(tlsConfig, cfg.TLSConfig.CAFile, newRT)
+}
+
+// decodedBody returns a reader of the decompressed body of resp, read from
+// r, along with a function releasing the decompressor.
+func decodedBody(resp *http.Response, r io.Reader) (io.Reader, func(), error) {
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return r, func() {}, nil
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
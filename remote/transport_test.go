@@ -0,0 +1,27 @@
+package remote
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+)
+
+func TestTransportIdleConnTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		configured, expected time.Duration
+	}{
+		{configured: 0, expected: DefaultIdleConnTimeout},
+		{configured: time.Minute, expected: time.Minute},
+		{configured: -1, expected: 0},
+	} {
+		rt, err := newRoundTripper(config_util.HTTPClientConfig{}, &TransportConfig{IdleConnTimeout: tc.configured})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := rt.(*http.Transport).IdleConnTimeout; d != tc.expected {
+			t.Fatalf("configured %s: expected %s, got %s", tc.configured, tc.expected, d)
+		}
+	}
+}